@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kubil6y/myshop-go/internal/authz"
+	"github.com/kubil6y/myshop-go/internal/data"
+	"github.com/kubil6y/myshop-go/internal/validator"
+)
+
+// authzCheckHandler lets other services ask whether a user holds one or more
+// permissions, optionally on a resource, without reimplementing the rules.
+func (app *application) authzCheckHandler(w http.ResponseWriter, r *http.Request) {
+	var input authzCheckDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var subject *data.User
+	var err error
+	if input.Subject.Token != "" {
+		subject, err = app.models.Users.GetForToken(data.ScopeAuthentication, input.Subject.Token)
+	} else {
+		subject, err = app.models.Users.GetByIDWithAccess(input.Subject.UserID)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("subject", "no user matches the subject")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if input.OrganizationID != 0 {
+		membership, err := app.models.Organizations.GetMembership(input.OrganizationID, subject.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("organization_id", "the subject is not a member of the organization")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		subject = subject.InOrganization(membership)
+	}
+
+	ctx := data.AccessContext{
+		Now:     time.Now(),
+		IP:      net.ParseIP(input.Context.IP),
+		UserID:  subject.ID,
+		Params:  input.Context.Params,
+		IsAdmin: app.isAdminUser,
+	}
+
+	decisions := make([]authz.Decision, 0, len(input.Permissions))
+	for _, code := range input.Permissions {
+		decision, err := authz.Evaluate(subject, authz.Request{
+			Permission: code,
+			Resource:   input.Resource,
+			Context:    ctx,
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		decisions = append(decisions, decision)
+	}
+
+	e := envelope{
+		"subject":   map[string]int64{"user_id": subject.ID},
+		"decisions": decisions,
+	}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/kubil6y/myshop-go/internal/data"
+	"github.com/kubil6y/myshop-go/internal/validator"
+)
+
+func (app *application) createBundleHandler(w http.ResponseWriter, r *http.Request) {
+	var input bundleDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	permissions := make([]data.Permission, 0)
+	for _, id := range input.Permissions {
+		permission, err := app.models.Permissions.GetByID(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		permissions = append(permissions, *permission)
+	}
+
+	bundle := data.Bundle{
+		Name:        input.Name,
+		Permissions: permissions,
+	}
+
+	if err := app.models.Bundles.Insert(&bundle); err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRecord):
+			v.AddError("name", "a bundle with that name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	e := envelope{"bundle": bundle}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusCreated, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) getAllBundlesHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	v := validator.New()
+	p := &data.Paginate{
+		Limit: app.readInt(qs, v, "limit", 10),
+		Page:  app.readInt(qs, v, "page", 1),
+	}
+
+	if data.ValidatePaginate(v, p); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	bundles, metadata, err := app.models.Bundles.GetAll(p)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := envelope{
+		"bundles":  bundles,
+		"metadata": metadata,
+	}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) getBundleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	bundle, err := app.models.Bundles.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	e := envelope{"bundle": bundle}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// updateBundleHandler replaces the permissions of the bundle, every role and
+// user holding it picks up the change.
+func (app *application) updateBundleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	var input bundleDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	bundle, err := app.models.Bundles.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var permissions []data.Permission
+	for _, id := range input.Permissions {
+		permission, err := app.models.Permissions.GetByID(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// users would get it without approval.
+		if permission.RequiresApproval && !ContainsPermission(bundle.Permissions, *permission) {
+			attached, err := app.bundleAttachedToUsers(bundle.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			if attached {
+				v.AddError("permissions", fmt.Sprintf("%q requires approval and the bundle is attached to users, grant the permission instead", permission.Name))
+			}
+		}
+
+		permissions = append(permissions, *permission)
+	}
+	if !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	bundle.Name = input.Name
+	bundle.Permissions = permissions
+
+	if err := app.models.Bundles.Update(bundle); err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRecord):
+			v.AddError("name", "a bundle with that name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.models.Users.PurgeCache()
+
+	e := envelope{"message": "resource updated"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) deleteBundleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	bundle, err := app.models.Bundles.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.models.Bundles.Delete(bundle); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.models.Users.PurgeCache()
+
+	e := envelope{"message": "success"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusAccepted, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) grantBundleToUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.updateUserBundles(w, r, true)
+}
+
+func (app *application) revokeBundleToUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.updateUserBundles(w, r, false)
+}
+
+// bundleAttachedToUsers reports whether the bundle is attached to any user.
+func (app *application) bundleAttachedToUsers(id int64) (bool, error) {
+	bundles, err := app.models.Bundles.GetAllAttachedToUsers()
+	if err != nil {
+		return false, err
+	}
+	for _, b := range bundles {
+		if b.ID == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// updateUserBundles attaches the bundles in the request to the user, or
+// detaches them. Bundles with permissions that require approval can not be
+// attached, those permissions have to be granted one by one.
+func (app *application) updateUserBundles(w http.ResponseWriter, r *http.Request, attach bool) {
+	var input bundleToUserDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByIDWithRolesAndPermissions(input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var inputBundles []data.Bundle
+	for _, id := range input.BundleIDs {
+		bundle, err := app.models.Bundles.GetByID(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if attach {
+			for _, p := range bundle.Permissions {
+				if p.RequiresApproval {
+					v.AddError("bundle_ids", fmt.Sprintf("bundle %q contains %q which requires approval, grant the permission instead", bundle.Name, p.Name))
+				}
+			}
+		}
+		inputBundles = append(inputBundles, *bundle)
+	}
+	if !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	containsBundle := func(list []data.Bundle, b data.Bundle) bool {
+		for _, v := range list {
+			if v.ID == b.ID {
+				return true
+			}
+		}
+		return false
+	}
+
+	var bundles []data.Bundle
+	for _, b := range user.Bundles {
+		if attach || !containsBundle(inputBundles, b) {
+			bundles = append(bundles, b)
+		}
+	}
+	if attach {
+		for _, b := range inputBundles {
+			if !containsBundle(bundles, b) {
+				bundles = append(bundles, b)
+			}
+		}
+	}
+	user.Bundles = bundles
+
+	if err := app.models.Users.UpdateBundles(user); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.models.Users.InvalidateCache(user.ID)
+
+	e := envelope{"message": "success"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusAccepted, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
@@ -10,7 +10,10 @@ import (
 // contextKey is a type for avoiding name clashes.
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey  = contextKey("user")
+	tokenContextKey = contextKey("token")
+)
 
 func (app *application) setUserContext(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -25,3 +28,15 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+func (app *application) setTokenContext(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetToken returns the authentication token of the request, it is
+// empty for anonymous users.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/kubil6y/myshop-go/internal/authz"
+	"github.com/kubil6y/myshop-go/internal/data"
+)
+
+// delegation is what the current user is allowed to grant and revoke.
+// Admins manage everything, role managers only the roles and permissions
+// configured on the roles they hold.
+type delegation struct {
+	admin         bool
+	roleIDs       map[int64]bool
+	permissionIDs map[int64]bool
+}
+
+func (d *delegation) isManager() bool {
+	return d.admin || len(d.roleIDs) > 0 || len(d.permissionIDs) > 0
+}
+
+func (d *delegation) canManageRole(role data.Role) bool {
+	return d.admin || d.roleIDs[role.ID]
+}
+
+func (d *delegation) canManagePermission(permission data.Permission) bool {
+	return d.admin || d.permissionIDs[permission.ID]
+}
+
+func (app *application) delegationFor(user *data.User) (*delegation, error) {
+	d := &delegation{
+		admin:         authz.IsAdmin(user),
+		roleIDs:       make(map[int64]bool),
+		permissionIDs: make(map[int64]bool),
+	}
+	if d.admin {
+		return d, nil
+	}
+
+	var roleIDs []int64
+	for _, role := range user.Roles {
+		roleIDs = append(roleIDs, role.ID)
+	}
+	managedRoleIDs, managedPermissionIDs, err := app.models.Roles.ManagedBy(roleIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range managedRoleIDs {
+		d.roleIDs[id] = true
+	}
+	for _, id := range managedPermissionIDs {
+		d.permissionIDs[id] = true
+	}
+	return d, nil
+}
+
+// unheldPermissions returns the names of the permissions the current user
+// does not hold for good, a role manager can not hand out more than they
+// have. Elevations, grants with a time window and conditional permissions do
+// not count. Admins hold everything.
+func (app *application) unheldPermissions(r *http.Request, d *delegation, permissions []data.Permission) ([]string, error) {
+	if d.admin {
+		return nil, nil
+	}
+
+	user := app.contextGetUser(r)
+	standing := user.StandingAccess()
+	var names []string
+	for _, p := range permissions {
+		decision, err := authz.Evaluate(standing, authz.Request{
+			Permission: p.Name,
+			Context:    app.accessContext(r, user),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !decision.Allowed {
+			names = append(names, p.Name)
+		}
+	}
+	return names, nil
+}
+
+// requireRoleManager lets admins and role managers through, the handlers
+// check each role and permission against the delegation.
+func (app *application) requireRoleManager(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, err := app.delegationFor(app.contextGetUser(r))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !d.isManager() {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireActivatedUser(fn)
+}
+
+// checkDelegatedRoles responds with 403 and returns false unless the current
+// user manages every role. When granting, the user must also hold every
+// permission of the roles, including the inherited ones.
+func (app *application) checkDelegatedRoles(w http.ResponseWriter, r *http.Request, roles []data.Role, granting bool) bool {
+	d, err := app.delegationFor(app.contextGetUser(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	var unmanaged []string
+	var permissions []data.Permission
+	for _, role := range roles {
+		if !d.canManageRole(role) {
+			unmanaged = append(unmanaged, role.Name)
+		}
+		permissions = append(permissions, role.AllPermissions()...)
+	}
+	if len(unmanaged) > 0 {
+		app.notDelegatedResponse(w, r, "roles", unmanaged)
+		return false
+	}
+	if !granting {
+		return true
+	}
+
+	unheld, err := app.unheldPermissions(r, d, permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if len(unheld) > 0 {
+		app.unheldPermissionsResponse(w, r, unheld)
+		return false
+	}
+	return true
+}
+
+// checkDelegatedPermissions is checkDelegatedRoles for permissions.
+func (app *application) checkDelegatedPermissions(w http.ResponseWriter, r *http.Request, permissions []data.Permission, granting bool) bool {
+	d, err := app.delegationFor(app.contextGetUser(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	var unmanaged []string
+	for _, p := range permissions {
+		if !d.canManagePermission(p) {
+			unmanaged = append(unmanaged, p.Name)
+		}
+	}
+	if len(unmanaged) > 0 {
+		app.notDelegatedResponse(w, r, "permissions", unmanaged)
+		return false
+	}
+	if !granting {
+		return true
+	}
+
+	unheld, err := app.unheldPermissions(r, d, permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if len(unheld) > 0 {
+		app.unheldPermissionsResponse(w, r, unheld)
+		return false
+	}
+	return true
+}
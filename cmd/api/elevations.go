@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/kubil6y/myshop-go/internal/data"
+	"github.com/kubil6y/myshop-go/internal/validator"
+)
+
+// elevateHandler is the break-glass: a user with the break-glass permission
+// temporarily gains a role by giving a written reason. Permission checks see
+// the role until the elevation expires. Roles that require approval and
+// roles that conflict with the ones the user holds can not be gained.
+func (app *application) elevateHandler(w http.ResponseWriter, r *http.Request) {
+	var input elevateDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v, app.config.breakGlass.maxDuration); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	role, err := app.models.Roles.GetByID(input.RoleID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if role.OrganizationID != nil {
+		v.AddError("role_id", "organization roles can not be used for elevation")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if role.RequiresApproval {
+		v.AddError("role_id", "roles that require approval can not be used for elevation")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	conflicts, err := app.newRoleConflicts(user.EffectiveRoles(), []data.Role{*role})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if len(conflicts) > 0 {
+		app.roleConflictResponse(w, r, conflicts)
+		return
+	}
+
+	elevation := data.Elevation{
+		UserID:    &user.ID,
+		UserEmail: user.Email,
+		RoleID:    &role.ID,
+		Role:      role,
+		RoleName:  role.Name,
+		Reason:    input.Reason,
+		ExpiresAt: time.Now().Add(time.Duration(input.Minutes) * time.Minute),
+	}
+
+	if err := app.models.Elevations.Insert(&elevation); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.models.Users.InvalidateCache(user.ID)
+
+	app.logger.Warnw("BREAK-GLASS elevation granted",
+		"elevation_id", elevation.ID,
+		"user_id", user.ID,
+		"email", user.Email,
+		"role", role.Name,
+		"reason", elevation.Reason,
+		"expires_at", elevation.ExpiresAt,
+		"remote_addr", r.RemoteAddr,
+	)
+
+	e := envelope{"elevation": elevation}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusCreated, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) getAllElevationsHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	v := validator.New()
+	p := &data.Paginate{
+		Limit: app.readInt(qs, v, "limit", 10),
+		Page:  app.readInt(qs, v, "page", 1),
+	}
+
+	if data.ValidatePaginate(v, p); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	elevations, metadata, err := app.models.Elevations.GetAll(p)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := envelope{
+		"elevations": elevations,
+		"metadata":   metadata,
+	}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
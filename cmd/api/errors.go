@@ -1,8 +1,18 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+
+	"github.com/kubil6y/myshop-go/internal/data"
+)
+
+var (
+	errInvalidOrganization = errors.New("invalid organization id")
+	errNotMember           = errors.New("not a member of the organization")
+	errNoOrganization      = errors.New("an organization must be selected")
 )
 
 func (app *application) logError(r *http.Request, err error) {
@@ -79,3 +89,55 @@ func (app *application) resourceAlreadyExists(w http.ResponseWriter, r *http.Req
 	message := "the requested resource already exists"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) notMemberResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account is not a member of the selected organization"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// organizationErrorResponse responds to the errors of selecting the
+// current organization.
+func (app *application) organizationErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errInvalidOrganization), errors.Is(err, errNoOrganization):
+		app.badRequestResponse(w, r, err)
+	case errors.Is(err, errNotMember):
+		app.notMemberResponse(w, r)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) grantRequestNotPendingResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the grant request is no longer pending"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) notMemberAnymoreResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the user is no longer a member of the organization of the grant request"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) sameApproverResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a grant request must be approved by an admin other than the requester and the grantee"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) roleConflictResponse(w http.ResponseWriter, r *http.Request, conflicts []data.RoleConflict) {
+	var names []string
+	for _, c := range conflicts {
+		names = append(names, fmt.Sprintf("%q and %q", c.Role.Name, c.ConflictingRole.Name))
+	}
+	message := fmt.Sprintf("conflicting roles can not be held together: %s", strings.Join(names, ", "))
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) notDelegatedResponse(w http.ResponseWriter, r *http.Request, field string, names []string) {
+	message := fmt.Sprintf("you can not grant or revoke %s: %s", field, strings.Join(names, ", "))
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) unheldPermissionsResponse(w http.ResponseWriter, r *http.Request, names []string) {
+	message := fmt.Sprintf("you can not hand out permissions you don't hold: %s", strings.Join(names, ", "))
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
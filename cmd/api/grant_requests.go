@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/kubil6y/myshop-go/internal/data"
+	"github.com/kubil6y/myshop-go/internal/validator"
+)
+
+// grantRoles adds the roles to the user. A grant without a window is
+// permanent, granting again replaces the window.
+func (app *application) grantRoles(user *data.User, roles []data.Role, window data.GrantWindow) error {
+	var ids []int64
+	for _, role := range roles {
+		ids = append(ids, role.ID)
+	}
+
+	if err := app.models.Users.GrantRoles(user.ID, ids, window); err != nil {
+		return err
+	}
+	app.models.Users.InvalidateCache(user.ID)
+	return nil
+}
+
+// grantPermissions adds the permissions to the custom granted permissions
+// of the user and takes them out of the revoked ones. A grant without a
+// window is permanent, granting again replaces the window.
+func (app *application) grantPermissions(user *data.User, permissions []data.Permission, window data.GrantWindow) error {
+	var ids []int64
+	for _, p := range permissions {
+		ids = append(ids, p.ID)
+	}
+
+	if err := app.models.Users.GrantPermissions(user.ID, ids, window); err != nil {
+		return err
+	}
+	app.models.Users.InvalidateCache(user.ID)
+	return nil
+}
+
+// requestGrants creates pending grant requests on behalf of the current user.
+func (app *application) requestGrants(r *http.Request, userID int64, kind string, targetIDs []int64, window data.GrantWindow) ([]*data.GrantRequest, error) {
+	base := data.GrantRequest{UserID: userID, Kind: kind, GrantWindow: window}
+	return app.insertGrantRequests(r, base, targetIDs)
+}
+
+// requestMembershipRoles creates pending grant requests for roles of the
+// user in the organization on behalf of the current user.
+func (app *application) requestMembershipRoles(r *http.Request, organizationID, userID int64, roleIDs []int64) ([]*data.GrantRequest, error) {
+	base := data.GrantRequest{UserID: userID, Kind: data.GrantKindMembershipRole, OrganizationID: &organizationID}
+	return app.insertGrantRequests(r, base, roleIDs)
+}
+
+// insertGrantRequests creates a pending request like base for every target.
+func (app *application) insertGrantRequests(r *http.Request, base data.GrantRequest, targetIDs []int64) ([]*data.GrantRequest, error) {
+	requester := app.contextGetUser(r)
+
+	requests := make([]*data.GrantRequest, 0)
+	for _, id := range targetIDs {
+		request := base
+		request.TargetID = id
+		request.Status = data.GrantRequestPending
+		request.RequestedByID = requester.ID
+		request.PendingUntil = time.Now().Add(app.config.approval.ttl)
+		if err := app.models.GrantRequests.Insert(&request); err != nil {
+			return nil, err
+		}
+
+		app.logger.Infow("grant request created",
+			"grant_request_id", request.ID,
+			"kind", request.Kind,
+			"target_id", id,
+			"user_id", request.UserID,
+			"organization_id", request.OrganizationID,
+			"requested_by_id", requester.ID,
+		)
+		requests = append(requests, &request)
+	}
+	return requests, nil
+}
+
+func (app *application) getAllGrantRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	v := validator.New()
+	status := app.readString(qs, "status", "")
+	p := &data.Paginate{
+		Limit: app.readInt(qs, v, "limit", 10),
+		Page:  app.readInt(qs, v, "page", 1),
+	}
+
+	data.ValidateGrantRequestStatus(v, status)
+	if data.ValidatePaginate(v, p); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	requests, metadata, err := app.models.GrantRequests.GetAll(status, p)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := envelope{
+		"grant_requests": requests,
+		"metadata":       metadata,
+	}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) getGrantRequestHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	request, err := app.models.GrantRequests.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	e := envelope{"grant_request": request}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// approveGrantRequestHandler applies a pending grant. The approver must be a
+// different admin than the one who requested it and than the grantee.
+func (app *application) approveGrantRequestHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	request, err := app.models.GrantRequests.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !request.IsPending(time.Now()) {
+		app.grantRequestNotPendingResponse(w, r)
+		return
+	}
+
+	approver := app.contextGetUser(r)
+	if approver.ID == request.RequestedByID || approver.ID == request.UserID {
+		app.sameApproverResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.GetByIDWithRolesAndPermissions(request.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	switch request.Kind {
+	case data.GrantKindRole, data.GrantKindMembershipRole:
+		role, err := app.models.Roles.GetByID(request.TargetID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// membership roles are held together with the global ones.
+		held := append([]data.Role{}, user.Roles...)
+		if request.Kind == data.GrantKindMembershipRole {
+			membership, err := app.models.Organizations.GetMembership(*request.OrganizationID, request.UserID)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.notMemberAnymoreResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+			held = append(held, membership.Roles...)
+		}
+
+		conflicts, err := app.newRoleConflicts(held, []data.Role{*role})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if len(conflicts) > 0 {
+			app.roleConflictResponse(w, r, conflicts)
+			return
+		}
+
+	case data.GrantKindPermission:
+		if _, err := app.models.Permissions.GetByID(request.TargetID); err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	// the decision and the grant are written together, only the approval
+	// that wins the decision applies the grant.
+	if err := app.models.GrantRequests.Approve(request, approver.ID); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.grantRequestNotPendingResponse(w, r)
+		case errors.Is(err, data.ErrNotMember):
+			app.notMemberAnymoreResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.models.Users.InvalidateCache(request.UserID)
+
+	app.logger.Infow("grant request approved",
+		"grant_request_id", request.ID,
+		"user_id", request.UserID,
+		"approved_by_id", approver.ID,
+	)
+
+	e := envelope{"grant_request": request}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) rejectGrantRequestHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	request, err := app.models.GrantRequests.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !request.IsPending(time.Now()) {
+		app.grantRequestNotPendingResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	if err := app.models.GrantRequests.Decide(request, data.GrantRequestRejected, user.ID); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.grantRequestNotPendingResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	e := envelope{"grant_request": request}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kubil6y/myshop-go/internal/data"
+	"github.com/kubil6y/myshop-go/internal/mailer"
+	"go.uber.org/zap"
+)
+
+// newTestApplication returns an application backed by the in-memory models.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	var cfg config
+	cfg.tokens.accessTTL = time.Hour
+	cfg.tokens.refreshTTL = 24 * time.Hour
+	cfg.approval.ttl = 24 * time.Hour
+	cfg.activation.ttl = time.Hour
+	cfg.mailer.dir = t.TempDir()
+
+	return &application{
+		config:   cfg,
+		logger:   zap.NewNop().Sugar(),
+		models:   data.NewMemoryModels(),
+		mailer:   mailer.FileMailer{Dir: cfg.mailer.dir},
+		lastUsed: newLastUsedTracker(),
+		shutdown: make(chan struct{}),
+	}
+}
+
+// newTestUser inserts an activated user with the permissions granted and
+// returns the user with an authentication token.
+func newTestUser(t *testing.T, app *application, email string, permissions ...*data.Permission) (*data.User, string) {
+	t.Helper()
+
+	user := &data.User{FirstName: "Fo", LastName: "La", Email: email, IsActivated: true}
+	if err := user.SetPassword("secret123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Users.Insert(user); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int64
+	for _, p := range permissions {
+		ids = append(ids, p.ID)
+	}
+	if len(ids) > 0 {
+		if err := app.models.Users.GrantPermissions(user.ID, ids, data.GrantWindow{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	token, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token.Plaintext
+}
+
+func newTestPermission(t *testing.T, app *application, name string) *data.Permission {
+	t.Helper()
+	p := &data.Permission{Name: name}
+	if err := app.models.Permissions.Insert(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func newTestRole(t *testing.T, app *application, r *data.Role) *data.Role {
+	t.Helper()
+	if err := app.models.Roles.Insert(r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// do sends a request through the routes and returns the status and the
+// decoded body.
+func do(t *testing.T, app *application, token, method, path, body string, header http.Header) (int, map[string]interface{}) {
+	t.Helper()
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("%s %s: decoding %q: %v", method, path, w.Body.String(), err)
+	}
+	return w.Code, decoded
+}
+
+func TestCreateRoleHandler(t *testing.T) {
+	app := newTestApplication(t)
+	admin := newTestPermission(t, app, "admin")
+	_, token := newTestUser(t, app, "admin@example.com", admin)
+
+	organization := &data.Organization{Name: "acme"}
+	if err := app.models.Organizations.Insert(organization); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"global role", `{"name":"editor","permissions":[1]}`, http.StatusCreated},
+		{"duplicate global role", `{"name":"editor","permissions":[1]}`, http.StatusUnprocessableEntity},
+		{"organization role with a global name", `{"name":"editor","permissions":[1],"organization_id":1}`, http.StatusCreated},
+		{"duplicate organization role", `{"name":"editor","permissions":[1],"organization_id":1}`, http.StatusUnprocessableEntity},
+		{"no permissions", `{"name":"viewer"}`, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := do(t, app, token, http.MethodPost, "/v1/admin/roles", tt.body, nil)
+			if status != tt.want {
+				t.Fatalf("got status %d, want %d: %v", status, tt.want, body)
+			}
+		})
+	}
+}
+
+func TestOrganizationPermissionsLeaveOutGlobalGrants(t *testing.T) {
+	app := newTestApplication(t)
+	admin := newTestPermission(t, app, "admin")
+	membersRead := newTestPermission(t, app, "members:read")
+	user, token := newTestUser(t, app, "admin@example.com", admin)
+
+	organization := &data.Organization{Name: "acme"}
+	if err := app.models.Organizations.Insert(organization); err != nil {
+		t.Fatal(err)
+	}
+	reader := newTestRole(t, app, &data.Role{Name: "reader", Permissions: []data.Permission{*membersRead}, OrganizationID: &organization.ID})
+	if _, err := app.models.Organizations.SetMembership(organization.ID, user.ID, []data.Role{*reader}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   []interface{}
+	}{
+		{"global", nil, []interface{}{"admin"}},
+		{"in organization", http.Header{"X-Organization-Id": {"1"}}, []interface{}{"members:read"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := do(t, app, token, http.MethodGet, "/v1/profile/permissions", "", tt.header)
+			if status != http.StatusOK {
+				t.Fatalf("got status %d: %v", status, body)
+			}
+			got := body["data"].(map[string]interface{})["permissions"]
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got permissions %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetMembershipHandlerChecksGlobalRoles(t *testing.T) {
+	app := newTestApplication(t)
+	admin := newTestPermission(t, app, "admin")
+	_, token := newTestUser(t, app, "admin@example.com", admin)
+	member, _ := newTestUser(t, app, "member@example.com")
+
+	approver := newTestRole(t, app, &data.Role{Name: "approver"})
+	requester := newTestRole(t, app, &data.Role{Name: "requester"})
+	if err := app.models.Conflicts.Insert(&data.RoleConflict{RoleID: approver.ID, ConflictingRoleID: requester.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Users.GrantRoles(member.ID, []int64{approver.ID}, data.GrantWindow{}); err != nil {
+		t.Fatal(err)
+	}
+
+	organization := &data.Organization{Name: "acme"}
+	if err := app.models.Organizations.Insert(organization); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"user_id":2,"role_ids":[2]}`
+	status, decoded := do(t, app, token, http.MethodPut, "/v1/admin/organizations/1/members", body, nil)
+	if status != http.StatusConflict {
+		t.Fatalf("got status %d, want %d: %v", status, http.StatusConflict, decoded)
+	}
+}
+
+func TestGrantPermissionHandlerNeedsStandingGrants(t *testing.T) {
+	app := newTestApplication(t)
+	ordersRead := newTestPermission(t, app, "orders:read")
+	manager, token := newTestUser(t, app, "manager@example.com")
+	newTestUser(t, app, "member@example.com")
+
+	supportManager := newTestRole(t, app, &data.Role{Name: "support-manager", Permissions: []data.Permission{*ordersRead}})
+	if err := app.models.Roles.SetManaged(supportManager, nil, []data.Permission{*ordersRead}); err != nil {
+		t.Fatal(err)
+	}
+	supportLead := newTestRole(t, app, &data.Role{Name: "support-lead", Parents: []data.Role{*supportManager}})
+
+	tests := []struct {
+		name   string
+		window data.GrantWindow
+		want   int
+	}{
+		{"inherited standing role", data.GrantWindow{}, http.StatusAccepted},
+		{"inherited role with a window", data.GrantWindow{ExpiresAt: timePtr(time.Now().Add(time.Hour))}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := app.models.Users.GrantRoles(manager.ID, []int64{supportLead.ID}, tt.window); err != nil {
+				t.Fatal(err)
+			}
+
+			body := `{"user_id":2,"permission_ids":[1]}`
+			status, decoded := do(t, app, token, http.MethodPost, "/v1/admin/users/grant-permission", body, nil)
+			if status != tt.want {
+				t.Fatalf("got status %d, want %d: %v", status, tt.want, decoded)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestOrganizationRolesStayInTheirOrganization(t *testing.T) {
+	app := newTestApplication(t)
+	admin := newTestPermission(t, app, "admin")
+	membersRead := newTestPermission(t, app, "members:read")
+	user, token := newTestUser(t, app, "owner@example.com")
+
+	organization := &data.Organization{Name: "acme"}
+	if err := app.models.Organizations.Insert(organization); err != nil {
+		t.Fatal(err)
+	}
+	owner := newTestRole(t, app, &data.Role{Name: "owner", Permissions: []data.Permission{*admin, *membersRead}, OrganizationID: &organization.ID})
+	if _, err := app.models.Organizations.SetMembership(organization.ID, user.ID, []data.Role{*owner}); err != nil {
+		t.Fatal(err)
+	}
+
+	inOrganization := http.Header{"X-Organization-Id": {"1"}}
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		want   int
+	}{
+		{"global route", "/v1/admin/roles", nil, http.StatusForbidden},
+		{"global route with an organization selected", "/v1/admin/roles", inOrganization, http.StatusForbidden},
+		{"tenant route", "/v1/organizations/1/members", nil, http.StatusOK},
+		{"tenant route of another organization", "/v1/organizations/2/members", nil, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := do(t, app, token, http.MethodGet, tt.path, "", tt.header)
+			if status != tt.want {
+				t.Fatalf("got status %d, want %d: %v", status, tt.want, body)
+			}
+		})
+	}
+}
+
+func TestGrantRoleHandlerIgnoresExistingViolations(t *testing.T) {
+	app := newTestApplication(t)
+	admin := newTestPermission(t, app, "admin")
+	_, token := newTestUser(t, app, "admin@example.com", admin)
+	member, _ := newTestUser(t, app, "member@example.com")
+
+	approver := newTestRole(t, app, &data.Role{Name: "approver"})
+	requester := newTestRole(t, app, &data.Role{Name: "requester"})
+	newTestRole(t, app, &data.Role{Name: "viewer"})
+	// the conflict is added after the user already holds both roles.
+	if err := app.models.Users.GrantRoles(member.ID, []int64{approver.ID, requester.ID}, data.GrantWindow{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Conflicts.Insert(&data.RoleConflict{RoleID: approver.ID, ConflictingRoleID: requester.ID}); err != nil {
+		t.Fatal(err)
+	}
+	auditor := newTestRole(t, app, &data.Role{Name: "auditor"})
+	if err := app.models.Conflicts.Insert(&data.RoleConflict{RoleID: auditor.ID, ConflictingRoleID: approver.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"unrelated role", `{"user_id":2,"role_ids":[3]}`, http.StatusAccepted},
+		{"role conflicting with a held one", `{"user_id":2,"role_ids":[4]}`, http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := do(t, app, token, http.MethodPost, "/v1/admin/users/grant-role", tt.body, nil)
+			if status != tt.want {
+				t.Fatalf("got status %d, want %d: %v", status, tt.want, body)
+			}
+		})
+	}
+}
+
+func TestBundleUpdatesKeepApprovalOutOfUserBundles(t *testing.T) {
+	app := newTestApplication(t)
+	admin := newTestPermission(t, app, "admin")
+	_, token := newTestUser(t, app, "admin@example.com", admin)
+	member, _ := newTestUser(t, app, "member@example.com")
+
+	ordersRead := newTestPermission(t, app, "orders:read")
+	refunds := &data.Permission{Name: "orders:refund", RequiresApproval: true}
+	if err := app.models.Permissions.Insert(refunds); err != nil {
+		t.Fatal(err)
+	}
+	newTestPermission(t, app, "orders:export")
+
+	for _, name := range []string{"support", "spare"} {
+		if err := app.models.Bundles.Insert(&data.Bundle{Name: name, Permissions: []data.Permission{*ordersRead}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	support, err := app.models.Bundles.GetByName("support")
+	if err != nil {
+		t.Fatal(err)
+	}
+	member.Bundles = []data.Bundle{*support}
+	if err := app.models.Users.UpdateBundles(member); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"approval permission into an attached bundle", "/v1/admin/bundles/1", `{"name":"support","permissions":[2,3]}`, http.StatusUnprocessableEntity},
+		{"approval permission into a detached bundle", "/v1/admin/bundles/2", `{"name":"spare","permissions":[2,3]}`, http.StatusOK},
+		{"approval on a permission of an attached bundle", "/v1/admin/permissions/2", `{"name":"orders:read","requires_approval":true}`, http.StatusUnprocessableEntity},
+		{"approval on a permission of no attached bundle", "/v1/admin/permissions/4", `{"name":"orders:export","requires_approval":true}`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := do(t, app, token, http.MethodPut, tt.path, tt.body, nil)
+			if status != tt.want {
+				t.Fatalf("got status %d, want %d: %v", status, tt.want, body)
+			}
+		})
+	}
+}
+
+// sentTokens waits for the emails being sent and returns the tokens in the
+// ones written so far, oldest first.
+func sentTokens(t *testing.T, app *application) []string {
+	t.Helper()
+	app.wg.Wait()
+
+	entries, err := os.ReadDir(app.config.mailer.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens []string
+	for _, entry := range entries {
+		content, err := os.ReadFile(app.config.mailer.dir + "/" + entry.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := regexp.MustCompile(`"token": "([A-Z0-9]+)"`).FindSubmatch(content); m != nil {
+			tokens = append(tokens, string(m[1]))
+		}
+	}
+	return tokens
+}
+
+func TestActivationTokenResend(t *testing.T) {
+	app := newTestApplication(t)
+
+	register := `{"first_name":"Fo","last_name":"La","email":"new@example.com","password":"secret123"}`
+	if status, body := do(t, app, "", http.MethodPost, "/v1/users", register, nil); status != http.StatusCreated {
+		t.Fatalf("registering: got status %d: %v", status, body)
+	}
+	app.wg.Wait()
+	if status, body := do(t, app, "", http.MethodPost, "/v1/tokens/activation", `{"email":"unknown@example.com"}`, nil); status != http.StatusAccepted {
+		t.Fatalf("resending to an unknown email: got status %d: %v", status, body)
+	}
+	if status, body := do(t, app, "", http.MethodPost, "/v1/tokens/activation", `{"email":"new@example.com"}`, nil); status != http.StatusAccepted {
+		t.Fatalf("resending: got status %d: %v", status, body)
+	}
+
+	tokens := sentTokens(t, app)
+	if len(tokens) != 2 {
+		t.Fatalf("got %d emails with a token, want 2", len(tokens))
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"replaced token", tokens[0], http.StatusUnprocessableEntity},
+		{"resent token", tokens[1], http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := do(t, app, "", http.MethodPut, "/v1/users/activated", `{"token":"`+tt.token+`"}`, nil)
+			if status != tt.want {
+				t.Fatalf("got status %d, want %d: %v", status, tt.want, body)
+			}
+		})
+	}
+}
+
+func TestRequireScopedPermission(t *testing.T) {
+	app := newTestApplication(t)
+	ordersWrite := newTestPermission(t, app, "orders:write")
+	storeClerk, storeToken := newTestUser(t, app, "clerk@example.com")
+	_, globalToken := newTestUser(t, app, "manager@example.com", ordersWrite)
+	_, otherToken := newTestUser(t, app, "other@example.com")
+
+	err := app.models.Scoped.Insert(&data.ScopedUserPermission{UserID: storeClerk.ID, PermissionID: ordersWrite.ID, ResourceType: "store", ResourceID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := httprouter.New()
+	router.HandlerFunc(http.MethodPost, "/v1/stores/:store_id/orders", app.requireScopedPermission("orders:write", "store", "store_id", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	handler := app.authenticate(router)
+
+	tests := []struct {
+		name  string
+		token string
+		path  string
+		want  int
+	}{
+		{"granted on the store", storeToken, "/v1/stores/7/orders", http.StatusNoContent},
+		{"granted on another store", storeToken, "/v1/stores/8/orders", http.StatusForbidden},
+		{"granted globally", globalToken, "/v1/stores/8/orders", http.StatusNoContent},
+		{"not granted", otherToken, "/v1/stores/7/orders", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
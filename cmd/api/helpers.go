@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/kubil6y/myshop-go/internal/data"
+	"github.com/kubil6y/myshop-go/internal/mailer"
 	"github.com/kubil6y/myshop-go/internal/validator"
 )
 
@@ -106,11 +108,15 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 }
 
 func (app *application) readIDParam(r *http.Request) (int64, error) {
+	return app.readInt64Param(r, "id")
+}
+
+func (app *application) readInt64Param(r *http.Request, name string) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
-	s := params.ByName("id")
+	s := params.ByName(name)
 	id, err := strconv.ParseInt(s, 10, 64)
 	if err != nil || id < 0 {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 	return id, nil
 }
@@ -130,6 +136,20 @@ func (app *application) background(fn func()) {
 	}()
 }
 
+// sendMail renders the template and sends it to the recipient in the
+// background, failures are only logged.
+func (app *application) sendMail(recipient, templateFile string, templateData interface{}) {
+	app.background(func() {
+		msg, err := mailer.Render(recipient, templateFile, templateData)
+		if err == nil {
+			err = app.mailer.Send(msg)
+		}
+		if err != nil {
+			app.logger.Errorw("sending email failed", "template", templateFile, "error", err)
+		}
+	})
+}
+
 func (app *application) intSliceToSet(nums []int64) []int64 {
 	var result []int64
 	cache := map[int64]bool{}
@@ -166,6 +186,19 @@ func (app *application) readInt(qs url.Values, v *validator.Validator, key strin
 	return i
 }
 
+func (app *application) readBool(qs url.Values, v *validator.Validator, key string, defaultValue bool) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+	return b
+}
+
 func (app *application) readCSV(qs url.Values, key string, defaultValue []string) []string {
 	csv := qs.Get(key)
 	if csv == "" {
@@ -195,6 +228,17 @@ func CleanedIS(target, input []int64) []int64 {
 	return result
 }
 
+// permissionsETag returns a strong ETag for the effective permissions of a
+// user, it changes whenever the list changes.
+func permissionsETag(userID int64, permissions []string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n", userID)
+	for _, p := range permissions {
+		fmt.Fprintf(h, "%s\n", p)
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum(nil))
+}
+
 func ContainsPermission(list []data.Permission, target data.Permission) bool {
 	for _, v := range list {
 		if v.ID == target.ID {
@@ -203,3 +247,12 @@ func ContainsPermission(list []data.Permission, target data.Permission) bool {
 	}
 	return false
 }
+
+func ContainsRole(list []data.Role, target data.Role) bool {
+	for _, v := range list {
+		if v.ID == target.ID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// sweepExpiredGrants periodically removes the role and permission grants of
+// users that have expired. Permission checks already ignore them, this only
+// keeps the join tables clean.
+func (app *application) sweepExpiredGrants() {
+	ticker := time.NewTicker(app.config.grants.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		n, err := app.models.Users.DeleteExpiredGrants()
+		if err != nil {
+			app.logger.Errorw("failed to remove expired grants", "error", err.Error())
+			continue
+		}
+		if n > 0 {
+			app.logger.Infow("removed expired grants", "count", n)
+		}
+	}
+}
+
+// expirePendingGrantRequests periodically marks the grant requests that were
+// not approved or rejected in time as expired.
+func (app *application) expirePendingGrantRequests() {
+	ticker := time.NewTicker(app.config.grants.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		n, err := app.models.GrantRequests.ExpirePending()
+		if err != nil {
+			app.logger.Errorw("failed to expire grant requests", "error", err.Error())
+			continue
+		}
+		if n > 0 {
+			app.logger.Infow("expired grant requests", "count", n)
+		}
+	}
+}
+
+// flushTokenLastUsed periodically writes the last used times collected by
+// authenticate, so requests do not have to write to the database. On
+// shutdown it writes what is left before it returns.
+func (app *application) flushTokenLastUsed() {
+	ticker := time.NewTicker(app.config.sessions.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.shutdown:
+			app.writeTokenLastUsed()
+			return
+		case <-ticker.C:
+			app.writeTokenLastUsed()
+		}
+	}
+}
+
+// writeTokenLastUsed writes one batch of last used times. If the write fails
+// or panics the times go back to the tracker for the next batch, and the
+// panic is recovered so flushTokenLastUsed keeps running.
+func (app *application) writeTokenLastUsed() {
+	lastUsed := app.lastUsed.take()
+	if len(lastUsed) == 0 {
+		return
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			app.lastUsed.restore(lastUsed)
+			app.logger.Errorw("failed to update token last used times", "error", fmt.Sprint(err), "count", len(lastUsed))
+		}
+	}()
+
+	if err := app.models.Tokens.UpdateLastUsed(lastUsed); err != nil {
+		app.lastUsed.restore(lastUsed)
+		app.logger.Errorw("failed to update token last used times", "error", err.Error(), "count", len(lastUsed))
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/kubil6y/myshop-go/internal/data"
+	"github.com/kubil6y/myshop-go/internal/mailer"
+	"github.com/kubil6y/myshop-go/internal/migrations"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -15,20 +18,56 @@ type config struct {
 	port int
 	env  string
 	db   struct {
-		dsn string
+		driver string
+		dsn    string
 	}
 	limiter struct {
 		enabled bool
 		rps     float64
 		burst   int
 	}
+	grants struct {
+		sweepInterval time.Duration
+	}
+	approval struct {
+		ttl time.Duration
+	}
+	breakGlass struct {
+		maxDuration time.Duration
+	}
+	cache struct {
+		enabled bool
+		size    int
+		ttl     time.Duration
+	}
+	tokens struct {
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+	}
+	activation struct {
+		ttl time.Duration
+	}
+	passwordReset struct {
+		ttl time.Duration
+	}
+	sessions struct {
+		flushInterval time.Duration
+	}
+	mailer struct {
+		kind string
+		dir  string
+	}
 }
 
 type application struct {
-	config config
-	logger *zap.SugaredLogger
-	models data.Models
-	wg     sync.WaitGroup
+	config   config
+	logger   *zap.SugaredLogger
+	models   data.Models
+	mailer   mailer.Mailer
+	lastUsed *lastUsedTracker
+	wg       sync.WaitGroup
+	// shutdown is closed when the server stops, background jobs return.
+	shutdown chan struct{}
 }
 
 func main() {
@@ -42,18 +81,59 @@ func main() {
 
 	db, err := connectDatabase(cfg)
 	if err != nil {
-		sugar.Fatal("database connection failed")
+		sugar.Fatalw("database connection failed", "error", err)
+	}
+	if err := migrations.Check(db); err != nil {
+		sugar.Fatalw("database schema is not up to date, run: rbacctl migrate up", "error", err)
 	}
-	autoMigrate(db)
 	sugar.Info("database connection pool established")
 
+	models := data.NewModels(db)
+	if cfg.cache.enabled {
+		models.Users = data.UserModel{DB: db, Cache: data.NewUserCache(cfg.cache.size, cfg.cache.ttl)}
+	}
+
+	m, err := newMailer(cfg, sugar)
+	if err != nil {
+		sugar.Fatalw("mailer setup failed", "error", err)
+	}
+
 	app := &application{
-		config: cfg,
-		logger: sugar,
-		models: data.NewModels(db),
+		config:   cfg,
+		logger:   sugar,
+		models:   models,
+		mailer:   m,
+		lastUsed: newLastUsedTracker(),
+		shutdown: make(chan struct{}),
 	}
 
+	app.background(app.sweepExpiredGrants)
+	app.background(app.expirePendingGrantRequests)
+	app.background(app.flushTokenLastUsed)
+
 	if err := app.serve(); err != nil {
 		app.logger.Fatalf("failed to start %s server", app.config.env)
 	}
 }
+
+// newMailer returns the mailer picked by -mailer. The log and file mailers
+// write activation and reset tokens in plain text, so outside development
+// one has to be picked on purpose.
+func newMailer(cfg config, logger *zap.SugaredLogger) (mailer.Mailer, error) {
+	kind := cfg.mailer.kind
+	if kind == "" {
+		if cfg.env != "development" {
+			return nil, fmt.Errorf("-mailer must be set in the %s environment", cfg.env)
+		}
+		kind = "log"
+	}
+
+	switch kind {
+	case "log":
+		return mailer.LogMailer{Logger: logger}, nil
+	case "file":
+		return mailer.FileMailer{Dir: cfg.mailer.dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", kind)
+	}
+}
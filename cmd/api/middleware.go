@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/julienschmidt/httprouter"
+	"github.com/kubil6y/myshop-go/internal/authz"
 	"github.com/kubil6y/myshop-go/internal/data"
 	"github.com/kubil6y/myshop-go/internal/validator"
 	"golang.org/x/time/rate"
@@ -96,6 +99,7 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-Organization-ID")
 		authorizationHeader := r.Header.Get("Authorization")
 
 		if authorizationHeader == "" {
@@ -129,7 +133,10 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		app.lastUsed.touch(token)
+
 		r = app.setUserContext(r, user)
+		r = app.setTokenContext(r, token)
 
 		next.ServeHTTP(w, r)
 	})
@@ -176,30 +183,169 @@ func (app *application) isAdmin(next http.HandlerFunc) http.HandlerFunc {
 	return app.requireActivatedUser(fn)
 }
 
+// accessContext collects the attributes of the request that role permission
+// conditions are evaluated against.
+func (app *application) accessContext(r *http.Request, user *data.User) data.AccessContext {
+	params := make(map[string]string)
+	for _, p := range httprouter.ParamsFromContext(r.Context()) {
+		params[p.Key] = p.Value
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return data.AccessContext{
+		Now:     time.Now(),
+		IP:      net.ParseIP(ip),
+		UserID:  user.ID,
+		Params:  params,
+		IsAdmin: app.isAdminUser,
+	}
+}
+
+// isAdminUser is used by role permission conditions that limit access to
+// non-admin users.
+func (app *application) isAdminUser(id int64) (bool, error) {
+	user, err := app.models.Users.GetByIDWithAccess(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return authz.IsAdmin(user), nil
+}
+
+// currentOrganizationID returns the organization selected by the org_id
+// route param or by the X-Organization-ID header, or 0 if none is selected.
+func (app *application) currentOrganizationID(r *http.Request) (int64, error) {
+	s := httprouter.ParamsFromContext(r.Context()).ByName("org_id")
+	if s == "" {
+		s = r.Header.Get("X-Organization-ID")
+	}
+	if s == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errInvalidOrganization
+	}
+	return id, nil
+}
+
+// userInOrganization returns the user with the roles held in the selected
+// organization instead of the global ones, or the user itself if no
+// organization is selected.
+func (app *application) userInOrganization(r *http.Request, user *data.User) (*data.User, error) {
+	organizationID, err := app.currentOrganizationID(r)
+	if err != nil || organizationID == 0 {
+		return user, err
+	}
+
+	membership, err := app.models.Organizations.GetMembership(organizationID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, errNotMember
+		default:
+			return nil, err
+		}
+	}
+	return user.InOrganization(membership), nil
+}
+
+// requirePermission checks code against the global roles and grants of the
+// user. A selected organization is ignored, roles held through a membership
+// never open global routes.
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
 
-		var grantedPermissions []data.Permission
-		var revokedPermissions []data.Permission
-		// custom permissions
-		for _, gp := range user.GrantedPermissions {
-			grantedPermissions = append(grantedPermissions, gp)
+		decision, err := authz.Evaluate(user, authz.Request{
+			Permission: code,
+			Context:    app.accessContext(r, user),
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
 		}
-		for _, rp := range user.RevokedPermissions {
-			revokedPermissions = append(revokedPermissions, rp)
+		if !decision.Allowed {
+			app.notPermittedResponse(w, r)
+			return
 		}
-		// permissions that come from roles
-		for _, role := range user.Roles {
-			grantedPermissions = append(grantedPermissions, role.Permissions...)
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireActivatedUser(fn)
+}
+
+// requireOrganizationPermission is requirePermission for tenant routes, code
+// is checked against the roles the user holds in the selected organization.
+func (app *application) requireOrganizationPermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		organizationID, err := app.currentOrganizationID(r)
+		if err == nil && organizationID == 0 {
+			err = errNoOrganization
+		}
+		if err != nil {
+			app.organizationErrorResponse(w, r, err)
+			return
+		}
+
+		user, err := app.userInOrganization(r, app.contextGetUser(r))
+		if err != nil {
+			app.organizationErrorResponse(w, r, err)
+			return
 		}
 
-		// check if user has the permission...
-		if data.PermissionsInclude(revokedPermissions, code) {
+		decision, err := authz.Evaluate(user, authz.Request{
+			Permission: code,
+			Context:    app.accessContext(r, user),
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !decision.Allowed {
 			app.notPermittedResponse(w, r)
 			return
 		}
-		if !data.PermissionsInclude(grantedPermissions, code) {
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireActivatedUser(fn)
+}
+
+// requireScopedPermission is like requirePermission, but it also accepts
+// permissions granted on the resource whose id is in the given route param,
+// e.g. requireScopedPermission("orders:write", "store", "store_id", ...)
+func (app *application) requireScopedPermission(code, resourceType, param string, next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resourceID, err := app.readInt64Param(r, param)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		user := app.contextGetUser(r)
+
+		decision, err := authz.Evaluate(user, authz.Request{
+			Permission: code,
+			Resource:   &authz.Resource{Type: resourceType, ID: resourceID},
+			Context:    app.accessContext(r, user),
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !decision.Allowed {
 			app.notPermittedResponse(w, r)
 			return
 		}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/kubil6y/myshop-go/internal/data"
+	"github.com/kubil6y/myshop-go/internal/validator"
+)
+
+func (app *application) createOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	var input organizationDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var organization data.Organization
+	input.populate(&organization)
+
+	if err := app.models.Organizations.Insert(&organization); err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRecord):
+			v.AddError("name", "an organization with that name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	e := envelope{"organization": organization}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusCreated, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) getAllOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	v := validator.New()
+	p := &data.Paginate{
+		Limit: app.readInt(qs, v, "limit", 10),
+		Page:  app.readInt(qs, v, "page", 1),
+	}
+
+	if data.ValidatePaginate(v, p); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	organizations, metadata, err := app.models.Organizations.GetAll(p)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := envelope{
+		"organizations": organizations,
+		"metadata":      metadata,
+	}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) getOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	organization, err := app.models.Organizations.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	e := envelope{"organization": organization}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) updateOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	var input organizationDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	organization, err := app.models.Organizations.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	input.populate(organization)
+
+	if err := app.models.Organizations.Update(organization); err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRecord):
+			v.AddError("name", "an organization with that name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	e := envelope{"message": "resource updated"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) deleteOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	organization, err := app.models.Organizations.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.models.Organizations.Delete(organization); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := envelope{"message": "success"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusAccepted, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// setMembershipHandler adds a user to the organization with the given roles,
+// or replaces the roles of a user who is already a member. New roles that
+// require approval are not added, a grant request is created for each.
+func (app *application) setMembershipHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	var input membershipDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	organization, err := app.models.Organizations.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.GetByIDWithRolesAndPermissions(input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	roles := make([]data.Role, 0)
+	for _, roleID := range input.RoleIDs {
+		role, err := app.models.Roles.GetByID(roleID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !role.AvailableIn(organization.ID) {
+			v.AddError("role_ids", fmt.Sprintf("role %q belongs to another organization", role.Name))
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		roles = append(roles, *role)
+	}
+
+	// membership roles are held together with the global ones.
+	conflicts, err := app.newRoleConflicts(user.Roles, roles)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if len(conflicts) > 0 {
+		app.roleConflictResponse(w, r, conflicts)
+		return
+	}
+
+	// roles the user already holds in the organization were approved.
+	var held []data.Role
+	current, err := app.models.Organizations.GetMembership(organization.ID, user.ID)
+	switch {
+	case err == nil:
+		held = current.Roles
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	immediateRoles := make([]data.Role, 0)
+	var approvalRoleIDs []int64
+	for _, role := range roles {
+		if role.RequiresApproval && !ContainsRole(held, role) {
+			approvalRoleIDs = append(approvalRoleIDs, role.ID)
+			continue
+		}
+		immediateRoles = append(immediateRoles, role)
+	}
+
+	membership, err := app.models.Organizations.SetMembership(organization.ID, user.ID, immediateRoles)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	requests, err := app.requestMembershipRoles(r, organization.ID, user.ID, approvalRoleIDs)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := envelope{"membership": membership}
+	if len(requests) > 0 {
+		e["grant_requests"] = requests
+	}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) deleteMembershipHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	userID, err := app.readInt64Param(r, "user_id")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if err := app.models.Organizations.DeleteMembership(id, userID); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	e := envelope{"message": "success"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusAccepted, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// getOrganizationMembersHandler is the tenant side of getOrganizationHandler,
+// the organization is selected by the org_id route param.
+func (app *application) getOrganizationMembersHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readInt64Param(r, "org_id")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	organization, err := app.models.Organizations.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	e := envelope{"members": organization.Members}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) getProfileOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	me := app.contextGetUser(r)
+
+	memberships, organizations, err := app.models.Organizations.GetMembershipsForUser(me.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := envelope{"memberships": memberships, "organizations": organizations}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/kubil6y/myshop-go/internal/data"
@@ -129,12 +130,31 @@ func (app *application) updatePermissionsHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
+	// bundles attached to users would grant it without approval.
+	if input.RequiresApproval && !permission.RequiresApproval {
+		bundles, err := app.models.Bundles.GetAllAttachedToUsers()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for _, b := range bundles {
+			if ContainsPermission(b.Permissions, *permission) {
+				v.AddError("requires_approval", fmt.Sprintf("the permission is in bundle %q which is attached to users", b.Name))
+			}
+		}
+		if !v.IsValid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
 	input.populate(permission)
 
 	if err := app.models.Permissions.Update(permission); err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	app.models.Users.PurgeCache()
 
 	e := envelope{"message": "resource updated"}
 	out := app.outOK(e)
@@ -166,6 +186,7 @@ func (app *application) deletePermissionsHandler(w http.ResponseWriter, r *http.
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	app.models.Users.PurgeCache()
 
 	e := envelope{"message": "success"}
 	out := app.outOK(e)
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/kubil6y/myshop-go/internal/data"
+	"github.com/kubil6y/myshop-go/internal/validator"
+	"gopkg.in/yaml.v3"
+)
+
+// isYAML reports whether the media type is one of the yaml ones.
+func isYAML(mediaType string) bool {
+	return validator.In(mediaType, "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml")
+}
+
+// exportPolicyHandler writes the authorization model as a policy file, json by
+// default or yaml with ?format=yaml. User bindings are included with
+// ?bindings=true.
+func (app *application) exportPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	v := validator.New()
+	format := app.readString(qs, "format", "json")
+	withBindings := app.readBool(qs, v, "bindings", false)
+
+	v.Check(validator.In(format, "json", "yaml"), "format", "must be json or yaml")
+	if !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	policy, err := app.models.Policy.Export(withBindings)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if format == "json" {
+		if err := app.writeJSON(w, http.StatusOK, policy, nil); err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	b, err := yaml.Marshal(policy)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		// the status is already sent, the client only gets a cut off body.
+		app.logError(r, err)
+	}
+}
+
+// importPolicyHandler makes the authorization model match the policy in the
+// body, json or yaml depending on the Content-Type. With ?dry_run=true it
+// only returns the changes, with ?prune=true permissions, bundles and roles
+// missing from the policy are deleted. Bindings can give roles that require
+// approval only with ?bind_approval_roles=true, which is logged.
+func (app *application) importPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	v := validator.New()
+	dryRun := app.readBool(qs, v, "dry_run", false)
+	prune := app.readBool(qs, v, "prune", false)
+	bindApprovalRoles := app.readBool(qs, v, "bind_approval_roles", false)
+	if !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var policy data.Policy
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if isYAML(mediaType) {
+		if err := app.readYAML(w, r, &policy); err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	} else {
+		if err := app.readJSON(w, r, &policy); err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	if data.ValidatePolicy(v, &policy); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	changes, err := app.models.Policy.Import(&policy, data.PolicyImport{
+		Prune:             prune,
+		DryRun:            dryRun,
+		BindApprovalRoles: bindApprovalRoles,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidPolicy):
+			v.AddError("policy", err.Error())
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !dryRun {
+		for _, c := range changes {
+			if len(c.WithoutApproval) > 0 {
+				app.logger.Warnw("policy binding gives roles that require approval",
+					"user", c.Name,
+					"roles", c.WithoutApproval,
+					"imported_by_id", app.contextGetUser(r).ID,
+				)
+			}
+		}
+		app.models.Users.PurgeCache()
+		app.logger.Infow("policy imported",
+			"changes", len(changes),
+			"prune", prune,
+			"imported_by_id", app.contextGetUser(r).ID,
+		)
+	}
+
+	e := envelope{
+		"dry_run": dryRun,
+		"changes": changes,
+	}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) readYAML(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	maxBytes := 1_048_576
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	dec := yaml.NewDecoder(r.Body)
+	dec.KnownFields(true)
+
+	if err := dec.Decode(dst); err != nil {
+		return fmt.Errorf("body contains badly-formed YAML: %v", err)
+	}
+	return nil
+}
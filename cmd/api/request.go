@@ -1,6 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/kubil6y/myshop-go/internal/authz"
 	"github.com/kubil6y/myshop-go/internal/data"
 	"github.com/kubil6y/myshop-go/internal/validator"
 )
@@ -29,19 +35,65 @@ func (d *registerUserDTO) populate(user *data.User) {
 	user.Email = d.Email
 }
 
-type createAuthenticationTokenDto struct {
-	Email    string `json:"email"`
+type activateUserDTO struct {
+	Token string `json:"token"`
+}
+
+func (d *activateUserDTO) validate(v *validator.Validator) {
+	validator.ValidateTokenPlaintext(v, d.Token)
+}
+
+type refreshTokenDTO struct {
+	Token string `json:"token"`
+}
+
+func (d *refreshTokenDTO) validate(v *validator.Validator) {
+	validator.ValidateTokenPlaintext(v, d.Token)
+}
+
+type createPasswordResetTokenDTO struct {
+	Email string `json:"email"`
+}
+
+func (d *createPasswordResetTokenDTO) validate(v *validator.Validator) {
+	validator.ValidateEmail(v, d.Email)
+}
+
+type createActivationTokenDTO struct {
+	Email string `json:"email"`
+}
+
+func (d *createActivationTokenDTO) validate(v *validator.Validator) {
+	validator.ValidateEmail(v, d.Email)
+}
+
+type resetUserPasswordDTO struct {
 	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+func (d *resetUserPasswordDTO) validate(v *validator.Validator) {
+	v.Check(d.Password != "", "password", "must be provided")
+	v.Check(len(d.Password) > 3, "password", "must be longer than three characters")
+	validator.ValidateTokenPlaintext(v, d.Token)
+}
+
+type createAuthenticationTokenDto struct {
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	DeviceLabel string `json:"device_label"`
 }
 
 func (d *createAuthenticationTokenDto) validate(v *validator.Validator) {
 	validator.ValidateEmail(v, d.Email)
 	v.Check(d.Password != "", "password", "must be provided")
 	v.Check(len(d.Password) > 3, "password", "must be longer than three characters")
+	v.Check(len(d.DeviceLabel) <= 100, "device_label", "must not be more than 100 bytes long")
 }
 
 type permissionDTO struct {
-	Name string `json:"name"`
+	Name             string `json:"name"`
+	RequiresApproval bool   `json:"requires_approval"`
 }
 
 func (d *permissionDTO) validate(v *validator.Validator) {
@@ -49,17 +101,47 @@ func (d *permissionDTO) validate(v *validator.Validator) {
 }
 func (d *permissionDTO) populate(p *data.Permission) {
 	p.Name = d.Name
+	p.RequiresApproval = d.RequiresApproval
 }
 
 type roleDTO struct {
-	Name        string  `json:"name"`
-	Permissions []int64 `json:"permissions"`
+	Name             string  `json:"name"`
+	Permissions      []int64 `json:"permissions"`
+	Parents          []int64 `json:"parents"`
+	Bundles          []int64 `json:"bundles"`
+	OrganizationID   *int64  `json:"organization_id"`
+	RequiresApproval bool    `json:"requires_approval"`
 }
 
 func (d *roleDTO) validate(v *validator.Validator) {
 	v.Check(d.Name != "", "name", "must be provided")
-	v.Check(len(d.Permissions) != 0, "permissions", "must be provided")
+	v.Check(len(d.Permissions) != 0 || len(d.Bundles) != 0, "permissions", "must be provided")
 	v.Check(validator.IsUniqueIS(d.Permissions), "permissions", "values must be unique")
+	v.Check(validator.IsUniqueIS(d.Parents), "parents", "values must be unique")
+	v.Check(validator.IsUniqueIS(d.Bundles), "bundles", "values must be unique")
+	if d.OrganizationID != nil {
+		v.Check(*d.OrganizationID > 0, "organization_id", "invalid value")
+	}
+}
+
+type rolePermissionConditionsDTO struct {
+	PermissionID int64           `json:"permission_id"`
+	Conditions   data.Conditions `json:"conditions"`
+}
+
+func (d *rolePermissionConditionsDTO) validate(v *validator.Validator) {
+	v.Check(d.PermissionID > 0, "permission_id", "invalid value")
+	data.ValidateConditions(v, &d.Conditions)
+}
+
+type roleManagedDTO struct {
+	RoleIDs       []int64 `json:"role_ids"`
+	PermissionIDs []int64 `json:"permission_ids"`
+}
+
+func (d *roleManagedDTO) validate(v *validator.Validator) {
+	v.Check(validator.IsUniqueIS(d.RoleIDs), "role_ids", "values must be unique")
+	v.Check(validator.IsUniqueIS(d.PermissionIDs), "permission_ids", "values must be unique")
 }
 
 type grantPermissionsToRolesDTO struct {
@@ -134,6 +216,29 @@ func (d *roleToUserDTO) validate(v *validator.Validator) {
 	v.Check(validator.IsUniqueIS(d.RoleIDs), "role_ids", "must be unique values")
 }
 
+type bundleDTO struct {
+	Name        string  `json:"name"`
+	Permissions []int64 `json:"permissions"`
+}
+
+func (d *bundleDTO) validate(v *validator.Validator) {
+	v.Check(d.Name != "", "name", "must be provided")
+	v.Check(len(d.Permissions) != 0, "permissions", "must be provided")
+	v.Check(validator.IsUniqueIS(d.Permissions), "permissions", "values must be unique")
+}
+
+type bundleToUserDTO struct {
+	UserID    int64   `json:"user_id"`
+	BundleIDs []int64 `json:"bundle_ids"`
+}
+
+func (d *bundleToUserDTO) validate(v *validator.Validator) {
+	v.Check(d.UserID != 0, "user_id", "must be provided")
+	v.Check(d.UserID > 0, "user_id", "invalid value")
+	v.Check(len(d.BundleIDs) != 0, "bundle_ids", "must be provided")
+	v.Check(validator.IsUniqueIS(d.BundleIDs), "bundle_ids", "must be unique values")
+}
+
 type permissionToUserDTO struct {
 	UserID        int64   `json:"user_id"`
 	PermissionIDs []int64 `json:"permission_ids"`
@@ -145,3 +250,142 @@ func (d *permissionToUserDTO) validate(v *validator.Validator) {
 	v.Check(len(d.PermissionIDs) != 0, "permission_ids", "must be provided")
 	v.Check(validator.IsUniqueIS(d.PermissionIDs), "permission_ids", "must be unique values")
 }
+
+type scopedPermissionToUserDTO struct {
+	UserID        int64   `json:"user_id"`
+	PermissionIDs []int64 `json:"permission_ids"`
+	ResourceType  string  `json:"resource_type"`
+	ResourceID    int64   `json:"resource_id"`
+}
+
+func (d *scopedPermissionToUserDTO) validate(v *validator.Validator) {
+	v.Check(d.UserID != 0, "user_id", "must be provided")
+	v.Check(d.UserID > 0, "user_id", "invalid value")
+	v.Check(len(d.PermissionIDs) != 0, "permission_ids", "must be provided")
+	v.Check(validator.IsUniqueIS(d.PermissionIDs), "permission_ids", "must be unique values")
+	v.Check(d.ResourceType != "", "resource_type", "must be provided")
+	v.Check(d.ResourceID > 0, "resource_id", "invalid value")
+}
+
+type grantWindowDTO struct {
+	StartsAt  *time.Time `json:"starts_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func (d *grantWindowDTO) validate(v *validator.Validator) {
+	if d.ExpiresAt != nil {
+		v.Check(d.ExpiresAt.After(time.Now()), "expires_at", "must be in the future")
+		if d.StartsAt != nil {
+			v.Check(d.ExpiresAt.After(*d.StartsAt), "expires_at", "must be after starts_at")
+		}
+	}
+}
+
+func (d *grantWindowDTO) window() data.GrantWindow {
+	return data.GrantWindow{StartsAt: d.StartsAt, ExpiresAt: d.ExpiresAt}
+}
+
+type grantRoleToUserDTO struct {
+	roleToUserDTO
+	grantWindowDTO
+}
+
+func (d *grantRoleToUserDTO) validate(v *validator.Validator) {
+	d.roleToUserDTO.validate(v)
+	d.grantWindowDTO.validate(v)
+}
+
+type grantPermissionToUserDTO struct {
+	permissionToUserDTO
+	grantWindowDTO
+}
+
+func (d *grantPermissionToUserDTO) validate(v *validator.Validator) {
+	d.permissionToUserDTO.validate(v)
+	d.grantWindowDTO.validate(v)
+}
+
+type authzCheckDTO struct {
+	Subject struct {
+		UserID int64  `json:"user_id"`
+		Token  string `json:"token"`
+	} `json:"subject"`
+	OrganizationID int64           `json:"organization_id"`
+	Permissions    []string        `json:"permissions"`
+	Resource       *authz.Resource `json:"resource"`
+	Context        struct {
+		IP     string            `json:"ip"`
+		Params map[string]string `json:"params"`
+	} `json:"context"`
+}
+
+func (d *authzCheckDTO) validate(v *validator.Validator) {
+	v.Check(d.Subject.UserID != 0 || d.Subject.Token != "", "subject", "user_id or token must be provided")
+	v.Check(d.Subject.UserID == 0 || d.Subject.Token == "", "subject", "only one of user_id or token must be provided")
+	v.Check(d.Subject.UserID >= 0, "subject", "invalid user_id")
+	v.Check(d.OrganizationID >= 0, "organization_id", "invalid value")
+	if d.Subject.Token != "" {
+		validator.ValidateTokenPlaintext(v, d.Subject.Token)
+	}
+
+	v.Check(len(d.Permissions) != 0, "permissions", "must be provided")
+	for _, p := range d.Permissions {
+		v.Check(p != "", "permissions", "values can not be empty")
+	}
+
+	if d.Resource != nil {
+		v.Check(d.Resource.Type != "", "resource", "type must be provided")
+		v.Check(d.Resource.ID > 0, "resource", "invalid id")
+	}
+
+	if d.Context.IP != "" {
+		v.Check(net.ParseIP(d.Context.IP) != nil, "context", "invalid ip")
+	}
+}
+
+type organizationDTO struct {
+	Name string `json:"name"`
+}
+
+func (d *organizationDTO) validate(v *validator.Validator) {
+	v.Check(d.Name != "", "name", "must be provided")
+}
+
+func (d *organizationDTO) populate(o *data.Organization) {
+	o.Name = d.Name
+}
+
+type membershipDTO struct {
+	UserID  int64   `json:"user_id"`
+	RoleIDs []int64 `json:"role_ids"`
+}
+
+func (d *membershipDTO) validate(v *validator.Validator) {
+	v.Check(d.UserID != 0, "user_id", "must be provided")
+	v.Check(d.UserID > 0, "user_id", "invalid value")
+	v.Check(validator.IsUniqueIS(d.RoleIDs), "role_ids", "must be unique values")
+}
+
+type roleConflictDTO struct {
+	RoleID            int64 `json:"role_id"`
+	ConflictingRoleID int64 `json:"conflicting_role_id"`
+}
+
+func (d *roleConflictDTO) validate(v *validator.Validator) {
+	v.Check(d.RoleID > 0, "role_id", "invalid value")
+	v.Check(d.ConflictingRoleID > 0, "conflicting_role_id", "invalid value")
+	v.Check(d.RoleID != d.ConflictingRoleID, "conflicting_role_id", "must be different from role_id")
+}
+
+type elevateDTO struct {
+	RoleID  int64  `json:"role_id"`
+	Minutes int    `json:"minutes"`
+	Reason  string `json:"reason"`
+}
+
+func (d *elevateDTO) validate(v *validator.Validator, max time.Duration) {
+	v.Check(d.RoleID > 0, "role_id", "invalid value")
+	v.Check(d.Minutes > 0, "minutes", "must be greater than zero")
+	v.Check(time.Duration(d.Minutes)*time.Minute <= max, "minutes", fmt.Sprintf("must be a maximum of %d", int(max.Minutes())))
+	v.Check(len(strings.TrimSpace(d.Reason)) >= 10, "reason", "must be at least ten characters long")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/kubil6y/myshop-go/internal/data"
+	"github.com/kubil6y/myshop-go/internal/validator"
+)
+
+// roleConflicts returns the separation of duties conflicts between roles.
+func (app *application) roleConflicts(roles []data.Role) ([]data.RoleConflict, error) {
+	var ids []int64
+	for _, role := range roles {
+		ids = append(ids, role.ID)
+	}
+	return app.models.Conflicts.FindConflicts(app.intSliceToSet(ids))
+}
+
+// newRoleConflicts returns the conflicts that adding roles to the held ones
+// would create. Conflicts among the held roles alone are left out, an
+// existing violation is reported by the violations report and does not
+// block unrelated grants.
+func (app *application) newRoleConflicts(held, added []data.Role) ([]data.RoleConflict, error) {
+	existing, err := app.roleConflicts(held)
+	if err != nil {
+		return nil, err
+	}
+
+	var all []data.Role
+	all = append(all, held...)
+	all = append(all, added...)
+	conflicts, err := app.roleConflicts(all)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []data.RoleConflict
+	for _, c := range conflicts {
+		if !containsConflict(existing, c) {
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+func containsConflict(list []data.RoleConflict, c data.RoleConflict) bool {
+	for _, v := range list {
+		if v.ID == c.ID {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *application) createRoleConflictHandler(w http.ResponseWriter, r *http.Request) {
+	var input roleConflictDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var roles []data.Role
+	for _, id := range []int64{input.RoleID, input.ConflictingRoleID} {
+		role, err := app.models.Roles.GetByID(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		roles = append(roles, *role)
+	}
+
+	conflict := data.RoleConflict{
+		RoleID:            roles[0].ID,
+		Role:              roles[0],
+		ConflictingRoleID: roles[1].ID,
+		ConflictingRole:   roles[1],
+	}
+
+	if err := app.models.Conflicts.Insert(&conflict); err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRecord):
+			app.resourceAlreadyExists(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	e := envelope{"role_conflict": conflict}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusCreated, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) getAllRoleConflictsHandler(w http.ResponseWriter, r *http.Request) {
+	conflicts, err := app.models.Conflicts.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := envelope{"role_conflicts": conflicts}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) deleteRoleConflictHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	conflict, err := app.models.Conflicts.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.models.Conflicts.Delete(conflict); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := envelope{"message": "success"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusAccepted, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// roleConflictViolationsHandler lists the users who already hold both roles
+// of a conflict, e.g. because the conflict was declared after the grants.
+func (app *application) roleConflictViolationsHandler(w http.ResponseWriter, r *http.Request) {
+	violations, err := app.models.Conflicts.Violations()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := envelope{"violations": violations}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/kubil6y/myshop-go/internal/data"
@@ -38,15 +39,72 @@ func (app *application) createRoleHandler(w http.ResponseWriter, r *http.Request
 		permissions = append(permissions, *permission)
 	}
 
+	if input.OrganizationID != nil {
+		if _, err := app.models.Organizations.GetByID(*input.OrganizationID); err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	// check if parent roles exists
+	parents := make([]data.Role, 0)
+	for _, id := range input.Parents {
+		parent, err := app.models.Roles.GetByID(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		parents = append(parents, *parent)
+	}
+
+	bundles := make([]data.Bundle, 0)
+	for _, id := range input.Bundles {
+		bundle, err := app.models.Bundles.GetByID(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		bundles = append(bundles, *bundle)
+	}
+
 	var role data.Role
 	role.Name = input.Name
 	role.Permissions = permissions
+	role.Parents = parents
+	role.Bundles = bundles
+	role.OrganizationID = input.OrganizationID
+	role.RequiresApproval = input.RequiresApproval
+
+	if !app.validRoleParents(v, &role) {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 
 	if err := app.models.Roles.Insert(&role); err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateRecord):
 			v.AddError("name", "a role with that name already exists")
 			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRoleCycle):
+			v.AddError("parents", "must not create a cycle in the role hierarchy")
+			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -162,13 +220,126 @@ func (app *application) updateRolesHandler(w http.ResponseWriter, r *http.Reques
 		newPermissions = append(newPermissions, *permission)
 	}
 
+	var newParents []data.Role
+	for _, id := range input.Parents {
+		parent, err := app.models.Roles.GetByID(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		newParents = append(newParents, *parent)
+	}
+
+	if input.OrganizationID != nil {
+		if _, err := app.models.Organizations.GetByID(*input.OrganizationID); err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	newBundles := make([]data.Bundle, 0)
+	for _, id := range input.Bundles {
+		bundle, err := app.models.Bundles.GetByID(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		newBundles = append(newBundles, *bundle)
+	}
+
 	role.Name = input.Name
 	role.Permissions = newPermissions
+	role.Parents = newParents
+	role.Bundles = newBundles
+	role.OrganizationID = input.OrganizationID
+	role.RequiresApproval = input.RequiresApproval
+
+	if !app.validRoleParents(v, role) {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 
 	if err := app.models.Roles.Update(role); err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRecord):
+			v.AddError("name", "a role with that name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRoleCycle):
+			v.AddError("parents", "must not create a cycle in the role hierarchy")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.models.Users.PurgeCache()
+
+	e := envelope{"message": "resource updated"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+}
+
+func (app *application) updateRolePermissionConditionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	var input rolePermissionConditionsDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	role, err := app.models.Roles.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.models.Roles.SetPermissionConditions(role.ID, input.PermissionID, input.Conditions); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("permission_id", "the role does not have this permission")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.models.Users.PurgeCache()
 
 	e := envelope{"message": "resource updated"}
 	out := app.outOK(e)
@@ -178,6 +349,83 @@ func (app *application) updateRolesHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// updateRoleManagedHandler configures which roles and permissions the
+// holders of the role can grant and revoke, making them role managers.
+func (app *application) updateRoleManagedHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	var input roleManagedDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	role, err := app.models.Roles.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var managedRoles []data.Role
+	for _, id := range input.RoleIDs {
+		managed, err := app.models.Roles.GetByID(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		managedRoles = append(managedRoles, *managed)
+	}
+
+	var managedPermissions []data.Permission
+	for _, id := range input.PermissionIDs {
+		permission, err := app.models.Permissions.GetByID(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		managedPermissions = append(managedPermissions, *permission)
+	}
+
+	if err := app.models.Roles.SetManaged(role, managedRoles, managedPermissions); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := envelope{"role": role}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
 func (app *application) deleteRolesHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
@@ -196,7 +444,12 @@ func (app *application) deleteRolesHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	app.models.Roles.Delete(role)
+	if err := app.models.Roles.Delete(role); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.models.Users.PurgeCache()
+
 	e := envelope{"message": "success"}
 	out := app.outOK(e)
 	if err := app.writeJSON(w, http.StatusAccepted, out, nil); err != nil {
@@ -204,3 +457,18 @@ func (app *application) deleteRolesHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 }
+
+// validRoleParents checks that an organization local role only inherits from
+// global roles or roles of the same organization, and that a global role
+// only inherits from global roles.
+func (app *application) validRoleParents(v *validator.Validator, role *data.Role) bool {
+	for _, parent := range role.Parents {
+		if parent.OrganizationID == nil {
+			continue
+		}
+		if role.OrganizationID == nil || *parent.OrganizationID != *role.OrganizationID {
+			v.AddError("parents", fmt.Sprintf("role %q belongs to another organization", parent.Name))
+		}
+	}
+	return v.IsValid()
+}
@@ -15,11 +15,28 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.requirePermission("perm100", (app.healthCheckHandler)))
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.resetUserPasswordHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireAuthenticatedUser(app.deleteAllAuthenticationTokensHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/users", app.getAllUsersHandler)
 	router.HandlerFunc(http.MethodGet, "/v1/users/:id", app.getUserHandler)
 	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.updateUserOwnHandler)
 	router.HandlerFunc(http.MethodGet, "/v1/profile", app.getProfileHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/profile/permissions", app.requireAuthenticatedUser(app.getProfilePermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/profile/sessions", app.requireAuthenticatedUser(app.getProfileSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/profile/sessions/:id", app.requireAuthenticatedUser(app.deleteProfileSessionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/profile/organizations", app.requireAuthenticatedUser(app.getProfileOrganizationsHandler))
+
+	// organization routes, permissions are checked against the roles held in org_id
+	router.HandlerFunc(http.MethodGet, "/v1/organizations/:org_id/members", app.requireOrganizationPermission("members:read", app.getOrganizationMembersHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/access/elevate", app.requirePermission("break-glass", app.elevateHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/authz/check", app.requirePermission("authz:check", app.authzCheckHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/admin/permissions", app.requirePermission("admin", app.createPermissionHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions", app.requirePermission("admin", app.getAllPermissionHandler))
@@ -32,15 +49,52 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodGet, "/v1/admin/roles/:id", app.requirePermission("admin", app.getRoleHandler))
 	router.HandlerFunc(http.MethodPut, "/v1/admin/roles/:id", app.requirePermission("admin", app.updateRolesHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/admin/roles/:id", app.requirePermission("admin", app.deleteRolesHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/roles/:id/managed", app.requirePermission("admin", app.updateRoleManagedHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/roles/:id/conditions", app.requirePermission("admin", app.updateRolePermissionConditionsHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/admin/bundles", app.requirePermission("admin", app.createBundleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/bundles", app.requirePermission("admin", app.getAllBundlesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/bundles/:id", app.requirePermission("admin", app.getBundleHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/bundles/:id", app.requirePermission("admin", app.updateBundleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/bundles/:id", app.requirePermission("admin", app.deleteBundleHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/policy/export", app.requirePermission("admin", app.exportPolicyHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/policy/import", app.requirePermission("admin", app.importPolicyHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/elevations", app.requirePermission("admin", app.getAllElevationsHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/grant-requests", app.requirePermission("admin", app.getAllGrantRequestsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/grant-requests/:id", app.requirePermission("admin", app.getGrantRequestHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/grant-requests/:id/approve", app.requirePermission("admin", app.approveGrantRequestHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/grant-requests/:id/reject", app.requirePermission("admin", app.rejectGrantRequestHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/admin/role-conflicts", app.requirePermission("admin", app.createRoleConflictHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/role-conflicts", app.requirePermission("admin", app.getAllRoleConflictsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/role-conflicts/:id", app.requirePermission("admin", app.deleteRoleConflictHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/reports/role-conflicts", app.requirePermission("admin", app.roleConflictViolationsHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/admin/organizations", app.requirePermission("admin", app.createOrganizationHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/organizations", app.requirePermission("admin", app.getAllOrganizationsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/organizations/:id", app.requirePermission("admin", app.getOrganizationHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/organizations/:id", app.requirePermission("admin", app.updateOrganizationHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/organizations/:id", app.requirePermission("admin", app.deleteOrganizationHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/organizations/:id/members", app.requirePermission("admin", app.setMembershipHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/organizations/:id/members/:user_id", app.requirePermission("admin", app.deleteMembershipHandler))
 
 	router.HandlerFunc(http.MethodGet, "/v1/admin/users/access/:id", app.requirePermission("admin", app.getUserRolesAndPermissions))
-	router.HandlerFunc(http.MethodPost, "/v1/admin/users/grant-role", app.requirePermission("admin", app.grantRoleToUserHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/admin/users/revoke-role", app.requirePermission("admin", app.revokeRoleToUserHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/admin/users/grant-permission", app.requirePermission("admin", app.grantPermissionToUserHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/admin/users/revoke-permission", app.requirePermission("admin", app.revokePermissionToUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/access/:id/explain", app.requirePermission("admin", app.explainUserAccessHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/grant-role", app.requireRoleManager(app.grantRoleToUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/revoke-role", app.requireRoleManager(app.revokeRoleToUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/grant-permission", app.requireRoleManager(app.grantPermissionToUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/revoke-permission", app.requireRoleManager(app.revokePermissionToUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/grant-bundle", app.requirePermission("admin", app.grantBundleToUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/revoke-bundle", app.requirePermission("admin", app.revokeBundleToUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/grant-scoped-permission", app.requirePermission("admin", app.grantScopedPermissionToUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/revoke-scoped-permission", app.requirePermission("admin", app.revokeScopedPermissionToUserHandler))
 
 	router.HandlerFunc(http.MethodPatch, "/v1/admin/users/:id", app.requirePermission("admin", app.updateUserHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id", app.requirePermission("admin", app.deleteUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/tokens", app.requirePermission("admin", app.revokeUserTokensHandler))
 
 	return app.recoverPanic(app.rateLimit(app.authenticate(router)))
 }
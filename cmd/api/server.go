@@ -1,22 +1,45 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
+
+	"github.com/kubil6y/myshop-go/internal/data"
 )
 
 func initFlags(cfg *config) {
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
 	flag.IntVar(&cfg.port, "port", 4000, "API Server PORT")
-	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("MYSHOP_DB_DSN"), "PostgreSQL DSN")
+	flag.StringVar(&cfg.db.driver, "db-driver", data.DriverPostgres, "Database driver (postgres|sqlite)")
+	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("MYSHOP_DB_DSN"), "PostgreSQL DSN or SQLite file")
 
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 
+	flag.BoolVar(&cfg.cache.enabled, "cache-enabled", true, "Enable in-process cache of authenticated users")
+	flag.IntVar(&cfg.cache.size, "cache-size", 10_000, "Maximum number of cached authentication tokens")
+	flag.DurationVar(&cfg.cache.ttl, "cache-ttl", 30*time.Second, "Time to live of cached authentication tokens")
+
+	flag.DurationVar(&cfg.grants.sweepInterval, "grants-sweep-interval", time.Minute, "Interval of removing expired role and permission grants")
+	flag.DurationVar(&cfg.breakGlass.maxDuration, "break-glass-max-duration", 4*time.Hour, "Maximum duration of a break-glass elevation")
+	flag.DurationVar(&cfg.approval.ttl, "approval-ttl", 72*time.Hour, "Time a grant request waits for approval before it expires")
+
+	flag.DurationVar(&cfg.tokens.accessTTL, "access-token-ttl", 15*time.Minute, "Time to live of authentication (access) tokens")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", 72*time.Hour, "Time to live of refresh tokens, renewed on every refresh")
+	flag.DurationVar(&cfg.activation.ttl, "activation-ttl", 72*time.Hour, "Time to live of account activation tokens")
+	flag.DurationVar(&cfg.passwordReset.ttl, "password-reset-ttl", 45*time.Minute, "Time to live of password reset tokens")
+	flag.DurationVar(&cfg.sessions.flushInterval, "sessions-flush-interval", time.Minute, "Interval of writing the last used times of authentication tokens")
+	flag.StringVar(&cfg.mailer.kind, "mailer", "", "Mailer (log|file), log by default in development and required elsewhere")
+	flag.StringVar(&cfg.mailer.dir, "mailer-dir", "mail", "Directory the file mailer writes messages to")
+
 	flag.Parse()
 }
 
@@ -34,8 +57,32 @@ func (app *application) serve() error {
 		"environment": app.config.env,
 	})
 
-	if err := srv.ListenAndServe(); err != nil {
+	shutdownError := make(chan error)
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		app.logger.Infow("shutting down server", "signal", s.String())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+
+		// requests are done, the jobs can stop and flush what they hold.
+		close(app.shutdown)
+		app.wg.Wait()
+		shutdownError <- err
+	}()
+
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
+	if err := <-shutdownError; err != nil {
+		return err
+	}
+
+	app.logger.Infow("stopped server", "addr", srv.Addr)
 	return nil
 }
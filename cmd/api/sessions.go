@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kubil6y/myshop-go/internal/data"
+)
+
+// maxUserAgentLength bounds the user agent stored with a token.
+const maxUserAgentLength = 512
+
+// lastUsedTracker collects when authentication tokens were last used, keyed
+// by token hash, until flushTokenLastUsed writes them in one batch. A nil
+// tracker tracks nothing.
+type lastUsedTracker struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func newLastUsedTracker() *lastUsedTracker {
+	return &lastUsedTracker{used: make(map[string]time.Time)}
+}
+
+func (t *lastUsedTracker) touch(token string) {
+	if t == nil {
+		return
+	}
+	hash := string(data.HashToken(token))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.used[hash] = time.Now()
+}
+
+// take returns the collected times and starts a new batch.
+func (t *lastUsedTracker) take() map[string]time.Time {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	used := t.used
+	t.used = make(map[string]time.Time)
+	return used
+}
+
+// restore puts back times that could not be written, times collected since
+// they were taken are newer and win.
+func (t *lastUsedTracker) restore(used map[string]time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for hash, at := range used {
+		if current, ok := t.used[hash]; !ok || at.After(current) {
+			t.used[hash] = at
+		}
+	}
+}
+
+// tokenMetadata returns the client metadata of the login request.
+func (app *application) tokenMetadata(r *http.Request, deviceLabel string) data.TokenMetadata {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	return data.TokenMetadata{
+		IP:          ip,
+		UserAgent:   userAgent,
+		DeviceLabel: deviceLabel,
+	}
+}
+
+// getProfileSessionsHandler lists the sessions of the current user, a
+// session is the active refresh token of a login. Last used times are written
+// in batches, so they can lag behind by up to the flush interval.
+func (app *application) getProfileSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	accessTokens, err := app.models.Tokens.GetAllForUser(data.ScopeAuthentication, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	tokens, err := app.models.Tokens.GetAllForUser(data.ScopeRefresh, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var currentFamily string
+	current := app.contextGetToken(r)
+	for _, token := range accessTokens {
+		if token.Matches(current) {
+			currentFamily = token.Family
+		}
+	}
+
+	var currentID int64
+	for _, token := range tokens {
+		if token.Family == currentFamily {
+			currentID = token.ID
+		}
+	}
+
+	e := envelope{"sessions": tokens, "current_session_id": currentID}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// deleteProfileSessionHandler revokes one session of the current user, the
+// refresh token and the access tokens issued with it.
+func (app *application) deleteProfileSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if err := app.models.Tokens.DeleteForUser(data.ScopeRefresh, user.ID, id); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.models.Users.InvalidateCache(user.ID)
+
+	e := envelope{"message": "success"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"net/http"
-	"time"
 
 	"github.com/kubil6y/myshop-go/internal/data"
 	"github.com/kubil6y/myshop-go/internal/validator"
@@ -43,15 +42,253 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeAuthentication)
+	access, refresh, err := app.newTokenPair(user.ID, app.tokenMetadata(r, input.DeviceLabel))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := tokenPairEnvelope(access, refresh)
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusCreated, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// refreshTokenHandler exchanges a refresh token for a new access token and a
+// new refresh token of the same family. Refresh tokens are single use, if a
+// rotated one comes back it leaked, and the whole family is revoked so
+// neither side can keep using it.
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input refreshTokenDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	consumed, err := app.models.Tokens.Rotate(input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			app.models.Users.InvalidateCache(consumed.UserID)
+			app.logger.Warnw("refresh token reused, token family revoked", "user_id", consumed.UserID, "remote_addr", r.RemoteAddr)
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	access, refresh, err := app.newTokenPair(consumed.UserID, consumed.TokenMetadata)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-	e := envelope{"authentication_token": map[string]interface{}{
-		"token":  token.Plaintext,
-		"expiry": token.Expiry,
-	}}
+	e := tokenPairEnvelope(access, refresh)
 	out := app.outOK(e)
 	if err := app.writeJSON(w, http.StatusCreated, out, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 }
+
+// newTokenPair issues an access token and a refresh token in the family of
+// md, a new family if it has none.
+func (app *application) newTokenPair(userID int64, md data.TokenMetadata) (access, refresh *data.Token, err error) {
+	access, err = app.models.Tokens.NewWithMetadata(userID, app.config.tokens.accessTTL, data.ScopeAuthentication, md)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh, err = app.models.Tokens.NewWithMetadata(userID, app.config.tokens.refreshTTL, data.ScopeRefresh, access.TokenMetadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+func tokenPairEnvelope(access, refresh *data.Token) envelope {
+	return envelope{
+		"authentication_token": map[string]interface{}{
+			"token":  access.Plaintext,
+			"expiry": access.Expiry,
+		},
+		"refresh_token": map[string]interface{}{
+			"token":  refresh.Plaintext,
+			"expiry": refresh.Expiry,
+		},
+	}
+}
+
+// createPasswordResetTokenHandler mails a password reset token to the user
+// of the email address. It answers 202 whether or not the address belongs to
+// a user, so it cannot be used to find out which addresses are registered.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input createPasswordResetTokenDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		token, err := app.models.Tokens.New(user.ID, app.config.passwordReset.ttl, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.sendMail(user.Email, "token_password_reset.tmpl", map[string]interface{}{
+			"passwordResetToken": token.Plaintext,
+			"ttl":                app.config.passwordReset.ttl,
+		})
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := envelope{"message": "if the email address is registered, you will receive password reset instructions"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusAccepted, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// createActivationTokenHandler sends a new activation token to a user who is
+// not activated yet, e.g. when the welcome email got lost. Earlier
+// activation tokens are deleted. The response is the same whether the email
+// is registered or not.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input createActivationTokenDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	switch {
+	case err == nil && !user.IsActivated:
+		if err := app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		token, err := app.models.Tokens.New(user.ID, app.config.activation.ttl, data.ScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.sendMail(user.Email, "token_activation.tmpl", map[string]interface{}{
+			"activationToken": token.Plaintext,
+			"ttl":             app.config.activation.ttl,
+		})
+	case err != nil && !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := envelope{"message": "if the email address is registered and not activated, you will receive activation instructions"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusAccepted, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// deleteAuthenticationTokenHandler logs out the current session, its refresh
+// token is revoked with it.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	if err := app.models.Tokens.DeleteForToken(data.ScopeAuthentication, app.contextGetToken(r)); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.models.Users.InvalidateCache(user.ID)
+
+	e := envelope{"message": "success"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// deleteAllAuthenticationTokensHandler logs out every session of the
+// current user, including the current one.
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		if err := app.models.Tokens.DeleteAllForUser(scope, user.ID); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	app.models.Users.InvalidateCache(user.ID)
+
+	e := envelope{"message": "success"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// revokeUserTokensHandler deletes every token of a user, for compromised
+// accounts and offboarding. Pending password resets are revoked as well so
+// they cannot be used to get back in.
+func (app *application) revokeUserTokensHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user, err := app.models.Users.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh, data.ScopePasswordReset} {
+		if err := app.models.Tokens.DeleteAllForUser(scope, user.ID); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	app.models.Users.InvalidateCache(user.ID)
+
+	e := envelope{"message": "success"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
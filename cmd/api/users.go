@@ -3,8 +3,11 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"time"
 
+	"github.com/kubil6y/myshop-go/internal/authz"
 	"github.com/kubil6y/myshop-go/internal/data"
 	"github.com/kubil6y/myshop-go/internal/validator"
 )
@@ -30,7 +33,9 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	user.SetPassword(input.Password)
 	user.IsActivated = false
 
-	if err := app.models.Users.Insert(&user); err != nil {
+	// a user is never stored without a way to activate it.
+	token, err := app.models.Users.InsertWithToken(&user, app.config.activation.ttl, data.ScopeActivation)
+	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateRecord):
 			v.AddError("email", "a user with this email address already exists")
@@ -41,6 +46,12 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	app.sendMail(user.Email, "user_welcome.tmpl", map[string]interface{}{
+		"userID":          user.ID,
+		"activationToken": token.Plaintext,
+		"ttl":             app.config.activation.ttl,
+	})
+
 	e := envelope{"user": user}
 	out := app.outOK(e)
 	if err := app.writeJSON(w, http.StatusCreated, out, nil); err != nil {
@@ -49,6 +60,110 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 }
 
+// resetUserPasswordHandler sets a new password with a password reset token.
+// The reset tokens and all authentication tokens of the user are deleted, so
+// every session has to log in again.
+func (app *application) resetUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input resetUserPasswordDTO
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := user.SetPassword(input.Password); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err := app.models.Users.Update(user); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, scope := range []string{data.ScopePasswordReset, data.ScopeAuthentication, data.ScopeRefresh} {
+		if err := app.models.Tokens.DeleteAllForUser(scope, user.ID); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	app.models.Users.InvalidateCache(user.ID)
+
+	e := envelope{"message": "your password was successfully reset"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// activateUserHandler activates the user of an activation token, the token
+// and all other activation tokens of the user are consumed.
+func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input activateUserDTO
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired activation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user.IsActivated = true
+	if err := app.models.Users.Update(user); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.models.Users.InvalidateCache(user.ID)
+
+	e := envelope{"user": user}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
 func (app *application) getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
 	v := validator.New()
@@ -144,6 +259,7 @@ func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	app.models.Users.InvalidateCache(user.ID)
 
 	e := envelope{"message": "success"}
 	out := app.outOK(e)
@@ -175,6 +291,7 @@ func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	app.models.Users.InvalidateCache(user.ID)
 
 	e := envelope{"message": "success"}
 	out := app.outOK(e)
@@ -208,6 +325,7 @@ func (app *application) updateUserOwnHandler(w http.ResponseWriter, r *http.Requ
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	app.models.Users.InvalidateCache(user.ID)
 
 	e := envelope{"message": "success"}
 	out := app.outOK(e)
@@ -227,8 +345,50 @@ func (app *application) getProfileHandler(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// getProfilePermissionsHandler returns the effective permissions of the
+// current user as a flat list, with an ETag so clients can cache it.
+func (app *application) getProfilePermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	me, err := app.userInOrganization(r, app.contextGetUser(r))
+	if err != nil {
+		app.organizationErrorResponse(w, r, err)
+		return
+	}
+
+	catalogue, err := app.models.Permissions.GetAllNames()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := authz.EffectivePermissions(me, catalogue, app.accessContext(r, me))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	etag := permissionsETag(me.ID, permissions)
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+	headers.Set("Cache-Control", "private, no-cache")
+
+	if match := r.Header.Get("If-None-Match"); match != "" && match == etag {
+		for k, v := range headers {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	e := envelope{"permissions": permissions}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, headers); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
 func (app *application) grantRoleToUserHandler(w http.ResponseWriter, r *http.Request) {
-	var input roleToUserDTO
+	var input grantRoleToUserDTO
 	if err := app.readJSON(w, r, &input); err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -264,17 +424,58 @@ func (app *application) grantRoleToUserHandler(w http.ResponseWriter, r *http.Re
 			return
 		}
 
+		if role.OrganizationID != nil {
+			v.AddError("role_ids", fmt.Sprintf("role %q can only be held through an organization membership", role.Name))
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
 		inputRoles = append(inputRoles, *role)
 	}
 
-	targetUser.Roles = append(targetUser.Roles, inputRoles...)
+	if !app.checkDelegatedRoles(w, r, inputRoles, true) {
+		return
+	}
+
+	// conflicts are checked against every role, including the ones that
+	// need approval first.
+	conflicts, err := app.newRoleConflicts(targetUser.Roles, inputRoles)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if len(conflicts) > 0 {
+		app.roleConflictResponse(w, r, conflicts)
+		return
+	}
+
+	var immediateRoles []data.Role
+	var approvalRoleIDs []int64
+	for _, role := range inputRoles {
+		if role.RequiresApproval {
+			approvalRoleIDs = append(approvalRoleIDs, role.ID)
+			continue
+		}
+		immediateRoles = append(immediateRoles, role)
+	}
+
+	if len(immediateRoles) > 0 {
+		if err := app.grantRoles(targetUser, immediateRoles, input.window()); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
 
-	if err := app.models.Users.Update(targetUser); err != nil {
+	requests, err := app.requestGrants(r, targetUser.ID, data.GrantKindRole, approvalRoleIDs, input.window())
+	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
 	e := envelope{"message": "success"}
+	if len(requests) > 0 {
+		e["grant_requests"] = requests
+	}
 	out := app.outOK(e)
 	if err := app.writeJSON(w, http.StatusAccepted, out, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -322,6 +523,10 @@ func (app *application) revokeRoleToUserHandler(w http.ResponseWriter, r *http.R
 		inputRoles = append(inputRoles, *role)
 	}
 
+	if !app.checkDelegatedRoles(w, r, inputRoles, false) {
+		return
+	}
+
 	doesRoleExist := func(list []data.Role, role data.Role) bool {
 		for _, v := range list {
 			if v.ID == role.ID {
@@ -345,6 +550,7 @@ func (app *application) revokeRoleToUserHandler(w http.ResponseWriter, r *http.R
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	app.models.Users.InvalidateCache(targetUser.ID)
 
 	e := envelope{"message": "success"}
 	out := app.outOK(e)
@@ -355,7 +561,7 @@ func (app *application) revokeRoleToUserHandler(w http.ResponseWriter, r *http.R
 }
 
 func (app *application) grantPermissionToUserHandler(w http.ResponseWriter, r *http.Request) {
-	var input permissionToUserDTO
+	var input grantPermissionToUserDTO
 	if err := app.readJSON(w, r, &input); err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -394,34 +600,37 @@ func (app *application) grantPermissionToUserHandler(w http.ResponseWriter, r *h
 		inputPermissions = append(inputPermissions, *permission)
 	}
 
+	if !app.checkDelegatedPermissions(w, r, inputPermissions, true) {
+		return
+	}
+
+	var immediatePermissions []data.Permission
+	var approvalPermissionIDs []int64
 	for _, ip := range inputPermissions {
-		if ContainsPermission(user.GrantedPermissions, ip) {
+		if ip.RequiresApproval {
+			approvalPermissionIDs = append(approvalPermissionIDs, ip.ID)
 			continue
 		}
-		user.GrantedPermissions = append(user.GrantedPermissions, ip)
-	}
-
-	for _, v := range user.GrantedPermissions {
-		fmt.Println("granted id", v.ID)
+		immediatePermissions = append(immediatePermissions, ip)
 	}
 
-	var filteredRevokedPermissions []data.Permission
-	for _, rp := range user.RevokedPermissions {
-		if ContainsPermission(inputPermissions, rp) {
-			continue
+	if len(immediatePermissions) > 0 {
+		if err := app.grantPermissions(user, immediatePermissions, input.window()); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
 		}
-		filteredRevokedPermissions = append(filteredRevokedPermissions, rp)
 	}
-	user.RevokedPermissions = filteredRevokedPermissions
 
-	err = app.models.Users.UpdateGrantedPermissions(user)
-	err = app.models.Users.UpdateRevokedPermissions(user)
+	requests, err := app.requestGrants(r, user.ID, data.GrantKindPermission, approvalPermissionIDs, input.window())
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
 	e := envelope{"message": "success"}
+	if len(requests) > 0 {
+		e["grant_requests"] = requests
+	}
 	out := app.outOK(e)
 	if err := app.writeJSON(w, http.StatusAccepted, out, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -469,6 +678,10 @@ func (app *application) revokePermissionToUserHandler(w http.ResponseWriter, r *
 		inputPermissions = append(inputPermissions, *permission)
 	}
 
+	if !app.checkDelegatedPermissions(w, r, inputPermissions, false) {
+		return
+	}
+
 	// deciding new granted permissions TODO
 	var filteredGrantedPermissions []data.Permission
 	for _, grantedPerm := range user.GrantedPermissions {
@@ -492,6 +705,111 @@ func (app *application) revokePermissionToUserHandler(w http.ResponseWriter, r *
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	app.models.Users.InvalidateCache(user.ID)
+
+	e := envelope{"message": "success"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusAccepted, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) grantScopedPermissionToUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input scopedPermissionToUserDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByID(input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var inputPermissions []data.Permission
+	for _, permissionID := range input.PermissionIDs {
+		permission, err := app.models.Permissions.GetByID(permissionID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		inputPermissions = append(inputPermissions, *permission)
+	}
+
+	for _, ip := range inputPermissions {
+		scoped := data.ScopedUserPermission{
+			UserID:       user.ID,
+			PermissionID: ip.ID,
+			ResourceType: input.ResourceType,
+			ResourceID:   input.ResourceID,
+		}
+		// granting an already granted permission is not an error
+		if err := app.models.Scoped.Insert(&scoped); err != nil && !errors.Is(err, data.ErrDuplicateRecord) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	app.models.Users.InvalidateCache(user.ID)
+
+	e := envelope{"message": "success"}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusAccepted, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) revokeScopedPermissionToUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input scopedPermissionToUserDTO
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.validate(v); !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByID(input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	for _, permissionID := range input.PermissionIDs {
+		err := app.models.Scoped.Delete(user.ID, permissionID, input.ResourceType, input.ResourceID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	app.models.Users.InvalidateCache(user.ID)
 
 	e := envelope{"message": "success"}
 	out := app.outOK(e)
@@ -525,3 +843,81 @@ func (app *application) getUserRolesAndPermissions(w http.ResponseWriter, r *htt
 		return
 	}
 }
+
+// explainUserAccessHandler shows how the access decision for a user and a
+// permission is reached, e.g. /v1/admin/users/access/7/explain?permission=orders:read
+func (app *application) explainUserAccessHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	qs := r.URL.Query()
+	v := validator.New()
+	code := app.readString(qs, "permission", "")
+	resourceType := app.readString(qs, "resource_type", "")
+	resourceID := app.readInt(qs, v, "resource_id", 0)
+	organizationID := app.readInt(qs, v, "organization_id", 0)
+
+	v.Check(code != "", "permission", "must be provided")
+	v.Check(resourceType == "" || resourceID > 0, "resource_id", "must be provided with resource_type")
+	if !v.IsValid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByIDWithAccess(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if organizationID != 0 {
+		membership, err := app.models.Organizations.GetMembership(int64(organizationID), user.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("organization_id", "the user is not a member of the organization")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		user = user.InOrganization(membership)
+	}
+
+	// route params and the ip of this request belong to the admin, so only
+	// an ip given in the query string is used for conditions.
+	req := authz.Request{
+		Permission: code,
+		Context: data.AccessContext{
+			Now:     time.Now(),
+			IP:      net.ParseIP(app.readString(qs, "ip", "")),
+			UserID:  user.ID,
+			IsAdmin: app.isAdminUser,
+		},
+	}
+	if resourceType != "" {
+		req.Resource = &authz.Resource{Type: resourceType, ID: int64(resourceID)}
+	}
+
+	trace, err := authz.Explain(user, req)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e := envelope{"trace": trace}
+	out := app.outOK(e)
+	if err := app.writeJSON(w, http.StatusOK, out, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,163 @@
+// Command rbacctl manages users, roles and permissions directly in the
+// database, for example to create the first admin. It uses the same models
+// and the same -db-driver and -db-dsn flags and MYSHOP_DB_DSN variable as the
+// api server.
+//
+// Changes made with rbacctl reach a running server once its user cache
+// entries expire (see -cache-ttl of the server).
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kubil6y/myshop-go/internal/data"
+	"github.com/kubil6y/myshop-go/internal/validator"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const usage = `usage: rbacctl [-db-driver driver] [-db-dsn dsn] <command> [flags]
+
+commands:
+  migrate up                apply the pending schema migrations
+  migrate down              roll back the last schema migrations
+  migrate status            list the schema migrations
+  user create               create a user, e.g. the first admin
+  user access               show the roles and effective permissions of a user
+  user grant-role           grant roles to a user
+  user revoke-role          revoke roles from a user
+  user grant-permission     grant permissions to a user
+  user revoke-permission    revoke permissions from a user
+  permission create         create a permission
+  permission list           list permissions
+  permission delete         delete a permission
+  role create               create a role
+  role list                 list roles with their permissions
+  role delete               delete a role
+  seed                      import a json or yaml policy file
+
+run "rbacctl <command> -h" for the flags of a command.
+`
+
+type cli struct {
+	db     *gorm.DB
+	models data.Models
+	out    io.Writer
+}
+
+type command func(c *cli, name string, args []string) error
+
+var commands = map[string]command{
+	"migrate up":             migrateUp,
+	"migrate down":           migrateDown,
+	"migrate status":         migrateStatus,
+	"user create":            createUser,
+	"user access":            showUserAccess,
+	"user grant-role":        grantRoles,
+	"user revoke-role":       revokeRoles,
+	"user grant-permission":  grantPermissions,
+	"user revoke-permission": revokePermissions,
+	"permission create":      createPermission,
+	"permission list":        listPermissions,
+	"permission delete":      deletePermission,
+	"role create":            createRole,
+	"role list":              listRoles,
+	"role delete":            deleteRole,
+	"seed":                   seed,
+}
+
+func main() {
+	driver := flag.String("db-driver", data.DriverPostgres, "Database driver (postgres|sqlite)")
+	dsn := flag.String("db-dsn", os.Getenv("MYSHOP_DB_DSN"), "PostgreSQL DSN or SQLite file")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	name, args := lookupCommand(flag.Args())
+	cmd, ok := commands[name]
+	if !ok {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := connectDatabase(*driver, *dsn)
+	if err != nil {
+		fatal(fmt.Errorf("opening database: %w", err))
+	}
+
+	c := &cli{
+		db:     db,
+		models: data.NewModels(db),
+		out:    os.Stdout,
+	}
+	if err := cmd(c, name, args); err != nil {
+		fatal(err)
+	}
+}
+
+// lookupCommand splits args into the command name, one or two words, and
+// the flags of the command.
+func lookupCommand(args []string) (string, []string) {
+	if len(args) == 0 {
+		return "", nil
+	}
+	if _, ok := commands[args[0]]; ok {
+		return args[0], args[1:]
+	}
+	if len(args) > 1 {
+		return args[0] + " " + args[1], args[2:]
+	}
+	return args[0], nil
+}
+
+func connectDatabase(driver, dsn string) (*gorm.DB, error) {
+	// the connection is made on the first query, so that "-h" of a command
+	// works without a database.
+	return data.Open(driver, dsn, &gorm.Config{
+		Logger:               logger.Default.LogMode(logger.Silent),
+		DisableAutomaticPing: true,
+	})
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "rbacctl: %v\n", err)
+	os.Exit(1)
+}
+
+// newFlagSet returns the flag set of a command, parse errors exit.
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("rbacctl "+name, flag.ExitOnError)
+}
+
+// validationError turns the errors of v into a single error, sorted by key.
+func validationError(v *validator.Validator) error {
+	var keys []string
+	for key := range v.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("%s: %s", key, v.Errors[key]))
+	}
+	return fmt.Errorf("invalid input\n  %s", strings.Join(lines, "\n  "))
+}
+
+// splitNames splits a comma separated list, dropping empty names.
+func splitNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
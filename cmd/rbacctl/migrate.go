@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kubil6y/myshop-go/internal/migrations"
+)
+
+func migrateUp(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	fs.Parse(args)
+
+	applied, err := migrations.Up(c.db)
+	for _, m := range applied {
+		if m.Adopted {
+			fmt.Fprintf(c.out, "adopted %d %s, the existing schema matches it\n", m.Version, m.Name)
+			continue
+		}
+		fmt.Fprintf(c.out, "applied %d %s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Fprintf(c.out, "schema is up to date at version %d\n", migrations.Latest())
+	}
+	return nil
+}
+
+func migrateDown(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	steps := fs.Int("steps", 1, "Number of migrations to roll back")
+	fs.Parse(args)
+
+	if *steps < 1 {
+		return errors.New("steps: must be greater than zero")
+	}
+
+	rolledBack, err := migrations.Down(c.db, *steps)
+	for _, m := range rolledBack {
+		fmt.Fprintf(c.out, "rolled back %d %s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(rolledBack) == 0 {
+		fmt.Fprintln(c.out, "nothing to roll back")
+	}
+	return nil
+}
+
+func migrateStatus(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	fs.Parse(args)
+
+	statuses, err := migrations.StatusOf(c.db)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range statuses {
+		appliedAt := "pending"
+		if s.AppliedAt != nil {
+			appliedAt = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+	return tw.Flush()
+}
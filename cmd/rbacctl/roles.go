@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kubil6y/myshop-go/internal/data"
+)
+
+func createPermission(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	permissionName := fs.String("name", "", "Name of the permission, e.g. orders:read")
+	requiresApproval := fs.Bool("requires-approval", false, "Grants of the permission wait for a second admin")
+	fs.Parse(args)
+
+	if *permissionName == "" {
+		return errors.New("name: must be provided")
+	}
+
+	permission := data.Permission{Name: *permissionName, RequiresApproval: *requiresApproval}
+	if err := c.models.Permissions.Insert(&permission); err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRecord):
+			return fmt.Errorf("a permission with name %q already exists", *permissionName)
+		default:
+			return err
+		}
+	}
+
+	fmt.Fprintf(c.out, "created permission %d (%s)\n", permission.ID, permission.Name)
+	return nil
+}
+
+func listPermissions(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	fs.Parse(args)
+
+	var permissions []data.Permission
+	if err := c.db.Order("name").Find(&permissions).Error; err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tREQUIRES APPROVAL")
+	for _, p := range permissions {
+		fmt.Fprintf(tw, "%d\t%s\t%t\n", p.ID, p.Name, p.RequiresApproval)
+	}
+	return tw.Flush()
+}
+
+func deletePermission(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	permissionName := fs.String("name", "", "Name of the permission")
+	fs.Parse(args)
+
+	permissions, err := c.permissionsByName([]string{*permissionName})
+	if err != nil {
+		return err
+	}
+	if err := c.models.Permissions.Delete(&permissions[0]); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.out, "deleted permission %s\n", *permissionName)
+	return nil
+}
+
+func createRole(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	roleName := fs.String("name", "", "Name of the role")
+	permissionNames := fs.String("permissions", "", "Comma separated permission names")
+	parentNames := fs.String("parents", "", "Comma separated names of parent roles")
+	requiresApproval := fs.Bool("requires-approval", false, "Grants of the role wait for a second admin")
+	fs.Parse(args)
+
+	if *roleName == "" {
+		return errors.New("name: must be provided")
+	}
+
+	permissions, err := c.permissionsByName(splitNames(*permissionNames))
+	if err != nil {
+		return err
+	}
+	parents, err := c.rolesByName(splitNames(*parentNames))
+	if err != nil {
+		return err
+	}
+
+	role := data.Role{
+		Name:             *roleName,
+		Permissions:      permissions,
+		Parents:          parents,
+		RequiresApproval: *requiresApproval,
+	}
+	if err := c.models.Roles.Insert(&role); err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRecord):
+			return fmt.Errorf("a role with name %q already exists", *roleName)
+		default:
+			return err
+		}
+	}
+
+	fmt.Fprintf(c.out, "created role %d (%s)\n", role.ID, role.Name)
+	return nil
+}
+
+func listRoles(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	fs.Parse(args)
+
+	var roles []data.Role
+	if err := c.db.Preload("Permissions").Preload("Parents").Order("name").Find(&roles).Error; err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPARENTS\tPERMISSIONS")
+	for _, r := range roles {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", r.ID, r.Name,
+			strings.Join(roleNames(r.Parents), ","),
+			strings.Join(permissionNames(r.Permissions), ","))
+	}
+	return tw.Flush()
+}
+
+func deleteRole(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	roleName := fs.String("name", "", "Name of the role")
+	fs.Parse(args)
+
+	roles, err := c.rolesByName([]string{*roleName})
+	if err != nil {
+		return err
+	}
+	if err := c.models.Roles.Delete(&roles[0]); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.out, "deleted role %s\n", *roleName)
+	return nil
+}
+
+func (c *cli) rolesByName(names []string) ([]data.Role, error) {
+	var roles []data.Role
+	for _, name := range names {
+		role, err := c.models.Roles.GetByName(name)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return nil, fmt.Errorf("no role with name %q", name)
+			default:
+				return nil, err
+			}
+		}
+		roles = append(roles, *role)
+	}
+	return roles, nil
+}
+
+func (c *cli) permissionsByName(names []string) ([]data.Permission, error) {
+	var permissions []data.Permission
+	for _, name := range names {
+		permission, err := c.models.Permissions.GetByName(name)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return nil, fmt.Errorf("no permission with name %q", name)
+			default:
+				return nil, err
+			}
+		}
+		permissions = append(permissions, *permission)
+	}
+	return permissions, nil
+}
+
+func roleNames(roles []data.Role) []string {
+	names := make([]string, 0, len(roles))
+	for _, r := range roles {
+		names = append(names, r.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func permissionNames(permissions []data.Permission) []string {
+	names := make([]string, 0, len(permissions))
+	for _, p := range permissions {
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return names
+}
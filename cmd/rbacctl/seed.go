@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kubil6y/myshop-go/internal/data"
+	"github.com/kubil6y/myshop-go/internal/validator"
+	"gopkg.in/yaml.v3"
+)
+
+// seed imports a policy file the same way POST /v1/admin/policy/import does.
+func seed(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	file := fs.String("file", "", "Policy file, .json, .yaml or .yml")
+	prune := fs.Bool("prune", false, "Delete permissions, bundles and roles missing from the file")
+	dryRun := fs.Bool("dry-run", false, "Only print the changes")
+	bindApprovalRoles := fs.Bool("bind-approval-roles", false, "Let bindings give roles that require approval")
+	fs.Parse(args)
+
+	if *file == "" {
+		return errors.New("file: must be provided")
+	}
+
+	policy, err := readPolicy(*file)
+	if err != nil {
+		return err
+	}
+
+	v := validator.New()
+	if data.ValidatePolicy(v, policy); !v.IsValid() {
+		return validationError(v)
+	}
+
+	changes, err := c.models.Policy.Import(policy, data.PolicyImport{
+		Prune:             *prune,
+		DryRun:            *dryRun,
+		BindApprovalRoles: *bindApprovalRoles,
+	})
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	for _, change := range changes {
+		fields := strings.Join(change.Fields, ",")
+		if len(change.WithoutApproval) > 0 {
+			fields += " (without approval: " + strings.Join(change.WithoutApproval, ",") + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", change.Action, change.Kind, change.Name, fields)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	switch {
+	case len(changes) == 0:
+		fmt.Fprintln(c.out, "nothing to change")
+	case *dryRun:
+		fmt.Fprintf(c.out, "%d changes, dry run\n", len(changes))
+	default:
+		fmt.Fprintf(c.out, "%d changes applied\n", len(changes))
+	}
+	return nil
+}
+
+func readPolicy(file string) (*data.Policy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var policy data.Policy
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		err = dec.Decode(&policy)
+	case ".json":
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&policy)
+	default:
+		return nil, fmt.Errorf("%s: unknown policy format, use .json, .yaml or .yml", file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return &policy, nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kubil6y/myshop-go/internal/authz"
+	"github.com/kubil6y/myshop-go/internal/data"
+	"github.com/kubil6y/myshop-go/internal/validator"
+)
+
+func createUser(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	email := fs.String("email", "", "Email of the user")
+	firstName := fs.String("first-name", "", "First name of the user")
+	lastName := fs.String("last-name", "", "Last name of the user")
+	password := fs.String("password", "", "Password of the user, read from stdin if empty")
+	admin := fs.Bool("admin", false, "Make the user an admin, the admin permission is created if missing")
+	activated := fs.Bool("activated", true, "Activate the user")
+	fs.Parse(args)
+
+	if *password == "" {
+		fmt.Fprint(os.Stderr, "password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("reading password: %w", err)
+		}
+		*password = strings.TrimRight(line, "\r\n")
+	}
+
+	v := validator.New()
+	v.Check(*firstName != "", "first_name", "must be provided")
+	v.Check(*lastName != "", "last_name", "must be provided")
+	v.Check(len(*firstName) > 1, "first_name", "must be longer than one character")
+	v.Check(len(*lastName) > 1, "last_name", "must be longer than one character")
+	v.Check(len(*password) > 3, "password", "must be longer than three characters")
+	validator.ValidateEmail(v, *email)
+	if !v.IsValid() {
+		return validationError(v)
+	}
+
+	user := data.User{
+		FirstName:   *firstName,
+		LastName:    *lastName,
+		Email:       *email,
+		IsActivated: *activated,
+		IsAdmin:     *admin,
+	}
+	if err := user.SetPassword(*password); err != nil {
+		return err
+	}
+
+	if err := c.models.Users.Insert(&user); err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRecord):
+			return fmt.Errorf("a user with email %q already exists", *email)
+		default:
+			return err
+		}
+	}
+
+	if *admin {
+		// routes check the admin permission, the flag alone lets nothing in.
+		permission, err := c.adminPermission()
+		if err != nil {
+			return err
+		}
+		if err := c.models.Users.GrantPermissions(user.ID, []int64{permission.ID}, data.GrantWindow{}); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(c.out, "created user %d (%s)\n", user.ID, user.Email)
+	return nil
+}
+
+// adminPermission returns the admin permission, it is created on a fresh
+// database that has not been seeded yet.
+func (c *cli) adminPermission() (*data.Permission, error) {
+	permission, err := c.models.Permissions.GetByName("admin")
+	if err == nil || !errors.Is(err, data.ErrRecordNotFound) {
+		return permission, err
+	}
+
+	permission = &data.Permission{Name: "admin"}
+	if err := c.models.Permissions.Insert(permission); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(c.out, "created permission %d (%s)\n", permission.ID, permission.Name)
+	return permission, nil
+}
+
+// showUserAccess prints the roles of the user and the permissions the user
+// holds right now. Conditions that depend on the request, like client ip
+// ranges, are evaluated without one.
+func showUserAccess(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	email := fs.String("email", "", "Email of the user")
+	fs.Parse(args)
+
+	user, err := c.userByEmail(*email)
+	if err != nil {
+		return err
+	}
+	user, err = c.models.Users.GetByIDWithAccess(user.ID)
+	if err != nil {
+		return err
+	}
+
+	catalogue, err := c.models.Permissions.GetAllNames()
+	if err != nil {
+		return err
+	}
+	permissions, err := authz.EffectivePermissions(user, catalogue, data.AccessContext{
+		Now:    time.Now(),
+		UserID: user.ID,
+	})
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "user\t%s (%d)\n", user.Email, user.ID)
+	fmt.Fprintf(tw, "activated\t%t\n", user.IsActivated)
+	fmt.Fprintf(tw, "admin\t%t\n", authz.IsAdmin(user))
+	fmt.Fprintf(tw, "roles\t%s\n", strings.Join(roleNames(user.Roles), ", "))
+	var elevated []data.Role
+	for _, e := range user.Elevations {
+		elevated = append(elevated, *e.Role)
+	}
+	if len(elevated) > 0 {
+		fmt.Fprintf(tw, "elevated\t%s\n", strings.Join(roleNames(elevated), ", "))
+	}
+	fmt.Fprintf(tw, "granted\t%s\n", strings.Join(permissionNames(user.GrantedPermissions), ", "))
+	fmt.Fprintf(tw, "revoked\t%s\n", strings.Join(permissionNames(user.RevokedPermissions), ", "))
+	fmt.Fprintf(tw, "effective\t%s\n", strings.Join(permissions, ", "))
+	return tw.Flush()
+}
+
+func grantRoles(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	email := fs.String("email", "", "Email of the user")
+	names := fs.String("roles", "", "Comma separated role names")
+	fs.Parse(args)
+
+	user, roles, err := c.userAndRoles(*email, *names)
+	if err != nil {
+		return err
+	}
+
+	var ids []int64
+	for _, role := range roles {
+		if role.OrganizationID != nil {
+			return fmt.Errorf("role %q can only be held through an organization membership", role.Name)
+		}
+		if !containsRole(user.Roles, role) {
+			user.Roles = append(user.Roles, role)
+		}
+	}
+	for _, role := range user.Roles {
+		ids = append(ids, role.ID)
+	}
+
+	conflicts, err := c.models.Conflicts.FindConflicts(ids)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("conflicting roles can not be held together: %q and %q", conflicts[0].Role.Name, conflicts[0].ConflictingRole.Name)
+	}
+
+	if err := c.models.Users.UpdateRoles(user); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "granted %s to %s\n", strings.Join(roleNames(roles), ", "), user.Email)
+	return nil
+}
+
+func revokeRoles(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	email := fs.String("email", "", "Email of the user")
+	names := fs.String("roles", "", "Comma separated role names")
+	fs.Parse(args)
+
+	user, roles, err := c.userAndRoles(*email, *names)
+	if err != nil {
+		return err
+	}
+
+	var kept []data.Role
+	for _, role := range user.Roles {
+		if !containsRole(roles, role) {
+			kept = append(kept, role)
+		}
+	}
+	user.Roles = kept
+
+	if err := c.models.Users.UpdateRoles(user); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "revoked %s from %s\n", strings.Join(roleNames(roles), ", "), user.Email)
+	return nil
+}
+
+// grantPermissions adds custom granted permissions to the user and takes
+// them out of the revoked ones.
+func grantPermissions(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	email := fs.String("email", "", "Email of the user")
+	names := fs.String("permissions", "", "Comma separated permission names")
+	fs.Parse(args)
+
+	user, permissions, err := c.userAndPermissions(*email, *names)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range permissions {
+		if !containsPermission(user.GrantedPermissions, p) {
+			user.GrantedPermissions = append(user.GrantedPermissions, p)
+		}
+	}
+	user.RevokedPermissions = withoutPermissions(user.RevokedPermissions, permissions)
+
+	if err := c.models.Users.UpdateGrantedPermissions(user); err != nil {
+		return err
+	}
+	if err := c.models.Users.UpdateRevokedPermissions(user); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "granted %s to %s\n", strings.Join(permissionNames(permissions), ", "), user.Email)
+	return nil
+}
+
+// revokePermissions takes permissions out of the custom granted ones and
+// adds them to the revoked ones, so roles no longer give them either.
+func revokePermissions(c *cli, name string, args []string) error {
+	fs := newFlagSet(name)
+	email := fs.String("email", "", "Email of the user")
+	names := fs.String("permissions", "", "Comma separated permission names")
+	fs.Parse(args)
+
+	user, permissions, err := c.userAndPermissions(*email, *names)
+	if err != nil {
+		return err
+	}
+
+	user.GrantedPermissions = withoutPermissions(user.GrantedPermissions, permissions)
+	for _, p := range permissions {
+		if !containsPermission(user.RevokedPermissions, p) {
+			user.RevokedPermissions = append(user.RevokedPermissions, p)
+		}
+	}
+
+	if err := c.models.Users.UpdateGrantedPermissions(user); err != nil {
+		return err
+	}
+	if err := c.models.Users.UpdateRevokedPermissions(user); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "revoked %s from %s\n", strings.Join(permissionNames(permissions), ", "), user.Email)
+	return nil
+}
+
+func (c *cli) userByEmail(email string) (*data.User, error) {
+	v := validator.New()
+	if validator.ValidateEmail(v, email); !v.IsValid() {
+		return nil, validationError(v)
+	}
+
+	user, err := c.models.Users.GetByEmail(email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, fmt.Errorf("no user with email %q", email)
+		default:
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// userAndRoles loads the user with its roles and permissions, and the roles
+// in the comma separated list.
+func (c *cli) userAndRoles(email, names string) (*data.User, []data.Role, error) {
+	user, err := c.userByEmail(email)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err = c.models.Users.GetByIDWithRolesAndPermissions(user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	roles, err := c.rolesByName(splitNames(names))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(roles) == 0 {
+		return nil, nil, errors.New("roles: must be provided")
+	}
+	return user, roles, nil
+}
+
+// userAndPermissions is userAndRoles for permissions.
+func (c *cli) userAndPermissions(email, names string) (*data.User, []data.Permission, error) {
+	user, err := c.userByEmail(email)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err = c.models.Users.GetByIDWithRolesAndPermissions(user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	permissions, err := c.permissionsByName(splitNames(names))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(permissions) == 0 {
+		return nil, nil, errors.New("permissions: must be provided")
+	}
+	return user, permissions, nil
+}
+
+func containsRole(list []data.Role, role data.Role) bool {
+	for _, v := range list {
+		if v.ID == role.ID {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPermission(list []data.Permission, p data.Permission) bool {
+	for _, v := range list {
+		if v.ID == p.ID {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutPermissions(list, remove []data.Permission) []data.Permission {
+	var result []data.Permission
+	for _, p := range list {
+		if !containsPermission(remove, p) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
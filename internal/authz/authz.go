@@ -0,0 +1,182 @@
+// Package authz decides whether a user holds a permission. It merges the
+// permissions coming from roles (direct and inherited), custom grants,
+// resource scoped grants and revocations, so that the http middleware and
+// the policy decision endpoint share the same logic.
+package authz
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/kubil6y/myshop-go/internal/data"
+)
+
+// Sources of a decision.
+const (
+	SourceGranted  = "granted_permission"
+	SourceRevoked  = "revoked_permission"
+	SourceInactive = "inactive_account"
+	SourceNone     = "no_matching_permission"
+)
+
+// Request is a single access question about a user.
+type Request struct {
+	Permission string
+	// Resource is optional, if set permissions granted on it are considered.
+	Resource *Resource
+	Context  data.AccessContext
+}
+
+type Resource struct {
+	Type string `json:"type"`
+	ID   int64  `json:"id"`
+}
+
+// Decision is the answer to a Request. Source tells which role, bundle or
+// custom grant produced it, e.g. "role:editor", "bundle:orders-readonly",
+// "granted_permission" or "revoked_permission", and Match is the permission
+// name that matched.
+type Decision struct {
+	Permission string    `json:"permission"`
+	Resource   *Resource `json:"resource,omitempty"`
+	Allowed    bool      `json:"allowed"`
+	Source     string    `json:"source"`
+	Match      string    `json:"match,omitempty"`
+}
+
+// grant is a permission together with where it comes from.
+type grant struct {
+	permission data.Permission
+	source     string
+}
+
+// Evaluate decides req for user. The most specific matching grant or
+// revocation wins and revocations win ties.
+func Evaluate(user *data.User, req Request) (Decision, error) {
+	decision := Decision{Permission: req.Permission, Resource: req.Resource}
+
+	if !user.IsActivated {
+		decision.Source = SourceInactive
+		return decision, nil
+	}
+
+	granted, err := grants(user, req)
+	if err != nil {
+		return decision, err
+	}
+	revoked := revocations(user)
+
+	g := bestMatch(granted, req.Permission)
+	if g == nil {
+		decision.Source = SourceNone
+		return decision, nil
+	}
+
+	rv := bestMatch(revoked, req.Permission)
+	if rv != nil && data.PermissionSpecificity(rv.permission.Name) >= data.PermissionSpecificity(g.permission.Name) {
+		decision.Source = rv.source
+		decision.Match = rv.permission.Name
+		return decision, nil
+	}
+
+	decision.Allowed = true
+	decision.Source = g.source
+	decision.Match = g.permission.Name
+	return decision, nil
+}
+
+// IsAdmin reports whether the user has the admin flag or the admin
+// permission. Role conditions are ignored on purpose, so a user who is an
+// admin only sometimes is treated as an admin.
+func IsAdmin(user *data.User) bool {
+	var granted []data.Permission
+	granted = append(granted, user.GrantedPermissions...)
+	granted = append(granted, data.BundlePermissions(user.Bundles)...)
+	for _, role := range user.EffectiveRoles() {
+		granted = append(granted, role.AllPermissions()...)
+	}
+	return user.IsAdmin || data.IsPermitted(granted, user.RevokedPermissions, "admin")
+}
+
+// grants collects everything that grants a permission to the user for req,
+// bundles are expanded.
+// Role permissions with conditions are only included if the conditions hold.
+func grants(user *data.User, req Request) ([]grant, error) {
+	var result []grant
+
+	for _, p := range user.GrantedPermissions {
+		result = append(result, grant{p, SourceGranted})
+	}
+
+	for _, b := range user.Bundles {
+		source := fmt.Sprintf("bundle:%s", b.Name)
+		for _, p := range b.Permissions {
+			result = append(result, grant{p, source})
+		}
+	}
+
+	for _, role := range user.EffectiveRoles() {
+		source := fmt.Sprintf("role:%s", role.Name)
+		for _, p := range role.AllPermissions() {
+			if p.Conditions != nil {
+				ok, err := p.Conditions.Evaluate(req.Context)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					continue
+				}
+			}
+			result = append(result, grant{p, source})
+		}
+	}
+
+	if req.Resource != nil {
+		source := fmt.Sprintf("scoped:%s:%d", req.Resource.Type, req.Resource.ID)
+		for _, p := range data.ScopedPermissionsFor(user.ScopedPermissions, req.Resource.Type, req.Resource.ID) {
+			result = append(result, grant{p, source})
+		}
+	}
+
+	return result, nil
+}
+
+func revocations(user *data.User) []grant {
+	var result []grant
+	for _, p := range user.RevokedPermissions {
+		result = append(result, grant{p, SourceRevoked})
+	}
+	return result
+}
+
+// bestMatch returns the most specific entry in list that covers code, the
+// first one wins a tie.
+func bestMatch(list []grant, code string) *grant {
+	var best *grant
+	for i := range list {
+		if !data.PermissionMatches(list[i].permission.Name, code) {
+			continue
+		}
+		if best == nil || data.PermissionSpecificity(list[i].permission.Name) > data.PermissionSpecificity(best.permission.Name) {
+			best = &list[i]
+		}
+	}
+	return best
+}
+
+// EffectivePermissions returns, sorted, the names in catalogue that user
+// holds, so wildcard grants and revocations are already applied.
+func EffectivePermissions(user *data.User, catalogue []string, ctx data.AccessContext) ([]string, error) {
+	result := make([]string, 0)
+	for _, name := range catalogue {
+		decision, err := Evaluate(user, Request{Permission: name, Context: ctx})
+		if err != nil {
+			return nil, err
+		}
+		if decision.Allowed {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
@@ -0,0 +1,127 @@
+package authz
+
+import (
+	"github.com/kubil6y/myshop-go/internal/data"
+)
+
+// Trace explains how a Decision was reached.
+type Trace struct {
+	Decision  Decision `json:"decision"`
+	Activated bool     `json:"activated"`
+	// Roles lists every role of the user that was examined, elevated ones
+	// included, with the permissions of the role that cover the requested
+	// one.
+	Roles []RoleTrace `json:"roles"`
+	// Bundles lists every bundle attached to the user directly.
+	Bundles []BundleTrace `json:"bundles"`
+	// Granted, Scoped and Revoked list the custom permissions of the user
+	// that cover the requested one.
+	Granted []PermissionTrace `json:"granted_permissions"`
+	Scoped  []PermissionTrace `json:"scoped_permissions"`
+	Revoked []PermissionTrace `json:"revoked_permissions"`
+}
+
+type RoleTrace struct {
+	ID      int64             `json:"id"`
+	Name    string            `json:"name"`
+	Matches []PermissionTrace `json:"matches"`
+}
+
+type BundleTrace struct {
+	ID      int64             `json:"id"`
+	Name    string            `json:"name"`
+	Matches []PermissionTrace `json:"matches"`
+}
+
+type PermissionTrace struct {
+	Name        string `json:"name"`
+	Specificity int    `json:"specificity"`
+	// Inherited is set for role permissions that come from a parent role or
+	// a bundle of the role.
+	Inherited bool `json:"inherited,omitempty"`
+	// Conditions and ConditionsMet are set for role permissions that are
+	// granted conditionally.
+	Conditions    *data.Conditions `json:"conditions,omitempty"`
+	ConditionsMet *bool            `json:"conditions_met,omitempty"`
+}
+
+// Explain evaluates req for user like Evaluate does, and also returns
+// everything that was looked at on the way.
+func Explain(user *data.User, req Request) (Trace, error) {
+	decision, err := Evaluate(user, req)
+	if err != nil {
+		return Trace{}, err
+	}
+
+	roles := user.EffectiveRoles()
+	trace := Trace{
+		Decision:  decision,
+		Activated: user.IsActivated,
+		Roles:     make([]RoleTrace, 0, len(roles)),
+		Bundles:   make([]BundleTrace, 0, len(user.Bundles)),
+		Granted:   matching(user.GrantedPermissions, req.Permission),
+		Revoked:   matching(user.RevokedPermissions, req.Permission),
+		Scoped:    make([]PermissionTrace, 0),
+	}
+
+	if req.Resource != nil {
+		scoped := data.ScopedPermissionsFor(user.ScopedPermissions, req.Resource.Type, req.Resource.ID)
+		trace.Scoped = matching(scoped, req.Permission)
+	}
+
+	for _, b := range user.Bundles {
+		trace.Bundles = append(trace.Bundles, BundleTrace{
+			ID:      b.ID,
+			Name:    b.Name,
+			Matches: matching(b.Permissions, req.Permission),
+		})
+	}
+
+	for _, role := range roles {
+		rt := RoleTrace{ID: role.ID, Name: role.Name, Matches: make([]PermissionTrace, 0)}
+
+		for _, p := range role.AllPermissions() {
+			if !data.PermissionMatches(p.Name, req.Permission) {
+				continue
+			}
+
+			pt := PermissionTrace{
+				Name:        p.Name,
+				Specificity: data.PermissionSpecificity(p.Name),
+				Inherited:   !containsPermission(role.Permissions, p),
+			}
+			if p.Conditions != nil {
+				ok, err := p.Conditions.Evaluate(req.Context)
+				if err != nil {
+					return Trace{}, err
+				}
+				pt.Conditions = p.Conditions
+				pt.ConditionsMet = &ok
+			}
+			rt.Matches = append(rt.Matches, pt)
+		}
+
+		trace.Roles = append(trace.Roles, rt)
+	}
+
+	return trace, nil
+}
+
+func matching(list []data.Permission, code string) []PermissionTrace {
+	result := make([]PermissionTrace, 0)
+	for _, p := range list {
+		if data.PermissionMatches(p.Name, code) {
+			result = append(result, PermissionTrace{Name: p.Name, Specificity: data.PermissionSpecificity(p.Name)})
+		}
+	}
+	return result
+}
+
+func containsPermission(list []data.Permission, p data.Permission) bool {
+	for _, v := range list {
+		if v.ID == p.ID && v.Conditions == p.Conditions {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package data
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// Bundle is a named group of permissions, e.g. "orders-readonly", that can be
+// attached to roles and users. Bundles are expanded whenever roles and users
+// are loaded, so changing a bundle changes everyone holding it.
+type Bundle struct {
+	CoreModel
+	Name        string       `json:"name" gorm:"uniqueIndex;not null"`
+	Permissions []Permission `json:"permissions,omitempty" gorm:"many2many:bundles_permissions;constraint:OnDelete:CASCADE"`
+}
+
+// BundlePermissions returns the permissions of every bundle in the list.
+func BundlePermissions(bundles []Bundle) []Permission {
+	var result []Permission
+	for _, b := range bundles {
+		result = append(result, b.Permissions...)
+	}
+	return result
+}
+
+// UserBundleApprovals returns the permissions that require approval in the
+// bundles, keyed by bundle and permission name. Bundles attached to users
+// must not have any, attaching one to a user would grant them without the
+// approval a custom grant waits for.
+func UserBundleApprovals(bundles []*Bundle) map[[2]string]bool {
+	result := make(map[[2]string]bool)
+	for _, b := range bundles {
+		for _, p := range b.Permissions {
+			if p.RequiresApproval {
+				result[[2]string{b.Name, p.Name}] = true
+			}
+		}
+	}
+	return result
+}
+
+type BundleModel struct {
+	DB *gorm.DB
+}
+
+func (m BundleModel) GetAll(p *Paginate) ([]*Bundle, Metadata, error) {
+	bundles := make([]*Bundle, 0)
+	err := m.DB.Preload("Permissions").Scopes(p.PaginatedResults).Find(&bundles).Error
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	var total int64
+	m.DB.Model(&Bundle{}).Count(&total)
+	metadata := CalculateMetadata(p, int(total))
+	return bundles, metadata, nil
+}
+
+func (m BundleModel) GetByID(id int64) (*Bundle, error) {
+	var bundle Bundle
+	err := m.DB.Preload("Permissions").Where("id=?", id).First(&bundle).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &bundle, nil
+}
+
+func (m BundleModel) GetByName(name string) (*Bundle, error) {
+	var bundle Bundle
+	err := m.DB.Preload("Permissions").Where("name = ?", name).First(&bundle).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &bundle, nil
+}
+
+func (m BundleModel) GetAllAttachedToUsers() ([]*Bundle, error) {
+	bundles := make([]*Bundle, 0)
+	err := m.DB.Preload("Permissions").
+		Where("id IN (?)", m.DB.Table("users_bundles").Select("bundle_id")).
+		Order("id").
+		Find(&bundles).Error
+	if err != nil {
+		return nil, err
+	}
+	return bundles, nil
+}
+
+func (m BundleModel) Insert(b *Bundle) error {
+	err := m.DB.Create(b).Error
+	if err != nil {
+		switch {
+		case IsDuplicateRecord(err):
+			return ErrDuplicateRecord
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m BundleModel) Update(b *Bundle) error {
+	err := m.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(b).Association("Permissions").Replace(b.Permissions); err != nil {
+			return err
+		}
+		return tx.Model(b).Select("Name").Updates(b).Error
+	})
+	if err != nil {
+		switch {
+		case IsDuplicateRecord(err):
+			return ErrDuplicateRecord
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m BundleModel) Delete(b *Bundle) error {
+	return m.DB.Delete(b).Error
+}
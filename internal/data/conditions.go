@@ -0,0 +1,164 @@
+package data
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/kubil6y/myshop-go/internal/validator"
+)
+
+// timeOfDayLayout is used for After and Before in Conditions.
+const timeOfDayLayout = "15:04"
+
+// Conditions are attribute based rules attached to a permission of a role,
+// the role grants the permission only when all of them hold.
+type Conditions struct {
+	// After and Before limit access to a daily window in UTC, e.g. "09:00"
+	// and "17:00". The window wraps midnight if After is later than Before.
+	After  string `json:"after,omitempty"`
+	Before string `json:"before,omitempty"`
+	// CIDRs limits access to requests coming from one of these ranges.
+	CIDRs []string `json:"cidrs,omitempty"`
+	// OwnerParam is a route param that must be equal to the caller's id.
+	OwnerParam string `json:"owner_param,omitempty"`
+	// NonAdminTargetParam is a route param holding a user id, access is
+	// granted only if that user is not an admin.
+	NonAdminTargetParam string `json:"non_admin_target_param,omitempty"`
+}
+
+// AccessContext holds the attributes of a request that Conditions are
+// evaluated against.
+type AccessContext struct {
+	Now    time.Time
+	IP     net.IP
+	UserID int64
+	Params map[string]string
+	// IsAdmin reports whether the user with the given id is an admin.
+	IsAdmin func(userID int64) (bool, error)
+}
+
+func (c Conditions) IsZero() bool {
+	return c.After == "" && c.Before == "" && len(c.CIDRs) == 0 &&
+		c.OwnerParam == "" && c.NonAdminTargetParam == ""
+}
+
+// Value stores conditions as json, empty conditions are stored as NULL.
+func (c Conditions) Value() (driver.Value, error) {
+	if c.IsZero() {
+		return nil, nil
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (c *Conditions) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*c = Conditions{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, c)
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	default:
+		return fmt.Errorf("unsupported type for conditions: %T", value)
+	}
+}
+
+func ValidateConditions(v *validator.Validator, c *Conditions) {
+	if c.After != "" || c.Before != "" {
+		_, err := time.Parse(timeOfDayLayout, c.After)
+		v.Check(err == nil, "after", "must be in HH:MM format")
+		_, err = time.Parse(timeOfDayLayout, c.Before)
+		v.Check(err == nil, "before", "must be in HH:MM format")
+	}
+	for _, cidr := range c.CIDRs {
+		_, _, err := net.ParseCIDR(cidr)
+		v.Check(err == nil, "cidrs", "must be valid CIDR ranges")
+	}
+}
+
+// Evaluate reports whether all of the conditions hold in ctx.
+func (c *Conditions) Evaluate(ctx AccessContext) (bool, error) {
+	if c.After != "" && c.Before != "" {
+		ok, err := c.inTimeWindow(ctx.Now)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	if len(c.CIDRs) > 0 {
+		ok, err := c.inCIDRs(ctx.IP)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	if c.OwnerParam != "" {
+		if ctx.Params[c.OwnerParam] != strconv.FormatInt(ctx.UserID, 10) {
+			return false, nil
+		}
+	}
+
+	if c.NonAdminTargetParam != "" {
+		targetID, err := strconv.ParseInt(ctx.Params[c.NonAdminTargetParam], 10, 64)
+		if err != nil {
+			return false, nil
+		}
+		if ctx.IsAdmin == nil {
+			return false, errors.New("conditions: missing admin lookup in access context")
+		}
+		isAdmin, err := ctx.IsAdmin(targetID)
+		if err != nil || isAdmin {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (c *Conditions) inTimeWindow(now time.Time) (bool, error) {
+	after, err := time.Parse(timeOfDayLayout, c.After)
+	if err != nil {
+		return false, err
+	}
+	before, err := time.Parse(timeOfDayLayout, c.Before)
+	if err != nil {
+		return false, err
+	}
+
+	now = now.UTC()
+	minutes := now.Hour()*60 + now.Minute()
+	start := after.Hour()*60 + after.Minute()
+	end := before.Hour()*60 + before.Minute()
+
+	if start <= end {
+		return minutes >= start && minutes < end, nil
+	}
+	// window wraps midnight, e.g. 22:00 - 06:00
+	return minutes >= start || minutes < end, nil
+}
+
+func (c *Conditions) inCIDRs(ip net.IP) (bool, error) {
+	if ip == nil {
+		return false, nil
+	}
+	for _, cidr := range c.CIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return false, err
+		}
+		if network.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,109 @@
+package data
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Database drivers supported by Open.
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// Open connects to the database with the driver and sets up the join tables.
+// For SQLite dsn is a file name, e.g. "myshop.db", foreign keys are turned on,
+// times are stored in UTC and a single connection is used since SQLite has
+// one writer at a time.
+func Open(driver, dsn string, opts ...gorm.Option) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch driver {
+	case DriverPostgres:
+		dialector = postgres.Open(dsn)
+	case DriverSQLite:
+		dialector = &sqlite.Dialector{DriverName: sqliteUTCDriverName, DSN: sqliteDSN(dsn)}
+	default:
+		return nil, fmt.Errorf("unknown database driver %q, use %s or %s", driver, DriverPostgres, DriverSQLite)
+	}
+
+	db, err := gorm.Open(dialector, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if driver == DriverSQLite {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		sqlDB.SetMaxOpenConns(1)
+	}
+
+	if err := SetupJoinTables(db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// sqliteDSN turns on the foreign keys, which the cascading deletes rely on,
+// unless dsn already sets them.
+func sqliteDSN(dsn string) string {
+	if strings.Contains(dsn, "_foreign_keys=") || strings.Contains(dsn, "_fk=") {
+		return dsn
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&_foreign_keys=on"
+	}
+	return dsn + "?_foreign_keys=on"
+}
+
+// sqliteUTCDriverName is the sqlite3 driver that binds times in UTC. SQLite
+// stores times as text with their offset and compares them as text, so a
+// time in another zone would compare wrongly with the stored ones.
+const sqliteUTCDriverName = "sqlite3_utc"
+
+func init() {
+	sql.Register(sqliteUTCDriverName, &sqliteUTCDriver{})
+}
+
+type sqliteUTCDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+func (d *sqliteUTCDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteUTCConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type sqliteUTCConn struct {
+	*sqlite3.SQLiteConn
+}
+
+// CheckNamedValue converts times to UTC and leaves every other value to the
+// default conversion.
+func (c *sqliteUTCConn) CheckNamedValue(nv *driver.NamedValue) error {
+	switch v := nv.Value.(type) {
+	case time.Time:
+		nv.Value = v.UTC()
+		return nil
+	case *time.Time:
+		if v == nil {
+			nv.Value = nil
+		} else {
+			nv.Value = v.UTC()
+		}
+		return nil
+	}
+	return driver.ErrSkip
+}
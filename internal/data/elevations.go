@@ -0,0 +1,45 @@
+package data
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Elevation is a break-glass grant of a role for a short time, given to the
+// user with a written reason. Elevations are kept after they expire, they
+// are the audit trail of emergency access.
+type Elevation struct {
+	CoreModel
+	// UserID and RoleID are cleared when the user or the role is deleted,
+	// UserEmail and RoleName keep the audit trail readable.
+	UserID    *int64    `json:"user_id" gorm:"index"`
+	UserEmail string    `json:"user_email" gorm:"not null;default:''"`
+	RoleID    *int64    `json:"role_id"`
+	Role      *Role     `json:"role,omitempty" gorm:"constraint:OnDelete:SET NULL"`
+	RoleName  string    `json:"role_name" gorm:"not null;default:''"`
+	Reason    string    `json:"reason" gorm:"not null"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"not null;index"`
+}
+
+type ElevationModel struct {
+	DB *gorm.DB
+}
+
+func (m ElevationModel) Insert(e *Elevation) error {
+	return m.DB.Omit("Role").Create(e).Error
+}
+
+// GetAll returns elevations newest first.
+func (m ElevationModel) GetAll(p *Paginate) ([]*Elevation, Metadata, error) {
+	elevations := make([]*Elevation, 0)
+	err := m.DB.Preload("Role").Scopes(p.PaginatedResults).Order("id desc").Find(&elevations).Error
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	var total int64
+	m.DB.Model(&Elevation{}).Count(&total)
+	metadata := CalculateMetadata(p, int(total))
+	return elevations, metadata, nil
+}
@@ -0,0 +1,176 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kubil6y/myshop-go/internal/validator"
+	"gorm.io/gorm"
+)
+
+const (
+	GrantRequestPending  = "pending"
+	GrantRequestApproved = "approved"
+	GrantRequestRejected = "rejected"
+	GrantRequestExpired  = "expired"
+)
+
+const (
+	GrantKindRole       = "role"
+	GrantKindPermission = "permission"
+	// GrantKindMembershipRole is a role of the user in the organization of
+	// the request.
+	GrantKindMembershipRole = "membership_role"
+)
+
+// ErrNotMember is returned when approving a membership role of a user who
+// left the organization.
+var ErrNotMember = errors.New("user is not a member of the organization")
+
+// GrantRequest is a pending grant of a role or a permission that requires
+// approval, it is applied only after a second admin approves it.
+type GrantRequest struct {
+	CoreModel
+	UserID   int64  `json:"user_id" gorm:"not null;index"`
+	Kind     string `json:"kind" gorm:"not null"`
+	TargetID int64  `json:"target_id" gorm:"not null"`
+	// OrganizationID is set for membership roles.
+	OrganizationID *int64 `json:"organization_id,omitempty"`
+	// GrantWindow is the window of the grant once it is applied.
+	GrantWindow
+	Status        string     `json:"status" gorm:"not null;index"`
+	RequestedByID int64      `json:"requested_by_id" gorm:"not null"`
+	PendingUntil  time.Time  `json:"pending_until" gorm:"not null"`
+	DecidedByID   *int64     `json:"decided_by_id,omitempty"`
+	DecidedAt     *time.Time `json:"decided_at,omitempty"`
+}
+
+// IsPending reports whether the request can still be decided.
+func (g *GrantRequest) IsPending(now time.Time) bool {
+	return g.Status == GrantRequestPending && now.Before(g.PendingUntil)
+}
+
+func ValidateGrantRequestStatus(v *validator.Validator, status string) {
+	v.Check(validator.In(status, "", GrantRequestPending, GrantRequestApproved, GrantRequestRejected, GrantRequestExpired),
+		"status", "invalid value")
+}
+
+type GrantRequestModel struct {
+	DB *gorm.DB
+}
+
+func (m GrantRequestModel) Insert(g *GrantRequest) error {
+	return m.DB.Create(g).Error
+}
+
+// GetAll returns grant requests, newest first, optionally filtered by status.
+func (m GrantRequestModel) GetAll(status string, p *Paginate) ([]*GrantRequest, Metadata, error) {
+	query := m.DB.Model(&GrantRequest{})
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	requests := make([]*GrantRequest, 0)
+	err := query.Session(&gorm.Session{}).Scopes(p.PaginatedResults).Order("id desc").Find(&requests).Error
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	var total int64
+	query.Count(&total)
+	metadata := CalculateMetadata(p, int(total))
+	return requests, metadata, nil
+}
+
+func (m GrantRequestModel) GetByID(id int64) (*GrantRequest, error) {
+	var request GrantRequest
+	if err := m.DB.First(&request, id).Error; err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &request, nil
+}
+
+// Decide sets the status of a pending request, it returns
+// ErrRecordNotFound if the request is no longer pending.
+func (m GrantRequestModel) Decide(g *GrantRequest, status string, decidedByID int64) error {
+	return decideGrantRequest(m.DB, g, status, decidedByID)
+}
+
+// Approve marks a pending request approved and applies its grant in one
+// transaction, so a request is never approved without its grant or granted
+// twice. It returns ErrRecordNotFound if the request is no longer pending.
+func (m GrantRequestModel) Approve(g *GrantRequest, decidedByID int64) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		if err := decideGrantRequest(tx, g, GrantRequestApproved, decidedByID); err != nil {
+			return err
+		}
+
+		switch g.Kind {
+		case GrantKindRole:
+			return grantRoles(tx, g.UserID, []int64{g.TargetID}, g.GrantWindow)
+		case GrantKindPermission:
+			return grantPermissions(tx, g.UserID, []int64{g.TargetID}, g.GrantWindow)
+		case GrantKindMembershipRole:
+			return grantMembershipRole(tx, *g.OrganizationID, g.UserID, g.TargetID)
+		default:
+			return fmt.Errorf("unknown grant request kind %q", g.Kind)
+		}
+	})
+}
+
+// grantMembershipRole adds the role to the membership of the user in the
+// organization, it returns ErrNotMember if there is none.
+func grantMembershipRole(tx *gorm.DB, organizationID, userID, roleID int64) error {
+	var membership Membership
+	err := tx.Where("organization_id = ? and user_id = ?", organizationID, userID).First(&membership).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return ErrNotMember
+		default:
+			return err
+		}
+	}
+
+	return tx.Exec(
+		"INSERT INTO memberships_roles (membership_id, role_id) VALUES (?, ?) ON CONFLICT DO NOTHING",
+		membership.ID, roleID,
+	).Error
+}
+
+func decideGrantRequest(tx *gorm.DB, g *GrantRequest, status string, decidedByID int64) error {
+	now := time.Now()
+	result := tx.Model(g).
+		Where("status = ? and pending_until > ?", GrantRequestPending, now).
+		Updates(map[string]interface{}{
+			"status":        status,
+			"decided_by_id": decidedByID,
+			"decided_at":    now,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	g.Status = status
+	g.DecidedByID = &decidedByID
+	g.DecidedAt = &now
+	return nil
+}
+
+// ExpirePending marks the pending requests that were not decided in time as
+// expired, it returns the number of expired requests.
+func (m GrantRequestModel) ExpirePending() (int64, error) {
+	result := m.DB.Model(&GrantRequest{}).
+		Where("status = ? and pending_until <= ?", GrantRequestPending, time.Now()).
+		Update("status", GrantRequestExpired)
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,45 @@
+package data
+
+import (
+	"time"
+)
+
+// GrantWindow limits a grant to a period of time, a nil bound is open.
+type GrantWindow struct {
+	StartsAt  *time.Time `json:"starts_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" gorm:"index"`
+}
+
+// IsActive reports whether the grant is in effect at the given time.
+func (g GrantWindow) IsActive(now time.Time) bool {
+	if g.StartsAt != nil && now.Before(*g.StartsAt) {
+		return false
+	}
+	if g.ExpiresAt != nil && !now.Before(*g.ExpiresAt) {
+		return false
+	}
+	return true
+}
+
+// UserRole is the join between users and roles.
+type UserRole struct {
+	UserID int64 `json:"user_id" gorm:"primaryKey"`
+	RoleID int64 `json:"role_id" gorm:"primaryKey"`
+	GrantWindow
+}
+
+func (UserRole) TableName() string {
+	return "users_roles"
+}
+
+// GrantedUserPermission is the join between users and their custom granted
+// permissions.
+type GrantedUserPermission struct {
+	UserID       int64 `json:"user_id" gorm:"primaryKey"`
+	PermissionID int64 `json:"permission_id" gorm:"primaryKey"`
+	GrantWindow
+}
+
+func (GrantedUserPermission) TableName() string {
+	return "granted_users_permissions"
+}
@@ -0,0 +1,371 @@
+package data
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// NewMemoryModels returns models that keep everything in memory, for tests
+// and demos. They behave like the gorm models: ErrRecordNotFound,
+// ErrDuplicateRecord on unique names and emails, the same preloading,
+// cascading deletes and pagination metadata. There is no user cache.
+func NewMemoryModels() Models {
+	return memoryModels(&memoryStore{t: newMemoryTables()})
+}
+
+func memoryModels(s *memoryStore) Models {
+	return Models{
+		Users:         memoryUserModel{s},
+		Tokens:        memoryTokenModel{s},
+		Roles:         memoryRoleModel{s},
+		Permissions:   memoryPermissionModel{s},
+		Scoped:        memoryScopedPermissionModel{s},
+		Organizations: memoryOrganizationModel{s},
+		Conflicts:     memoryRoleConflictModel{s},
+		GrantRequests: memoryGrantRequestModel{s},
+		Elevations:    memoryElevationModel{s},
+		Bundles:       memoryBundleModel{s},
+		Policy:        memoryPolicyModel{s},
+	}
+}
+
+type memoryStore struct {
+	mu sync.Mutex
+	t  *memoryTables
+}
+
+// memoryTables holds the rows like the database does: records without their
+// associations, and the join tables.
+type memoryTables struct {
+	ids map[string]int64
+
+	users         map[int64]User
+	tokens        map[int64]Token
+	roles         map[int64]Role
+	permissions   map[int64]Permission
+	bundles       map[int64]Bundle
+	scoped        map[int64]ScopedUserPermission
+	organizations map[int64]Organization
+	memberships   map[int64]Membership
+	conflicts     map[int64]RoleConflict
+	grantRequests map[int64]GrantRequest
+	elevations    map[int64]Elevation
+
+	usersRoles              []UserRole
+	grantedPermissions      []GrantedUserPermission
+	rolesPermissions        []RolePermission
+	revokedPermissions      []memoryJoin
+	usersBundles            []memoryJoin
+	rolesParents            []memoryJoin
+	rolesBundles            []memoryJoin
+	rolesManagedRoles       []memoryJoin
+	rolesManagedPermissions []memoryJoin
+	bundlesPermissions      []memoryJoin
+	membershipsRoles        []memoryJoin
+}
+
+// memoryJoin is a row of a plain join table, e.g. roles_parents with the
+// role as left and the parent as right.
+type memoryJoin struct {
+	left, right int64
+}
+
+func newMemoryTables() *memoryTables {
+	return &memoryTables{
+		ids:           make(map[string]int64),
+		users:         make(map[int64]User),
+		tokens:        make(map[int64]Token),
+		roles:         make(map[int64]Role),
+		permissions:   make(map[int64]Permission),
+		bundles:       make(map[int64]Bundle),
+		scoped:        make(map[int64]ScopedUserPermission),
+		organizations: make(map[int64]Organization),
+		memberships:   make(map[int64]Membership),
+		conflicts:     make(map[int64]RoleConflict),
+		grantRequests: make(map[int64]GrantRequest),
+		elevations:    make(map[int64]Elevation),
+	}
+}
+
+// clone returns a copy of the tables that can be changed independently.
+func (t *memoryTables) clone() *memoryTables {
+	c := newMemoryTables()
+	for k, v := range t.ids {
+		c.ids[k] = v
+	}
+	for k, v := range t.users {
+		c.users[k] = v
+	}
+	for k, v := range t.tokens {
+		c.tokens[k] = v
+	}
+	for k, v := range t.roles {
+		c.roles[k] = v
+	}
+	for k, v := range t.permissions {
+		c.permissions[k] = v
+	}
+	for k, v := range t.bundles {
+		c.bundles[k] = v
+	}
+	for k, v := range t.scoped {
+		c.scoped[k] = v
+	}
+	for k, v := range t.organizations {
+		c.organizations[k] = v
+	}
+	for k, v := range t.memberships {
+		c.memberships[k] = v
+	}
+	for k, v := range t.conflicts {
+		c.conflicts[k] = v
+	}
+	for k, v := range t.grantRequests {
+		c.grantRequests[k] = v
+	}
+	for k, v := range t.elevations {
+		c.elevations[k] = v
+	}
+
+	c.usersRoles = append(c.usersRoles, t.usersRoles...)
+	c.grantedPermissions = append(c.grantedPermissions, t.grantedPermissions...)
+	c.rolesPermissions = append(c.rolesPermissions, t.rolesPermissions...)
+	c.revokedPermissions = append(c.revokedPermissions, t.revokedPermissions...)
+	c.usersBundles = append(c.usersBundles, t.usersBundles...)
+	c.rolesParents = append(c.rolesParents, t.rolesParents...)
+	c.rolesBundles = append(c.rolesBundles, t.rolesBundles...)
+	c.rolesManagedRoles = append(c.rolesManagedRoles, t.rolesManagedRoles...)
+	c.rolesManagedPermissions = append(c.rolesManagedPermissions, t.rolesManagedPermissions...)
+	c.bundlesPermissions = append(c.bundlesPermissions, t.bundlesPermissions...)
+	c.membershipsRoles = append(c.membershipsRoles, t.membershipsRoles...)
+	return c
+}
+
+// nextID returns the next id of the table, ids start at 1 like serials do.
+func (t *memoryTables) nextID(table string) int64 {
+	t.ids[table]++
+	return t.ids[table]
+}
+
+// newCore returns the core fields of a new row of the table.
+func (t *memoryTables) newCore(table string) CoreModel {
+	now := time.Now()
+	return CoreModel{ID: t.nextID(table), CreatedAt: now, UpdatedAt: now}
+}
+
+// sortedIDs sorts ids in place, which is the insertion order of the rows.
+func sortedIDs(ids []int64) []int64 {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// paginate returns the part of ids on the page of p.
+func paginate(ids []int64, p *Paginate) []int64 {
+	offset := (p.Page - 1) * p.Limit
+	if offset >= len(ids) {
+		return nil
+	}
+	end := offset + p.Limit
+	if end > len(ids) {
+		end = len(ids)
+	}
+	return ids[offset:end]
+}
+
+// joined returns the right ids joined to left, in insertion order.
+func joined(rows []memoryJoin, left int64) []int64 {
+	var ids []int64
+	for _, row := range rows {
+		if row.left == left {
+			ids = append(ids, row.right)
+		}
+	}
+	return ids
+}
+
+// replaceJoins makes left joined to exactly the rights, like replacing a
+// gorm association does, existing rows are kept.
+func replaceJoins(rows []memoryJoin, left int64, rights []int64) []memoryJoin {
+	keep := idSet(rights)
+	result := rows[:0:0]
+	present := make(map[int64]bool)
+	for _, row := range rows {
+		if row.left == left {
+			if !keep[row.right] {
+				continue
+			}
+			present[row.right] = true
+		}
+		result = append(result, row)
+	}
+	for _, id := range rights {
+		if !present[id] {
+			present[id] = true
+			result = append(result, memoryJoin{left: left, right: id})
+		}
+	}
+	return result
+}
+
+// dropJoins removes the rows with left on the left side or right on the
+// right side, like the cascading foreign keys do. Zero matches nothing.
+func dropJoins(rows []memoryJoin, left, right int64) []memoryJoin {
+	result := rows[:0:0]
+	for _, row := range rows {
+		if (left != 0 && row.left == left) || (right != 0 && row.right == right) {
+			continue
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+func permissionIDs(permissions []Permission) []int64 {
+	ids := make([]int64, 0, len(permissions))
+	for _, p := range permissions {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func roleIDs(roles []Role) []int64 {
+	ids := make([]int64, 0, len(roles))
+	for _, r := range roles {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func bundleIDs(bundles []Bundle) []int64 {
+	ids := make([]int64, 0, len(bundles))
+	for _, b := range bundles {
+		ids = append(ids, b.ID)
+	}
+	return ids
+}
+
+// The loaders below return copies of the stored rows with the associations
+// that the gorm models preload.
+
+func (t *memoryTables) permissionsByID(ids []int64) []Permission {
+	var result []Permission
+	for _, id := range sortedIDs(append([]int64(nil), ids...)) {
+		if p, ok := t.permissions[id]; ok {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func (t *memoryTables) bundleWithPermissions(id int64) Bundle {
+	b := t.bundles[id]
+	b.Permissions = t.permissionsByID(joined(t.bundlesPermissions, id))
+	return b
+}
+
+func (t *memoryTables) bundlesWithPermissions(ids []int64) []Bundle {
+	var result []Bundle
+	for _, id := range sortedIDs(append([]int64(nil), ids...)) {
+		if _, ok := t.bundles[id]; ok {
+			result = append(result, t.bundleWithPermissions(id))
+		}
+	}
+	return result
+}
+
+func (t *memoryTables) rolesByID(ids []int64) []Role {
+	var result []Role
+	for _, id := range sortedIDs(append([]int64(nil), ids...)) {
+		if r, ok := t.roles[id]; ok {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// rolePermissionIDs returns the ids of the direct permissions of the role.
+func (t *memoryTables) rolePermissionIDs(roleID int64) []int64 {
+	var ids []int64
+	for _, row := range t.rolesPermissions {
+		if row.RoleID == roleID {
+			ids = append(ids, row.PermissionID)
+		}
+	}
+	return ids
+}
+
+// roleWithAccess returns the role with its permissions, conditions attached,
+// its bundles with their permissions and its parents, like the Preload calls
+// of RoleModel.GetByName followed by attachConditions.
+func (t *memoryTables) roleWithAccess(id int64) Role {
+	r := t.roles[id]
+	r.Permissions = t.permissionsByID(t.rolePermissionIDs(id))
+	r.Bundles = t.bundlesWithPermissions(joined(t.rolesBundles, id))
+	r.Parents = t.rolesByID(joined(t.rolesParents, id))
+
+	for i := range r.Permissions {
+		for _, row := range t.rolesPermissions {
+			if row.RoleID == id && row.PermissionID == r.Permissions[i].ID && !row.Conditions.IsZero() {
+				c := row.Conditions
+				r.Permissions[i].Conditions = &c
+			}
+		}
+	}
+	return r
+}
+
+// resolvedRole is roleWithAccess with the inherited permissions loaded.
+func (t *memoryTables) resolvedRole(id int64) Role {
+	r := t.roleWithAccess(id)
+	r.InheritedPermissions = make([]Permission, 0)
+	for _, ancestor := range t.ancestors(r.Parents) {
+		for _, p := range ancestor.AllPermissions() {
+			if containsUnconditionalPermission(r.Permissions, p.ID) || containsUnconditionalPermission(r.InheritedPermissions, p.ID) {
+				continue
+			}
+			r.InheritedPermissions = append(r.InheritedPermissions, p)
+		}
+	}
+	return r
+}
+
+// ancestors works like RoleModel.ancestors.
+func (t *memoryTables) ancestors(parents []Role) []Role {
+	var result []Role
+	seen := make(map[int64]bool)
+
+	frontier := roleIDs(parents)
+	for len(frontier) > 0 {
+		var next []int64
+		for _, id := range frontier {
+			if _, ok := t.roles[id]; !ok || seen[id] {
+				continue
+			}
+			seen[id] = true
+			role := t.roleWithAccess(id)
+			result = append(result, role)
+
+			for _, parent := range role.Parents {
+				if !seen[parent.ID] {
+					next = append(next, parent.ID)
+				}
+			}
+		}
+		frontier = next
+	}
+	return result
+}
+
+// checkCycle works like RoleModel.checkCycle.
+func (t *memoryTables) checkCycle(r *Role) error {
+	if r.ID == 0 {
+		return nil
+	}
+	for _, ancestor := range t.ancestors(r.Parents) {
+		if ancestor.ID == r.ID {
+			return ErrRoleCycle
+		}
+	}
+	return nil
+}
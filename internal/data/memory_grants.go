@@ -0,0 +1,252 @@
+package data
+
+import (
+	"fmt"
+	"time"
+)
+
+type memoryScopedPermissionModel struct {
+	s *memoryStore
+}
+
+func (m memoryScopedPermissionModel) Insert(s *ScopedUserPermission) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	for _, other := range t.scoped {
+		if other.UserID == s.UserID && other.PermissionID == s.PermissionID &&
+			other.ResourceType == s.ResourceType && other.ResourceID == s.ResourceID {
+			return ErrDuplicateRecord
+		}
+	}
+
+	s.CoreModel = t.newCore("scoped_users_permissions")
+	stored := *s
+	stored.Permission = Permission{}
+	t.scoped[s.ID] = stored
+	return nil
+}
+
+func (m memoryScopedPermissionModel) Delete(userID, permissionID int64, resourceType string, resourceID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	for id, s := range t.scoped {
+		if s.UserID == userID && s.PermissionID == permissionID &&
+			s.ResourceType == resourceType && s.ResourceID == resourceID {
+			delete(t.scoped, id)
+		}
+	}
+	return nil
+}
+
+func (m memoryScopedPermissionModel) GetAllForUser(userID int64) ([]ScopedUserPermission, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	return m.s.t.scopedForUser(userID), nil
+}
+
+// scopedForUser returns the scoped permissions of the user, ordered by id,
+// with their permissions.
+func (t *memoryTables) scopedForUser(userID int64) []ScopedUserPermission {
+	var ids []int64
+	for id, s := range t.scoped {
+		if s.UserID == userID {
+			ids = append(ids, id)
+		}
+	}
+
+	scoped := make([]ScopedUserPermission, 0, len(ids))
+	for _, id := range sortedIDs(ids) {
+		s := t.scoped[id]
+		s.Permission = t.permissions[s.PermissionID]
+		scoped = append(scoped, s)
+	}
+	return scoped
+}
+
+type memoryGrantRequestModel struct {
+	s *memoryStore
+}
+
+func (m memoryGrantRequestModel) Insert(g *GrantRequest) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	g.CoreModel = t.newCore("grant_requests")
+	t.grantRequests[g.ID] = *g
+	return nil
+}
+
+func (m memoryGrantRequestModel) GetAll(status string, p *Paginate) ([]*GrantRequest, Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	var ids []int64
+	for id, g := range t.grantRequests {
+		if status == "" || g.Status == status {
+			ids = append(ids, id)
+		}
+	}
+	newestFirst(sortedIDs(ids))
+
+	requests := make([]*GrantRequest, 0)
+	for _, id := range paginate(ids, p) {
+		request := t.grantRequests[id]
+		requests = append(requests, &request)
+	}
+	return requests, CalculateMetadata(p, len(ids)), nil
+}
+
+func (m memoryGrantRequestModel) GetByID(id int64) (*GrantRequest, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	request, ok := m.s.t.grantRequests[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return &request, nil
+}
+
+func (m memoryGrantRequestModel) Decide(g *GrantRequest, status string, decidedByID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	return m.s.t.decideGrantRequest(g, status, decidedByID)
+}
+
+func (m memoryGrantRequestModel) Approve(g *GrantRequest, decidedByID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	// every check comes before the decision, there is no rollback here.
+	var membership []Membership
+	switch g.Kind {
+	case GrantKindRole, GrantKindPermission:
+	case GrantKindMembershipRole:
+		membership = t.membershipsWhere(func(ms Membership) bool {
+			return ms.OrganizationID == *g.OrganizationID && ms.UserID == g.UserID
+		})
+		if len(membership) == 0 {
+			if _, err := t.pendingGrantRequest(g.ID); err != nil {
+				return err
+			}
+			return ErrNotMember
+		}
+	default:
+		return fmt.Errorf("unknown grant request kind %q", g.Kind)
+	}
+
+	if err := t.decideGrantRequest(g, GrantRequestApproved, decidedByID); err != nil {
+		return err
+	}
+	switch g.Kind {
+	case GrantKindRole:
+		t.grantRoles(g.UserID, []int64{g.TargetID}, g.GrantWindow)
+	case GrantKindPermission:
+		t.grantPermissions(g.UserID, []int64{g.TargetID}, g.GrantWindow)
+	case GrantKindMembershipRole:
+		id := membership[0].ID
+		t.membershipsRoles = replaceJoins(t.membershipsRoles, id, append(joined(t.membershipsRoles, id), g.TargetID))
+	}
+	return nil
+}
+
+// pendingGrantRequest returns the stored request if it can still be decided.
+func (t *memoryTables) pendingGrantRequest(id int64) (GrantRequest, error) {
+	stored, ok := t.grantRequests[id]
+	if !ok || stored.Status != GrantRequestPending || !time.Now().Before(stored.PendingUntil) {
+		return GrantRequest{}, ErrRecordNotFound
+	}
+	return stored, nil
+}
+
+func (t *memoryTables) decideGrantRequest(g *GrantRequest, status string, decidedByID int64) error {
+	stored, err := t.pendingGrantRequest(g.ID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	stored.Status = status
+	stored.DecidedByID = &decidedByID
+	stored.DecidedAt = &now
+	stored.UpdatedAt = now
+	t.grantRequests[g.ID] = stored
+
+	g.Status = status
+	g.DecidedByID = &decidedByID
+	g.DecidedAt = &now
+	return nil
+}
+
+func (m memoryGrantRequestModel) ExpirePending() (int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	now := time.Now()
+	var total int64
+	for id, g := range t.grantRequests {
+		if g.Status == GrantRequestPending && !g.PendingUntil.After(now) {
+			g.Status = GrantRequestExpired
+			g.UpdatedAt = now
+			t.grantRequests[id] = g
+			total++
+		}
+	}
+	return total, nil
+}
+
+type memoryElevationModel struct {
+	s *memoryStore
+}
+
+func (m memoryElevationModel) Insert(e *Elevation) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	e.CoreModel = t.newCore("elevations")
+	stored := *e
+	stored.Role = nil
+	t.elevations[e.ID] = stored
+	return nil
+}
+
+func (m memoryElevationModel) GetAll(p *Paginate) ([]*Elevation, Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	var ids []int64
+	for id := range t.elevations {
+		ids = append(ids, id)
+	}
+	newestFirst(sortedIDs(ids))
+
+	elevations := make([]*Elevation, 0)
+	for _, id := range paginate(ids, p) {
+		elevation := t.elevations[id]
+		if elevation.RoleID != nil {
+			role := t.roles[*elevation.RoleID]
+			elevation.Role = &role
+		}
+		elevations = append(elevations, &elevation)
+	}
+	return elevations, CalculateMetadata(p, len(ids)), nil
+}
+
+// newestFirst reverses ids sorted by sortedIDs.
+func newestFirst(ids []int64) {
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+}
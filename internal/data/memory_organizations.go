@@ -0,0 +1,204 @@
+package data
+
+import "time"
+
+type memoryOrganizationModel struct {
+	s *memoryStore
+}
+
+func (m memoryOrganizationModel) Insert(o *Organization) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	if t.organizationNameTaken(o.Name, 0) {
+		return ErrDuplicateRecord
+	}
+
+	o.CoreModel = t.newCore("organizations")
+	t.organizations[o.ID] = Organization{CoreModel: o.CoreModel, Name: o.Name}
+	return nil
+}
+
+func (m memoryOrganizationModel) GetAll(p *Paginate) ([]*Organization, Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	var ids []int64
+	for id := range t.organizations {
+		ids = append(ids, id)
+	}
+
+	organizations := make([]*Organization, 0)
+	for _, id := range paginate(sortedIDs(ids), p) {
+		organization := t.organizations[id]
+		organizations = append(organizations, &organization)
+	}
+	return organizations, CalculateMetadata(p, len(ids)), nil
+}
+
+func (m memoryOrganizationModel) GetByID(id int64) (*Organization, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	organization, ok := t.organizations[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	for _, ms := range t.membershipsWhere(func(ms Membership) bool { return ms.OrganizationID == id }) {
+		ms.Roles = t.rolesByID(joined(t.membershipsRoles, ms.ID))
+		organization.Members = append(organization.Members, ms)
+	}
+	return &organization, nil
+}
+
+func (m memoryOrganizationModel) Update(o *Organization) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	stored, ok := t.organizations[o.ID]
+	if !ok {
+		return nil
+	}
+	if t.organizationNameTaken(o.Name, o.ID) {
+		return ErrDuplicateRecord
+	}
+
+	stored.Name = o.Name
+	stored.UpdatedAt = time.Now()
+	o.UpdatedAt = stored.UpdatedAt
+	t.organizations[o.ID] = stored
+	return nil
+}
+
+func (m memoryOrganizationModel) Delete(o *Organization) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	delete(t.organizations, o.ID)
+	for id, ms := range t.memberships {
+		if ms.OrganizationID == o.ID {
+			t.deleteMembership(id)
+		}
+	}
+	for id, g := range t.grantRequests {
+		if g.OrganizationID != nil && *g.OrganizationID == o.ID {
+			delete(t.grantRequests, id)
+		}
+	}
+	return nil
+}
+
+func (m memoryOrganizationModel) GetMembership(organizationID, userID int64) (*Membership, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	memberships := t.membershipsWhere(func(ms Membership) bool {
+		return ms.OrganizationID == organizationID && ms.UserID == userID
+	})
+	if len(memberships) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	membership := memberships[0]
+	for _, id := range sortedIDs(joined(t.membershipsRoles, membership.ID)) {
+		if _, ok := t.roles[id]; ok {
+			membership.Roles = append(membership.Roles, t.resolvedRole(id))
+		}
+	}
+	return &membership, nil
+}
+
+func (m memoryOrganizationModel) GetMembershipsForUser(userID int64) ([]Membership, []Organization, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	memberships := make([]Membership, 0)
+	var ids []int64
+	for _, ms := range t.membershipsWhere(func(ms Membership) bool { return ms.UserID == userID }) {
+		ms.Roles = t.rolesByID(joined(t.membershipsRoles, ms.ID))
+		memberships = append(memberships, ms)
+		ids = append(ids, ms.OrganizationID)
+	}
+
+	organizations := make([]Organization, 0)
+	for _, id := range sortedIDs(ids) {
+		if organization, ok := t.organizations[id]; ok {
+			organizations = append(organizations, organization)
+		}
+	}
+	return memberships, organizations, nil
+}
+
+func (m memoryOrganizationModel) SetMembership(organizationID, userID int64, roles []Role) (*Membership, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	var membership Membership
+	memberships := t.membershipsWhere(func(ms Membership) bool {
+		return ms.OrganizationID == organizationID && ms.UserID == userID
+	})
+	if len(memberships) > 0 {
+		membership = memberships[0]
+	} else {
+		membership = Membership{CoreModel: t.newCore("memberships"), OrganizationID: organizationID, UserID: userID}
+		t.memberships[membership.ID] = membership
+	}
+
+	t.membershipsRoles = replaceJoins(t.membershipsRoles, membership.ID, roleIDs(roles))
+	membership.Roles = roles
+	return &membership, nil
+}
+
+func (m memoryOrganizationModel) DeleteMembership(organizationID, userID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	memberships := t.membershipsWhere(func(ms Membership) bool {
+		return ms.OrganizationID == organizationID && ms.UserID == userID
+	})
+	if len(memberships) == 0 {
+		return ErrRecordNotFound
+	}
+	t.deleteMembership(memberships[0].ID)
+	return nil
+}
+
+func (t *memoryTables) organizationNameTaken(name string, exceptID int64) bool {
+	for id, organization := range t.organizations {
+		if id != exceptID && organization.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// membershipsWhere returns the memberships that match, ordered by id,
+// without their roles.
+func (t *memoryTables) membershipsWhere(match func(Membership) bool) []Membership {
+	var ids []int64
+	for id, ms := range t.memberships {
+		if match(ms) {
+			ids = append(ids, id)
+		}
+	}
+
+	memberships := make([]Membership, 0, len(ids))
+	for _, id := range sortedIDs(ids) {
+		memberships = append(memberships, t.memberships[id])
+	}
+	return memberships
+}
+
+func (t *memoryTables) deleteMembership(id int64) {
+	delete(t.memberships, id)
+	t.membershipsRoles = dropJoins(t.membershipsRoles, id, 0)
+}
@@ -0,0 +1,105 @@
+package data
+
+import "sort"
+
+type memoryPolicyModel struct {
+	s *memoryStore
+}
+
+func (m memoryPolicyModel) Export(withBindings bool) (*Policy, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	policy := &Policy{
+		Permissions: make([]PolicyPermission, 0),
+		Roles:       make([]PolicyRole, 0),
+	}
+
+	var permissions []Permission
+	for _, p := range t.permissions {
+		permissions = append(permissions, p)
+	}
+	sort.Slice(permissions, func(i, j int) bool { return permissions[i].Name < permissions[j].Name })
+	for _, p := range permissions {
+		policy.Permissions = append(policy.Permissions, PolicyPermission{Name: p.Name, RequiresApproval: p.RequiresApproval})
+	}
+
+	var bundles []Bundle
+	for id := range t.bundles {
+		bundles = append(bundles, t.bundleWithPermissions(id))
+	}
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].Name < bundles[j].Name })
+	for _, b := range bundles {
+		policy.Bundles = append(policy.Bundles, PolicyBundle{Name: b.Name, Permissions: permissionNames(b.Permissions)})
+	}
+
+	var roles []Role
+	for id, r := range t.roles {
+		if r.OrganizationID != nil {
+			continue
+		}
+		r.Permissions = t.permissionsByID(t.rolePermissionIDs(id))
+		r.Bundles = t.bundlesWithPermissions(joined(t.rolesBundles, id))
+		r.Parents = t.rolesByID(joined(t.rolesParents, id))
+		roles = append(roles, r)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	for _, r := range roles {
+		pr := PolicyRole{
+			Name:             r.Name,
+			Permissions:      permissionNames(r.Permissions),
+			RequiresApproval: r.RequiresApproval,
+		}
+		for _, b := range r.Bundles {
+			pr.Bundles = append(pr.Bundles, b.Name)
+		}
+		pr.Parents = roleNames(r.Parents)
+		sort.Strings(pr.Bundles)
+		policy.Roles = append(policy.Roles, pr)
+	}
+
+	if withBindings {
+		var users []User
+		for id, u := range t.users {
+			u.Roles = t.rolesByID(t.userRoleIDs(id))
+			users = append(users, u)
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+		for _, u := range users {
+			if len(u.Roles) == 0 {
+				continue
+			}
+			policy.Bindings = append(policy.Bindings, PolicyBinding{User: u.Email, Roles: roleNames(u.Roles)})
+		}
+	}
+
+	return policy, nil
+}
+
+// Import works like PolicyModel.Import. The policy is applied to a copy of
+// the tables, which replaces them only if everything succeeds, and other
+// calls wait until the import is done.
+func (m memoryPolicyModel) Import(p *Policy, opts PolicyImport) ([]PolicyChange, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	tx := &memoryStore{t: m.s.t.clone()}
+	models := memoryModels(tx)
+
+	current, err := models.Policy.Export(len(p.Bindings) > 0)
+	if err != nil {
+		return nil, err
+	}
+	changes := DiffPolicy(current, p, opts.Prune)
+
+	withoutApproval, err := applyPolicy(models, current, p, opts)
+	if err != nil {
+		return nil, err
+	}
+	annotateWithoutApproval(changes, withoutApproval)
+	if !opts.DryRun {
+		m.s.t = tx.t
+	}
+	return changes, nil
+}
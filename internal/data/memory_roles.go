@@ -0,0 +1,639 @@
+package data
+
+import (
+	"sort"
+	"time"
+)
+
+type memoryRoleModel struct {
+	s *memoryStore
+}
+
+func (m memoryRoleModel) GetAll(p *Paginate) ([]*Role, Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	var ids []int64
+	for id := range t.roles {
+		ids = append(ids, id)
+	}
+
+	roles := make([]*Role, 0)
+	for _, id := range paginate(sortedIDs(ids), p) {
+		role := t.roles[id]
+		roles = append(roles, &role)
+	}
+	return roles, CalculateMetadata(p, len(ids)), nil
+}
+
+func (m memoryRoleModel) GetByID(id int64) (*Role, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	if _, ok := t.roles[id]; !ok {
+		return nil, ErrRecordNotFound
+	}
+	role := t.resolvedRole(id)
+	role.ManagedRoles = t.rolesByID(joined(t.rolesManagedRoles, id))
+	role.ManagedPermissions = t.permissionsByID(joined(t.rolesManagedPermissions, id))
+	return &role, nil
+}
+
+func (m memoryRoleModel) GetByName(name string) (*Role, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	for id, role := range t.roles {
+		if role.Name == name && role.OrganizationID == nil {
+			role = t.resolvedRole(id)
+			return &role, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryRoleModel) Insert(r *Role) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	if err := t.checkCycle(r); err != nil {
+		return err
+	}
+	if t.roleNameTaken(r.OrganizationID, r.Name, 0) {
+		return ErrDuplicateRecord
+	}
+
+	r.CoreModel = t.newCore("roles")
+	t.roles[r.ID] = storedRole(r)
+	t.replaceRolePermissions(r.ID, permissionIDs(r.Permissions))
+	t.rolesParents = replaceJoins(t.rolesParents, r.ID, roleIDs(r.Parents))
+	t.rolesBundles = replaceJoins(t.rolesBundles, r.ID, bundleIDs(r.Bundles))
+	t.rolesManagedRoles = replaceJoins(t.rolesManagedRoles, r.ID, roleIDs(r.ManagedRoles))
+	t.rolesManagedPermissions = replaceJoins(t.rolesManagedPermissions, r.ID, permissionIDs(r.ManagedPermissions))
+	return nil
+}
+
+func (m memoryRoleModel) Update(r *Role) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	if err := t.checkCycle(r); err != nil {
+		return err
+	}
+	if t.roleNameTaken(r.OrganizationID, r.Name, r.ID) {
+		return ErrDuplicateRecord
+	}
+
+	t.replaceRolePermissions(r.ID, permissionIDs(r.Permissions))
+	t.rolesParents = replaceJoins(t.rolesParents, r.ID, roleIDs(r.Parents))
+	t.rolesBundles = replaceJoins(t.rolesBundles, r.ID, bundleIDs(r.Bundles))
+
+	r.UpdatedAt = time.Now()
+	t.roles[r.ID] = storedRole(r)
+	return nil
+}
+
+func (m memoryRoleModel) Delete(r *Role) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	delete(t.roles, r.ID)
+	t.replaceRolePermissions(r.ID, nil)
+	t.rolesParents = dropJoins(t.rolesParents, r.ID, r.ID)
+	t.rolesBundles = dropJoins(t.rolesBundles, r.ID, 0)
+	t.rolesManagedRoles = dropJoins(t.rolesManagedRoles, r.ID, r.ID)
+	t.rolesManagedPermissions = dropJoins(t.rolesManagedPermissions, r.ID, 0)
+	t.membershipsRoles = dropJoins(t.membershipsRoles, 0, r.ID)
+
+	rows := t.usersRoles[:0:0]
+	for _, row := range t.usersRoles {
+		if row.RoleID != r.ID {
+			rows = append(rows, row)
+		}
+	}
+	t.usersRoles = rows
+
+	for id, c := range t.conflicts {
+		if c.RoleID == r.ID || c.ConflictingRoleID == r.ID {
+			delete(t.conflicts, id)
+		}
+	}
+	for id, e := range t.elevations {
+		if e.RoleID != nil && *e.RoleID == r.ID {
+			e.RoleID = nil
+			t.elevations[id] = e
+		}
+	}
+	return nil
+}
+
+func (m memoryRoleModel) SetManaged(r *Role, roles []Role, permissions []Permission) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	t.rolesManagedRoles = replaceJoins(t.rolesManagedRoles, r.ID, roleIDs(roles))
+	t.rolesManagedPermissions = replaceJoins(t.rolesManagedPermissions, r.ID, permissionIDs(permissions))
+	r.ManagedRoles = roles
+	r.ManagedPermissions = permissions
+	return nil
+}
+
+func (m memoryRoleModel) ManagedBy(roleIDs []int64) (managedRoleIDs []int64, managedPermissionIDs []int64, err error) {
+	if len(roleIDs) == 0 {
+		return nil, nil, nil
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	roleIDs = t.hierarchy().withAncestors(roleIDs).ids()
+	distinct := func(rows []memoryJoin) []int64 {
+		seen := make(map[int64]bool)
+		var ids []int64
+		for _, roleID := range roleIDs {
+			for _, id := range joined(rows, roleID) {
+				if !seen[id] {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+		return sortedIDs(ids)
+	}
+	return distinct(t.rolesManagedRoles), distinct(t.rolesManagedPermissions), nil
+}
+
+func (m memoryRoleModel) SetPermissionConditions(roleID, permissionID int64, c Conditions) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	for i, row := range t.rolesPermissions {
+		if row.RoleID == roleID && row.PermissionID == permissionID {
+			t.rolesPermissions[i].Conditions = c
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+// storedRole returns the columns of r, without the associations.
+func storedRole(r *Role) Role {
+	return Role{
+		CoreModel:        r.CoreModel,
+		Name:             r.Name,
+		OrganizationID:   r.OrganizationID,
+		RequiresApproval: r.RequiresApproval,
+	}
+}
+
+// roleNameTaken reports whether another role of the organization, or another
+// global role if organizationID is nil, has the name.
+func (t *memoryTables) roleNameTaken(organizationID *int64, name string, exceptID int64) bool {
+	for id, role := range t.roles {
+		if id != exceptID && role.Name == name && sameOrganization(role.OrganizationID, organizationID) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameOrganization(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// replaceRolePermissions works like replaceJoins, kept rows keep their
+// conditions.
+func (t *memoryTables) replaceRolePermissions(roleID int64, ids []int64) {
+	keep := idSet(ids)
+	present := make(map[int64]bool)
+	rows := t.rolesPermissions[:0:0]
+	for _, row := range t.rolesPermissions {
+		if row.RoleID == roleID {
+			if !keep[row.PermissionID] {
+				continue
+			}
+			present[row.PermissionID] = true
+		}
+		rows = append(rows, row)
+	}
+	for _, id := range ids {
+		if !present[id] {
+			present[id] = true
+			rows = append(rows, RolePermission{RoleID: roleID, PermissionID: id})
+		}
+	}
+	t.rolesPermissions = rows
+}
+
+type memoryPermissionModel struct {
+	s *memoryStore
+}
+
+func (m memoryPermissionModel) GetAll(p *Paginate) ([]*Permission, Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	var ids []int64
+	for id := range t.permissions {
+		ids = append(ids, id)
+	}
+
+	permissions := make([]*Permission, 0)
+	for _, id := range paginate(sortedIDs(ids), p) {
+		permission := t.permissions[id]
+		permissions = append(permissions, &permission)
+	}
+	return permissions, CalculateMetadata(p, len(ids)), nil
+}
+
+func (m memoryPermissionModel) GetAllNames() ([]string, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	names := make([]string, 0)
+	for _, permission := range m.s.t.permissions {
+		names = append(names, permission.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m memoryPermissionModel) GetByID(id int64) (*Permission, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	permission, ok := m.s.t.permissions[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return &permission, nil
+}
+
+func (m memoryPermissionModel) GetByName(name string) (*Permission, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for _, permission := range m.s.t.permissions {
+		if permission.Name == name {
+			return &permission, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryPermissionModel) Insert(p *Permission) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	if t.permissionNameTaken(p.Name, 0) {
+		return ErrDuplicateRecord
+	}
+
+	p.CoreModel = t.newCore("permissions")
+	t.permissions[p.ID] = storedPermission(p)
+	return nil
+}
+
+func (m memoryPermissionModel) Update(p *Permission) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	stored, ok := t.permissions[p.ID]
+	if !ok {
+		return nil
+	}
+	if t.permissionNameTaken(p.Name, p.ID) {
+		return ErrDuplicateRecord
+	}
+
+	stored.Name = p.Name
+	stored.RequiresApproval = p.RequiresApproval
+	stored.UpdatedAt = time.Now()
+	p.UpdatedAt = stored.UpdatedAt
+	t.permissions[p.ID] = stored
+	return nil
+}
+
+func (m memoryPermissionModel) Delete(p *Permission) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	delete(t.permissions, p.ID)
+	t.revokedPermissions = dropJoins(t.revokedPermissions, 0, p.ID)
+	t.bundlesPermissions = dropJoins(t.bundlesPermissions, 0, p.ID)
+	t.rolesManagedPermissions = dropJoins(t.rolesManagedPermissions, 0, p.ID)
+
+	roleRows := t.rolesPermissions[:0:0]
+	for _, row := range t.rolesPermissions {
+		if row.PermissionID != p.ID {
+			roleRows = append(roleRows, row)
+		}
+	}
+	t.rolesPermissions = roleRows
+
+	grantedRows := t.grantedPermissions[:0:0]
+	for _, row := range t.grantedPermissions {
+		if row.PermissionID != p.ID {
+			grantedRows = append(grantedRows, row)
+		}
+	}
+	t.grantedPermissions = grantedRows
+
+	for id, s := range t.scoped {
+		if s.PermissionID == p.ID {
+			delete(t.scoped, id)
+		}
+	}
+	return nil
+}
+
+// storedPermission returns the columns of p, without the associations.
+func storedPermission(p *Permission) Permission {
+	return Permission{
+		CoreModel:        p.CoreModel,
+		Name:             p.Name,
+		RequiresApproval: p.RequiresApproval,
+	}
+}
+
+func (t *memoryTables) permissionNameTaken(name string, exceptID int64) bool {
+	for id, permission := range t.permissions {
+		if id != exceptID && permission.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryBundleModel struct {
+	s *memoryStore
+}
+
+func (m memoryBundleModel) GetAll(p *Paginate) ([]*Bundle, Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	var ids []int64
+	for id := range t.bundles {
+		ids = append(ids, id)
+	}
+
+	bundles := make([]*Bundle, 0)
+	for _, id := range paginate(sortedIDs(ids), p) {
+		bundle := t.bundleWithPermissions(id)
+		bundles = append(bundles, &bundle)
+	}
+	return bundles, CalculateMetadata(p, len(ids)), nil
+}
+
+func (m memoryBundleModel) GetByID(id int64) (*Bundle, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	if _, ok := t.bundles[id]; !ok {
+		return nil, ErrRecordNotFound
+	}
+	bundle := t.bundleWithPermissions(id)
+	return &bundle, nil
+}
+
+func (m memoryBundleModel) GetByName(name string) (*Bundle, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	for id, bundle := range t.bundles {
+		if bundle.Name == name {
+			bundle = t.bundleWithPermissions(id)
+			return &bundle, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryBundleModel) GetAllAttachedToUsers() ([]*Bundle, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	var ids []int64
+	attached := make(map[int64]bool)
+	for _, row := range t.usersBundles {
+		if !attached[row.right] {
+			attached[row.right] = true
+			ids = append(ids, row.right)
+		}
+	}
+
+	bundles := make([]*Bundle, 0)
+	for _, b := range t.bundlesWithPermissions(ids) {
+		b := b
+		bundles = append(bundles, &b)
+	}
+	return bundles, nil
+}
+
+func (m memoryBundleModel) Insert(b *Bundle) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	if t.bundleNameTaken(b.Name, 0) {
+		return ErrDuplicateRecord
+	}
+
+	b.CoreModel = t.newCore("bundles")
+	t.bundles[b.ID] = Bundle{CoreModel: b.CoreModel, Name: b.Name}
+	t.bundlesPermissions = replaceJoins(t.bundlesPermissions, b.ID, permissionIDs(b.Permissions))
+	return nil
+}
+
+func (m memoryBundleModel) Update(b *Bundle) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	stored, ok := t.bundles[b.ID]
+	if !ok {
+		return nil
+	}
+	if t.bundleNameTaken(b.Name, b.ID) {
+		return ErrDuplicateRecord
+	}
+
+	t.bundlesPermissions = replaceJoins(t.bundlesPermissions, b.ID, permissionIDs(b.Permissions))
+	stored.Name = b.Name
+	stored.UpdatedAt = time.Now()
+	b.UpdatedAt = stored.UpdatedAt
+	t.bundles[b.ID] = stored
+	return nil
+}
+
+func (m memoryBundleModel) Delete(b *Bundle) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	delete(t.bundles, b.ID)
+	t.bundlesPermissions = dropJoins(t.bundlesPermissions, b.ID, 0)
+	t.rolesBundles = dropJoins(t.rolesBundles, 0, b.ID)
+	t.usersBundles = dropJoins(t.usersBundles, 0, b.ID)
+	return nil
+}
+
+func (t *memoryTables) bundleNameTaken(name string, exceptID int64) bool {
+	for id, bundle := range t.bundles {
+		if id != exceptID && bundle.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryRoleConflictModel struct {
+	s *memoryStore
+}
+
+func (m memoryRoleConflictModel) Insert(c *RoleConflict) error {
+	if c.RoleID > c.ConflictingRoleID {
+		c.RoleID, c.ConflictingRoleID = c.ConflictingRoleID, c.RoleID
+		c.Role, c.ConflictingRole = c.ConflictingRole, c.Role
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	for _, other := range t.conflicts {
+		if other.RoleID == c.RoleID && other.ConflictingRoleID == c.ConflictingRoleID {
+			return ErrDuplicateRecord
+		}
+	}
+
+	c.CoreModel = t.newCore("role_conflicts")
+	t.conflicts[c.ID] = RoleConflict{CoreModel: c.CoreModel, RoleID: c.RoleID, ConflictingRoleID: c.ConflictingRoleID}
+	return nil
+}
+
+func (m memoryRoleConflictModel) GetAll() ([]RoleConflict, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	return m.s.t.conflictsWhere(func(RoleConflict) bool { return true }), nil
+}
+
+func (m memoryRoleConflictModel) GetByID(id int64) (*RoleConflict, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	conflicts := m.s.t.conflictsWhere(func(c RoleConflict) bool { return c.ID == id })
+	if len(conflicts) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return &conflicts[0], nil
+}
+
+func (m memoryRoleConflictModel) Delete(c *RoleConflict) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	delete(m.s.t.conflicts, c.ID)
+	return nil
+}
+
+func (m memoryRoleConflictModel) FindConflicts(roleIDs []int64) ([]RoleConflict, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	held := t.hierarchy().withAncestors(roleIDs)
+	return t.conflictsWhere(held.holdsBoth), nil
+}
+
+func (m memoryRoleConflictModel) Violations() ([]Violation, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+	h := t.hierarchy()
+
+	heldByUser := make(map[int64][]int64)
+	for _, row := range t.usersRoles {
+		heldByUser[row.UserID] = append(heldByUser[row.UserID], row.RoleID)
+	}
+	var users []int64
+	for id := range heldByUser {
+		users = append(users, id)
+	}
+	users = sortedIDs(users)
+
+	members := t.membershipsWhere(func(Membership) bool { return true })
+	sort.SliceStable(members, func(i, j int) bool {
+		if members[i].UserID != members[j].UserID {
+			return members[i].UserID < members[j].UserID
+		}
+		return members[i].OrganizationID < members[j].OrganizationID
+	})
+
+	violations := make([]Violation, 0)
+	for _, c := range t.conflictsWhere(func(RoleConflict) bool { return true }) {
+		for _, id := range users {
+			if h.withAncestors(heldByUser[id]).holdsBoth(c) {
+				violations = append(violations, Violation{UserID: id, Conflict: c})
+			}
+		}
+		for _, ms := range members {
+			if h.membershipViolates(heldByUser[ms.UserID], joined(t.membershipsRoles, ms.ID), c) {
+				organizationID := ms.OrganizationID
+				violations = append(violations, Violation{UserID: ms.UserID, OrganizationID: &organizationID, Conflict: c})
+			}
+		}
+	}
+	return violations, nil
+}
+
+// hierarchy works like loadRoleHierarchy.
+func (t *memoryTables) hierarchy() roleHierarchy {
+	h := make(roleHierarchy)
+	for _, row := range t.rolesParents {
+		h[row.left] = append(h[row.left], row.right)
+	}
+	return h
+}
+
+// conflictsWhere returns the conflicts that match, ordered by id, with their
+// roles.
+func (t *memoryTables) conflictsWhere(match func(RoleConflict) bool) []RoleConflict {
+	var ids []int64
+	for id, c := range t.conflicts {
+		if match(c) {
+			ids = append(ids, id)
+		}
+	}
+
+	conflicts := make([]RoleConflict, 0, len(ids))
+	for _, id := range sortedIDs(ids) {
+		c := t.conflicts[id]
+		c.Role = t.roles[c.RoleID]
+		c.ConflictingRole = t.roles[c.ConflictingRoleID]
+		conflicts = append(conflicts, c)
+	}
+	return conflicts
+}
@@ -0,0 +1,633 @@
+package data
+
+import (
+	"bytes"
+	"time"
+)
+
+type memoryUserModel struct {
+	s *memoryStore
+}
+
+func (m memoryUserModel) InvalidateCache(userID int64) {}
+
+func (m memoryUserModel) PurgeCache() {}
+
+func (m memoryUserModel) Insert(u *User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	return t.insertUser(u)
+}
+
+func (t *memoryTables) insertUser(u *User) error {
+	if t.emailTaken(u.Email, 0) {
+		return ErrDuplicateRecord
+	}
+
+	u.CoreModel = t.newCore("users")
+	t.users[u.ID] = storedUser(u)
+	t.replaceUserRoles(u.ID, roleIDs(u.Roles))
+	t.replaceGrantedPermissions(u.ID, permissionIDs(u.GrantedPermissions))
+	t.revokedPermissions = replaceJoins(t.revokedPermissions, u.ID, permissionIDs(u.RevokedPermissions))
+	t.usersBundles = replaceJoins(t.usersBundles, u.ID, bundleIDs(u.Bundles))
+	return nil
+}
+
+func (m memoryUserModel) InsertWithToken(u *User, ttl time.Duration, scope string) (*Token, error) {
+	// the token is made first, nothing is stored if it fails.
+	token, err := generateTokenWithMetadata(0, ttl, scope, TokenMetadata{})
+	if err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	if err := t.insertUser(u); err != nil {
+		return nil, err
+	}
+	token.UserID = u.ID
+	t.insertToken(token)
+	return token, nil
+}
+
+// Update writes the non-zero fields of u, like gorm's Updates does.
+func (m memoryUserModel) Update(u *User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	stored, ok := t.users[u.ID]
+	if !ok {
+		return nil
+	}
+	if u.Email != "" && t.emailTaken(u.Email, u.ID) {
+		return ErrDuplicateRecord
+	}
+
+	if u.FirstName != "" {
+		stored.FirstName = u.FirstName
+	}
+	if u.LastName != "" {
+		stored.LastName = u.LastName
+	}
+	if u.Email != "" {
+		stored.Email = u.Email
+	}
+	if len(u.Password) > 0 {
+		stored.Password = u.Password
+	}
+	if u.IsActivated {
+		stored.IsActivated = true
+	}
+	if u.IsAdmin {
+		stored.IsAdmin = true
+	}
+	stored.UpdatedAt = time.Now()
+	u.UpdatedAt = stored.UpdatedAt
+	t.users[u.ID] = stored
+	return nil
+}
+
+func (m memoryUserModel) UpdateGrantedPermissions(u *User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	m.s.t.replaceGrantedPermissions(u.ID, permissionIDs(u.GrantedPermissions))
+	return nil
+}
+
+func (m memoryUserModel) UpdateRevokedPermissions(u *User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	t.revokedPermissions = replaceJoins(t.revokedPermissions, u.ID, permissionIDs(u.RevokedPermissions))
+	return nil
+}
+
+func (m memoryUserModel) UpdateBundles(u *User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	t.usersBundles = replaceJoins(t.usersBundles, u.ID, bundleIDs(u.Bundles))
+	return nil
+}
+
+func (m memoryUserModel) UpdateRoles(u *User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	m.s.t.replaceUserRoles(u.ID, roleIDs(u.Roles))
+	return nil
+}
+
+func (m memoryUserModel) Delete(u *User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	delete(t.users, u.ID)
+	for id, token := range t.tokens {
+		if token.UserID == u.ID {
+			delete(t.tokens, id)
+		}
+	}
+	for id, s := range t.scoped {
+		if s.UserID == u.ID {
+			delete(t.scoped, id)
+		}
+	}
+	for id, e := range t.elevations {
+		if e.UserID != nil && *e.UserID == u.ID {
+			e.UserID = nil
+			t.elevations[id] = e
+		}
+	}
+	for id, ms := range t.memberships {
+		if ms.UserID == u.ID {
+			t.deleteMembership(id)
+		}
+	}
+	t.replaceUserRoles(u.ID, nil)
+	t.replaceGrantedPermissions(u.ID, nil)
+	t.revokedPermissions = dropJoins(t.revokedPermissions, u.ID, 0)
+	t.usersBundles = dropJoins(t.usersBundles, u.ID, 0)
+	return nil
+}
+
+func (m memoryUserModel) GetByID(id int64) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	user, ok := m.s.t.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return &user, nil
+}
+
+func (m memoryUserModel) GetByIDWithRolesAndPermissions(id int64) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	user, ok := t.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	user.Roles = t.rolesByID(t.userRoleIDs(id))
+	user.GrantedPermissions = t.permissionsByID(t.grantedPermissionIDs(id))
+	user.RevokedPermissions = t.permissionsByID(joined(t.revokedPermissions, id))
+	user.ScopedPermissions = t.scopedForUser(id)
+	user.Bundles = t.bundlesWithPermissions(joined(t.usersBundles, id))
+	t.loadGrants(&user)
+	return &user, nil
+}
+
+func (m memoryUserModel) GetByIDWithAccess(id int64) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	return m.s.t.userWithAccess(id)
+}
+
+func (m memoryUserModel) GetByEmail(email string) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for _, user := range m.s.t.users {
+		if user.Email == email {
+			return &user, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryUserModel) GetForToken(scope string, tokenPlaintext string) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	hash := HashToken(tokenPlaintext)
+	now := time.Now()
+	for _, token := range t.tokens {
+		if bytes.Equal(token.Hash, hash) && token.Scope == scope && token.Expiry.After(now) {
+			return t.userWithAccess(token.UserID)
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryUserModel) GetAll(p *Paginate) ([]*User, Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	var ids []int64
+	for id := range t.users {
+		ids = append(ids, id)
+	}
+
+	users := make([]*User, 0)
+	for _, id := range paginate(sortedIDs(ids), p) {
+		user := t.users[id]
+		users = append(users, &user)
+	}
+	return users, CalculateMetadata(p, len(ids)), nil
+}
+
+func (m memoryUserModel) GrantRoles(userID int64, roleIDs []int64, w GrantWindow) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	m.s.t.grantRoles(userID, roleIDs, w)
+	return nil
+}
+
+func (m memoryUserModel) GrantPermissions(userID int64, permissionIDs []int64, w GrantWindow) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	m.s.t.grantPermissions(userID, permissionIDs, w)
+	return nil
+}
+
+func (m memoryUserModel) DeleteExpiredGrants() (int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	now := time.Now()
+	expired := func(w GrantWindow) bool {
+		return w.ExpiresAt != nil && !w.ExpiresAt.After(now)
+	}
+
+	var total int64
+	roles := t.usersRoles[:0:0]
+	for _, row := range t.usersRoles {
+		if expired(row.GrantWindow) {
+			total++
+			continue
+		}
+		roles = append(roles, row)
+	}
+	t.usersRoles = roles
+
+	permissions := t.grantedPermissions[:0:0]
+	for _, row := range t.grantedPermissions {
+		if expired(row.GrantWindow) {
+			total++
+			continue
+		}
+		permissions = append(permissions, row)
+	}
+	t.grantedPermissions = permissions
+	return total, nil
+}
+
+type memoryTokenModel struct {
+	s *memoryStore
+}
+
+func (m memoryTokenModel) Insert(token *Token) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	t.insertToken(token)
+	return nil
+}
+
+func (t *memoryTables) insertToken(token *Token) {
+	token.CoreModel = t.newCore("tokens")
+	stored := *token
+	stored.Plaintext = ""
+	t.tokens[token.ID] = stored
+}
+
+func (m memoryTokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	return m.NewWithMetadata(userID, ttl, scope, TokenMetadata{})
+}
+
+func (m memoryTokenModel) NewWithMetadata(userID int64, ttl time.Duration, scope string, md TokenMetadata) (*Token, error) {
+	token, err := generateTokenWithMetadata(userID, ttl, scope, md)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(token)
+	return token, err
+}
+
+func (m memoryTokenModel) GetAllForUser(scope string, userID int64) ([]Token, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	var ids []int64
+	now := time.Now()
+	for id, token := range t.tokens {
+		if token.Scope == scope && token.UserID == userID && token.Expiry.After(now) && token.RotatedAt == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	var tokens []Token
+	for _, id := range sortedIDs(ids) {
+		tokens = append(tokens, t.tokens[id])
+	}
+	return tokens, nil
+}
+
+func (m memoryTokenModel) DeleteAllForUser(scope string, userID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	for id, token := range t.tokens {
+		if token.Scope == scope && token.UserID == userID {
+			delete(t.tokens, id)
+		}
+	}
+	return nil
+}
+
+func (m memoryTokenModel) DeleteForUser(scope string, userID, id int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	token, ok := t.tokens[id]
+	if !ok || token.Scope != scope || token.UserID != userID {
+		return ErrRecordNotFound
+	}
+	t.deleteTokenFamily(token.Family)
+	return nil
+}
+
+func (m memoryTokenModel) DeleteForToken(scope string, tokenPlaintext string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	if token, ok := t.tokenByHash(scope, HashToken(tokenPlaintext)); ok {
+		t.deleteTokenFamily(token.Family)
+	}
+	return nil
+}
+
+func (m memoryTokenModel) Rotate(tokenPlaintext string) (*Token, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	token, ok := t.tokenByHash(ScopeRefresh, HashToken(tokenPlaintext))
+	if !ok || !token.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	if token.RotatedAt != nil {
+		t.deleteTokenFamily(token.Family)
+		return &token, ErrTokenReused
+	}
+
+	now := time.Now()
+	stored := token
+	stored.RotatedAt = &now
+	t.tokens[token.ID] = stored
+	return &token, nil
+}
+
+func (m memoryTokenModel) UpdateLastUsed(lastUsed map[string]time.Time) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := m.s.t
+
+	families := make(map[string]time.Time)
+	for _, token := range t.tokens {
+		if usedAt, ok := lastUsed[string(token.Hash)]; ok {
+			families[token.Family] = usedAt
+		}
+	}
+	for id, token := range t.tokens {
+		if usedAt, ok := families[token.Family]; ok {
+			token.LastUsedAt = &usedAt
+			t.tokens[id] = token
+		}
+	}
+	return nil
+}
+
+func (t *memoryTables) tokenByHash(scope string, hash []byte) (Token, bool) {
+	for _, token := range t.tokens {
+		if token.Scope == scope && bytes.Equal(token.Hash, hash) {
+			return token, true
+		}
+	}
+	return Token{}, false
+}
+
+func (t *memoryTables) deleteTokenFamily(family string) {
+	for id, token := range t.tokens {
+		if token.Family == family {
+			delete(t.tokens, id)
+		}
+	}
+}
+
+// storedUser returns the columns of u, without the associations.
+func storedUser(u *User) User {
+	return User{
+		CoreModel:   u.CoreModel,
+		FirstName:   u.FirstName,
+		LastName:    u.LastName,
+		Email:       u.Email,
+		Password:    u.Password,
+		IsActivated: u.IsActivated,
+		IsAdmin:     u.IsAdmin,
+	}
+}
+
+func (t *memoryTables) emailTaken(email string, exceptID int64) bool {
+	for id, user := range t.users {
+		if id != exceptID && user.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+// userWithAccess works like UserModel.GetByIDWithAccess.
+func (t *memoryTables) userWithAccess(id int64) (*User, error) {
+	now := time.Now()
+
+	user, ok := t.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	for _, roleID := range sortedIDs(t.userRoleIDs(id)) {
+		if _, ok := t.roles[roleID]; ok {
+			user.Roles = append(user.Roles, t.resolvedRole(roleID))
+		}
+	}
+	user.GrantedPermissions = t.permissionsByID(t.grantedPermissionIDs(id))
+	user.RevokedPermissions = t.permissionsByID(joined(t.revokedPermissions, id))
+	user.ScopedPermissions = t.scopedForUser(id)
+	user.Bundles = t.bundlesWithPermissions(joined(t.usersBundles, id))
+
+	var elevationIDs []int64
+	for eid, e := range t.elevations {
+		if e.UserID != nil && *e.UserID == id && e.RoleID != nil && e.ExpiresAt.After(now) {
+			elevationIDs = append(elevationIDs, eid)
+		}
+	}
+	for _, eid := range sortedIDs(elevationIDs) {
+		e := t.elevations[eid]
+		role := t.resolvedRole(*e.RoleID)
+		e.Role = &role
+		user.Elevations = append(user.Elevations, e)
+	}
+
+	t.loadGrants(&user)
+	dropInactiveGrants(&user, now)
+	return &user, nil
+}
+
+func (t *memoryTables) loadGrants(u *User) {
+	for _, row := range t.usersRoles {
+		if row.UserID == u.ID {
+			u.RoleGrants = append(u.RoleGrants, row)
+		}
+	}
+	for _, row := range t.grantedPermissions {
+		if row.UserID == u.ID {
+			u.PermissionGrants = append(u.PermissionGrants, row)
+		}
+	}
+}
+
+func (t *memoryTables) userRoleIDs(userID int64) []int64 {
+	var ids []int64
+	for _, row := range t.usersRoles {
+		if row.UserID == userID {
+			ids = append(ids, row.RoleID)
+		}
+	}
+	return ids
+}
+
+func (t *memoryTables) grantedPermissionIDs(userID int64) []int64 {
+	var ids []int64
+	for _, row := range t.grantedPermissions {
+		if row.UserID == userID {
+			ids = append(ids, row.PermissionID)
+		}
+	}
+	return ids
+}
+
+// replaceUserRoles works like replaceJoins, kept rows keep their windows.
+func (t *memoryTables) replaceUserRoles(userID int64, ids []int64) {
+	keep := idSet(ids)
+	present := make(map[int64]bool)
+	rows := t.usersRoles[:0:0]
+	for _, row := range t.usersRoles {
+		if row.UserID == userID {
+			if !keep[row.RoleID] {
+				continue
+			}
+			present[row.RoleID] = true
+		}
+		rows = append(rows, row)
+	}
+	for _, id := range ids {
+		if !present[id] {
+			present[id] = true
+			rows = append(rows, UserRole{UserID: userID, RoleID: id})
+		}
+	}
+	t.usersRoles = rows
+}
+
+// replaceGrantedPermissions works like replaceJoins, kept rows keep their
+// windows.
+func (t *memoryTables) replaceGrantedPermissions(userID int64, ids []int64) {
+	keep := idSet(ids)
+	present := make(map[int64]bool)
+	rows := t.grantedPermissions[:0:0]
+	for _, row := range t.grantedPermissions {
+		if row.UserID == userID {
+			if !keep[row.PermissionID] {
+				continue
+			}
+			present[row.PermissionID] = true
+		}
+		rows = append(rows, row)
+	}
+	for _, id := range ids {
+		if !present[id] {
+			present[id] = true
+			rows = append(rows, GrantedUserPermission{UserID: userID, PermissionID: id})
+		}
+	}
+	t.grantedPermissions = rows
+}
+
+// grantRoles adds the roles to the user with the window, granted roles get
+// the new window.
+func (t *memoryTables) grantRoles(userID int64, roleIDs []int64, w GrantWindow) {
+	present := make(map[int64]bool)
+	set := idSet(roleIDs)
+	for i, row := range t.usersRoles {
+		if row.UserID == userID && set[row.RoleID] {
+			t.usersRoles[i].GrantWindow = w
+			present[row.RoleID] = true
+		}
+	}
+	for _, id := range roleIDs {
+		if !present[id] {
+			present[id] = true
+			t.usersRoles = append(t.usersRoles, UserRole{UserID: userID, RoleID: id, GrantWindow: w})
+		}
+	}
+}
+
+// grantPermissions works like grantRoles and also takes the permissions out
+// of the revoked ones.
+func (t *memoryTables) grantPermissions(userID int64, permissionIDs []int64, w GrantWindow) {
+	present := make(map[int64]bool)
+	set := idSet(permissionIDs)
+	for i, row := range t.grantedPermissions {
+		if row.UserID == userID && set[row.PermissionID] {
+			t.grantedPermissions[i].GrantWindow = w
+			present[row.PermissionID] = true
+		}
+	}
+	for _, id := range permissionIDs {
+		if !present[id] {
+			present[id] = true
+			t.grantedPermissions = append(t.grantedPermissions, GrantedUserPermission{UserID: userID, PermissionID: id, GrantWindow: w})
+		}
+	}
+
+	revoked := t.revokedPermissions[:0:0]
+	for _, row := range t.revokedPermissions {
+		if row.left == userID && set[row.right] {
+			continue
+		}
+		revoked = append(revoked, row)
+	}
+	t.revokedPermissions = revoked
+}
+
+func idSet(ids []int64) map[int64]bool {
+	set := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/jackc/pgconn"
+	"github.com/mattn/go-sqlite3"
 	"gorm.io/gorm"
 )
 
@@ -20,27 +21,71 @@ type CoreModel struct {
 }
 
 type Models struct {
-	Users       UserModel
-	Tokens      TokenModel
-	Roles       RoleModel
-	Permissions PermissionModel
+	Users         UserRepository
+	Tokens        TokenRepository
+	Roles         RoleRepository
+	Permissions   PermissionRepository
+	Scoped        ScopedPermissionRepository
+	Organizations OrganizationRepository
+	Conflicts     RoleConflictRepository
+	GrantRequests GrantRequestRepository
+	Elevations    ElevationRepository
+	Bundles       BundleRepository
+	Policy        PolicyRepository
 }
 
 func NewModels(db *gorm.DB) Models {
 	return Models{
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Roles:       RoleModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Users:         UserModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		Roles:         RoleModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		Scoped:        ScopedPermissionModel{DB: db},
+		Organizations: OrganizationModel{DB: db},
+		Conflicts:     RoleConflictModel{DB: db},
+		GrantRequests: GrantRequestModel{DB: db},
+		Elevations:    ElevationModel{DB: db},
+		Bundles:       BundleModel{DB: db},
+		Policy:        PolicyModel{DB: db},
 	}
 }
 
+// IsDuplicateRecord reports whether err is a unique constraint violation of
+// PostgreSQL or SQLite.
 func IsDuplicateRecord(err error) bool {
 	if err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) {
 			return pgErr.Code == "23505"
 		}
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) {
+			return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+				sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+		}
 	}
 	return false
 }
+
+// SetupJoinTables registers the custom join tables, it must be called
+// before migrating or using the models.
+func SetupJoinTables(db *gorm.DB) error {
+	joins := []struct {
+		model     interface{}
+		field     string
+		joinTable interface{}
+	}{
+		{&Role{}, "Permissions", &RolePermission{}},
+		{&Permission{}, "Roles", &RolePermission{}},
+		{&User{}, "Roles", &UserRole{}},
+		{&Role{}, "Users", &UserRole{}},
+		{&User{}, "GrantedPermissions", &GrantedUserPermission{}},
+	}
+
+	for _, j := range joins {
+		if err := db.SetupJoinTable(j.model, j.field, j.joinTable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
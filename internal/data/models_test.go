@@ -0,0 +1,399 @@
+package data
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kubil6y/myshop-go/internal/migrations"
+)
+
+// testPostgresDSN names the environment variable with the DSN of a Postgres
+// database for the tests. The database is wiped, it must be a throwaway one.
+const testPostgresDSN = "MYSHOP_TEST_POSTGRES_DSN"
+
+// testBackends returns the models of every backend the cases run against, so
+// the in-memory models are held to the semantics of the gorm ones. Postgres
+// is skipped unless testPostgresDSN is set.
+func testBackends() map[string]func(t *testing.T) Models {
+	return map[string]func(t *testing.T) Models{
+		"memory": func(t *testing.T) Models { return NewMemoryModels() },
+		"sqlite": func(t *testing.T) Models {
+			db, err := Open(DriverSQLite, filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := migrations.Up(db); err != nil {
+				t.Fatal(err)
+			}
+			return NewModels(db)
+		},
+		"postgres": func(t *testing.T) Models {
+			dsn := os.Getenv(testPostgresDSN)
+			if dsn == "" {
+				t.Skipf("%s is not set", testPostgresDSN)
+			}
+			db, err := Open(DriverPostgres, dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public").Error; err != nil {
+				t.Fatal(err)
+			}
+			if _, err := migrations.Up(db); err != nil {
+				t.Fatal(err)
+			}
+			return NewModels(db)
+		},
+	}
+}
+
+func TestModels(t *testing.T) {
+	cases := map[string]func(t *testing.T, m Models){
+		"users":                   testUsers,
+		"pagination":              testPagination,
+		"role names":              testRoleNames,
+		"permission delete":       testPermissionDelete,
+		"expired grants":          testExpiredGrants,
+		"inherited conflicts":     testInheritedConflicts,
+		"membership conflicts":    testMembershipConflicts,
+		"policy user bundles":     testPolicyUserBundles,
+		"elevation audit trail":   testElevationAuditTrail,
+		"role update rollback":    testRoleUpdateRollback,
+		"inherited managed roles": testInheritedManagedRoles,
+	}
+
+	for backend, open := range testBackends() {
+		for name, run := range cases {
+			t.Run(backend+"/"+name, func(t *testing.T) {
+				run(t, open(t))
+			})
+		}
+	}
+}
+
+func insertTestUser(t *testing.T, m Models, email string) *User {
+	t.Helper()
+	u := &User{FirstName: "Fo", LastName: "La", Email: email, IsActivated: true}
+	if err := u.SetPassword("secret123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Users.Insert(u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func insertTestPermission(t *testing.T, m Models, name string) *Permission {
+	t.Helper()
+	p := &Permission{Name: name}
+	if err := m.Permissions.Insert(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func insertTestRole(t *testing.T, m Models, r *Role) *Role {
+	t.Helper()
+	if err := m.Roles.Insert(r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func testUsers(t *testing.T, m Models) {
+	u := insertTestUser(t, m, "a@example.com")
+
+	err := m.Users.Insert(&User{FirstName: "Fo", LastName: "La", Email: "a@example.com", Password: []byte("x")})
+	if !errors.Is(err, ErrDuplicateRecord) {
+		t.Fatalf("inserting a duplicate email: got %v, want ErrDuplicateRecord", err)
+	}
+
+	duplicate := &User{FirstName: "Fo", LastName: "La", Email: "a@example.com", Password: []byte("x")}
+	if _, err := m.Users.InsertWithToken(duplicate, time.Hour, ScopeActivation); !errors.Is(err, ErrDuplicateRecord) {
+		t.Fatalf("inserting a duplicate email with a token: got %v, want ErrDuplicateRecord", err)
+	}
+
+	got, err := m.Users.GetByEmail("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != u.ID {
+		t.Fatalf("got user %d, want %d", got.ID, u.ID)
+	}
+
+	if _, err := m.Users.GetByID(u.ID + 100); !errors.Is(err, ErrRecordNotFound) {
+		t.Fatalf("getting a missing user: got %v, want ErrRecordNotFound", err)
+	}
+}
+
+func testPagination(t *testing.T, m Models) {
+	for _, name := range []string{"a", "b", "c"} {
+		insertTestPermission(t, m, name)
+	}
+
+	permissions, metadata, err := m.Permissions.GetAll(&Paginate{Page: 2, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(permissions) != 1 || permissions[0].Name != "c" {
+		t.Fatalf("got %d permissions on the second page, want only c", len(permissions))
+	}
+	want := Metadata{CurrentPage: 2, PageSize: 2, FirstPage: 1, LastPage: 2, TotalRecords: 3}
+	if metadata != want {
+		t.Fatalf("got metadata %+v, want %+v", metadata, want)
+	}
+}
+
+func testRoleNames(t *testing.T, m Models) {
+	organization := &Organization{Name: "acme"}
+	if err := m.Organizations.Insert(organization); err != nil {
+		t.Fatal(err)
+	}
+
+	global := insertTestRole(t, m, &Role{Name: "editor"})
+	if err := m.Roles.Insert(&Role{Name: "editor"}); !errors.Is(err, ErrDuplicateRecord) {
+		t.Fatalf("inserting a duplicate global role: got %v, want ErrDuplicateRecord", err)
+	}
+
+	insertTestRole(t, m, &Role{Name: "editor", OrganizationID: &organization.ID})
+	if err := m.Roles.Insert(&Role{Name: "editor", OrganizationID: &organization.ID}); !errors.Is(err, ErrDuplicateRecord) {
+		t.Fatalf("inserting a duplicate organization role: got %v, want ErrDuplicateRecord", err)
+	}
+
+	got, err := m.Roles.GetByName("editor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != global.ID {
+		t.Fatalf("got role %d by name, want the global role %d", got.ID, global.ID)
+	}
+}
+
+func testPermissionDelete(t *testing.T, m Models) {
+	u := insertTestUser(t, m, "a@example.com")
+	granted := insertTestPermission(t, m, "orders:read")
+	revoked := insertTestPermission(t, m, "orders:write")
+
+	if err := m.Users.GrantPermissions(u.ID, []int64{granted.ID}, GrantWindow{}); err != nil {
+		t.Fatal(err)
+	}
+	u.RevokedPermissions = []Permission{*revoked}
+	if err := m.Users.UpdateRevokedPermissions(u); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []*Permission{granted, revoked} {
+		if err := m.Permissions.Delete(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := m.Users.GetByIDWithRolesAndPermissions(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.GrantedPermissions) != 0 || len(got.RevokedPermissions) != 0 {
+		t.Fatalf("deleted permissions are still granted or revoked: %v %v", got.GrantedPermissions, got.RevokedPermissions)
+	}
+}
+
+func testExpiredGrants(t *testing.T, m Models) {
+	u := insertTestUser(t, m, "a@example.com")
+	expired := insertTestRole(t, m, &Role{Name: "expired"})
+	current := insertTestRole(t, m, &Role{Name: "current"})
+
+	// times in another zone must compare like the same instants in UTC.
+	zone := time.FixedZone("UTC+5", 5*60*60)
+	past := time.Now().Add(-time.Hour).In(zone)
+	future := time.Now().Add(time.Hour).In(time.FixedZone("UTC-5", -5*60*60))
+	if err := m.Users.GrantRoles(u.ID, []int64{expired.ID}, GrantWindow{ExpiresAt: &past}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Users.GrantRoles(u.ID, []int64{current.ID}, GrantWindow{ExpiresAt: &future}); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := m.Users.DeleteExpiredGrants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("deleted %d expired grants, want 1", n)
+	}
+
+	got, err := m.Users.GetByIDWithRolesAndPermissions(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Roles) != 1 || got.Roles[0].ID != current.ID {
+		t.Fatalf("got roles %v, want only the current one", got.Roles)
+	}
+}
+
+func testInheritedConflicts(t *testing.T, m Models) {
+	parent := insertTestRole(t, m, &Role{Name: "approver"})
+	other := insertTestRole(t, m, &Role{Name: "requester"})
+	child := insertTestRole(t, m, &Role{Name: "lead", Parents: []Role{*parent}})
+
+	if err := m.Conflicts.Insert(&RoleConflict{RoleID: parent.ID, ConflictingRoleID: other.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	conflicts, err := m.Conflicts.FindConflicts([]int64{child.ID, other.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 {
+		t.Fatalf("got %d conflicts through the parent role, want 1", len(conflicts))
+	}
+
+	u := insertTestUser(t, m, "a@example.com")
+	if err := m.Users.GrantRoles(u.ID, []int64{child.ID, other.ID}, GrantWindow{}); err != nil {
+		t.Fatal(err)
+	}
+	violations, err := m.Conflicts.Violations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 1 || violations[0].UserID != u.ID {
+		t.Fatalf("got violations %v, want one of user %d", violations, u.ID)
+	}
+}
+
+func testMembershipConflicts(t *testing.T, m Models) {
+	approver := insertTestRole(t, m, &Role{Name: "approver"})
+	requester := insertTestRole(t, m, &Role{Name: "requester"})
+	if err := m.Conflicts.Insert(&RoleConflict{RoleID: approver.ID, ConflictingRoleID: requester.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	organization := &Organization{Name: "acme"}
+	if err := m.Organizations.Insert(organization); err != nil {
+		t.Fatal(err)
+	}
+	u := insertTestUser(t, m, "a@example.com")
+	if err := m.Users.GrantRoles(u.ID, []int64{approver.ID}, GrantWindow{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Organizations.SetMembership(organization.ID, u.ID, []Role{*requester}); err != nil {
+		t.Fatal(err)
+	}
+
+	violations, err := m.Conflicts.Violations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 1 || violations[0].OrganizationID == nil || *violations[0].OrganizationID != organization.ID {
+		t.Fatalf("got violations %v, want one in organization %d", violations, organization.ID)
+	}
+}
+
+func testPolicyUserBundles(t *testing.T, m Models) {
+	policy := &Policy{
+		Permissions: []PolicyPermission{{Name: "orders:read"}, {Name: "orders:refund"}},
+		Bundles:     []PolicyBundle{{Name: "support", Permissions: []string{"orders:read"}}},
+	}
+	if _, err := m.Policy.Import(policy, PolicyImport{}); err != nil {
+		t.Fatal(err)
+	}
+	u := insertTestUser(t, m, "a@example.com")
+	support, err := m.Bundles.GetByName("support")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Bundles = []Bundle{*support}
+	if err := m.Users.UpdateBundles(u); err != nil {
+		t.Fatal(err)
+	}
+
+	policy.Permissions[1].RequiresApproval = true
+	policy.Bundles[0].Permissions = append(policy.Bundles[0].Permissions, "orders:refund")
+	if _, err := m.Policy.Import(policy, PolicyImport{}); !errors.Is(err, ErrInvalidPolicy) {
+		t.Fatalf("importing an approval permission into a user bundle: got %v, want ErrInvalidPolicy", err)
+	}
+}
+
+func testElevationAuditTrail(t *testing.T, m Models) {
+	u := insertTestUser(t, m, "a@example.com")
+	role := insertTestRole(t, m, &Role{Name: "oncall"})
+	e := &Elevation{UserID: &u.ID, UserEmail: u.Email, RoleID: &role.ID, RoleName: role.Name, Reason: "outage", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := m.Elevations.Insert(e); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.Users.GetByIDWithAccess(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roles := got.EffectiveRoles(); len(roles) != 1 || roles[0].ID != role.ID {
+		t.Fatalf("got effective roles %v, want the elevated role", roles)
+	}
+
+	if err := m.Roles.Delete(role); err != nil {
+		t.Fatal(err)
+	}
+	got, err = m.Users.GetByIDWithAccess(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Elevations) != 0 {
+		t.Fatalf("got elevations %v of a deleted role", got.Elevations)
+	}
+	if err := m.Users.Delete(u); err != nil {
+		t.Fatal(err)
+	}
+
+	elevations, _, err := m.Elevations.GetAll(&Paginate{Page: 1, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elevations) != 1 {
+		t.Fatalf("got %d elevations after deleting the user and the role, want 1", len(elevations))
+	}
+	kept := elevations[0]
+	if kept.UserID != nil || kept.RoleID != nil || kept.UserEmail != "a@example.com" || kept.RoleName != "oncall" {
+		t.Fatalf("got elevation %+v, want the ids cleared and the names kept", kept)
+	}
+}
+
+func testRoleUpdateRollback(t *testing.T, m Models) {
+	read := insertTestPermission(t, m, "orders:read")
+	write := insertTestPermission(t, m, "orders:write")
+	insertTestRole(t, m, &Role{Name: "viewer"})
+	editor := insertTestRole(t, m, &Role{Name: "editor", Permissions: []Permission{*read}})
+
+	editor.Name = "viewer"
+	editor.Permissions = []Permission{*write}
+	if err := m.Roles.Update(editor); !errors.Is(err, ErrDuplicateRecord) {
+		t.Fatalf("renaming to a taken name: got %v, want ErrDuplicateRecord", err)
+	}
+
+	got, err := m.Roles.GetByID(editor.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "editor" || len(got.Permissions) != 1 || got.Permissions[0].ID != read.ID {
+		t.Fatalf("got role %q with permissions %v after a failed update, want it unchanged", got.Name, got.Permissions)
+	}
+}
+
+func testInheritedManagedRoles(t *testing.T, m Models) {
+	managed := insertTestRole(t, m, &Role{Name: "support"})
+	parent := insertTestRole(t, m, &Role{Name: "support-manager"})
+	child := insertTestRole(t, m, &Role{Name: "support-lead", Parents: []Role{*parent}})
+
+	if err := m.Roles.SetManaged(parent, []Role{*managed}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	roleIDs, _, err := m.Roles.ManagedBy([]int64{child.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roleIDs) != 1 || roleIDs[0] != managed.ID {
+		t.Fatalf("got managed roles %v, want [%d]", roleIDs, managed.ID)
+	}
+}
@@ -0,0 +1,183 @@
+package data
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// Organization is a tenant. Users join organizations through memberships
+// and hold different roles in each of them.
+type Organization struct {
+	CoreModel
+	Name    string       `json:"name" gorm:"uniqueIndex;not null"`
+	Members []Membership `json:"members,omitempty" gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// Membership is a user in an organization, with the roles the user holds
+// in that organization. The roles are either global templates or local to
+// the organization.
+type Membership struct {
+	CoreModel
+	OrganizationID int64  `json:"organization_id" gorm:"not null;uniqueIndex:idx_memberships_organization_user"`
+	UserID         int64  `json:"user_id" gorm:"not null;uniqueIndex:idx_memberships_organization_user"`
+	User           *User  `json:"user,omitempty" gorm:"constraint:OnDelete:CASCADE"`
+	Roles          []Role `json:"roles,omitempty" gorm:"many2many:memberships_roles;constraint:OnDelete:CASCADE"`
+}
+
+// InOrganization returns a copy of the user whose roles are the roles of
+// the membership, so access is decided for that organization only. The
+// global grants, bundles and scoped permissions of the user are left out,
+// revoked permissions still apply. Break-glass elevations still apply
+// through EffectiveRoles.
+func (u *User) InOrganization(m *Membership) *User {
+	user := *u
+	user.Roles = m.Roles
+	user.GrantedPermissions = nil
+	user.Bundles = nil
+	user.ScopedPermissions = nil
+	return &user
+}
+
+type OrganizationModel struct {
+	DB *gorm.DB
+}
+
+func (m OrganizationModel) Insert(o *Organization) error {
+	err := m.DB.Create(o).Error
+	if err != nil {
+		switch {
+		case IsDuplicateRecord(err):
+			return ErrDuplicateRecord
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m OrganizationModel) GetAll(p *Paginate) ([]*Organization, Metadata, error) {
+	organizations := make([]*Organization, 0)
+	err := m.DB.Scopes(p.PaginatedResults).Find(&organizations).Error
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	var total int64
+	m.DB.Model(&Organization{}).Count(&total)
+	metadata := CalculateMetadata(p, int(total))
+	return organizations, metadata, nil
+}
+
+func (m OrganizationModel) GetByID(id int64) (*Organization, error) {
+	var organization Organization
+	err := m.DB.Preload("Members.Roles").Where("id=?", id).First(&organization).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &organization, nil
+}
+
+func (m OrganizationModel) Update(o *Organization) error {
+	err := m.DB.Model(o).Select("Name").Updates(o).Error
+	if err != nil {
+		switch {
+		case IsDuplicateRecord(err):
+			return ErrDuplicateRecord
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m OrganizationModel) Delete(o *Organization) error {
+	return m.DB.Delete(o).Error
+}
+
+// GetMembership returns the membership of the user in the organization, with
+// the roles resolved the same way UserModel.GetByIDWithAccess does.
+func (m OrganizationModel) GetMembership(organizationID, userID int64) (*Membership, error) {
+	var membership Membership
+	err := m.DB.
+		Preload("Roles.Permissions").
+		Preload("Roles.Bundles.Permissions").
+		Preload("Roles.Parents").
+		Where("organization_id = ? and user_id = ?", organizationID, userID).
+		First(&membership).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	roles := RoleModel{DB: m.DB}
+	for i := range membership.Roles {
+		if err := roles.attachConditions(&membership.Roles[i]); err != nil {
+			return nil, err
+		}
+		if err := roles.LoadInheritedPermissions(&membership.Roles[i]); err != nil {
+			return nil, err
+		}
+	}
+	return &membership, nil
+}
+
+// GetMembershipsForUser returns every membership of the user, with the
+// organization names.
+func (m OrganizationModel) GetMembershipsForUser(userID int64) ([]Membership, []Organization, error) {
+	memberships := make([]Membership, 0)
+	if err := m.DB.Preload("Roles").Where("user_id = ?", userID).Find(&memberships).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var ids []int64
+	for _, ms := range memberships {
+		ids = append(ids, ms.OrganizationID)
+	}
+	organizations := make([]Organization, 0)
+	if len(ids) > 0 {
+		if err := m.DB.Where("id IN ?", ids).Find(&organizations).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+	return memberships, organizations, nil
+}
+
+// SetMembership adds the user to the organization, or replaces the roles of
+// the user in it if the user is already a member.
+func (m OrganizationModel) SetMembership(organizationID, userID int64, roles []Role) (*Membership, error) {
+	var membership Membership
+	err := m.DB.
+		Where(Membership{OrganizationID: organizationID, UserID: userID}).
+		FirstOrCreate(&membership).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.DB.Model(&membership).Association("Roles").Replace(roles); err != nil {
+		return nil, err
+	}
+	membership.Roles = roles
+	return &membership, nil
+}
+
+func (m OrganizationModel) DeleteMembership(organizationID, userID int64) error {
+	result := m.DB.
+		Where("organization_id = ? and user_id = ?", organizationID, userID).
+		Delete(&Membership{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -11,12 +11,94 @@ type Permission struct {
 	CoreModel
 	Name  string `json:"name" gorm:"uniqueIndex;not null"`
 	Roles []Role `json:"permissions,omitempty" gorm:"many2many:roles_permissions;constraint:OnDelete:CASCADE"`
+	// RequiresApproval makes custom grants of the permission wait for a
+	// second admin.
+	RequiresApproval bool `json:"requires_approval" gorm:"default:false;not null"`
+	// Conditions is only set when the permission is loaded through a role
+	// and the role grants it conditionally.
+	Conditions *Conditions `json:"conditions,omitempty" gorm:"-"`
+}
+
+// PermissionWildcard matches any segment of a permission name.
+const PermissionWildcard = "*"
+
+// PermissionMatches reports whether pattern covers code. Permission names are
+// namespaced with colons, e.g. "orders:read". A "*" segment in pattern matches
+// any single segment, a trailing "*" also matches all the remaining segments.
+// Comparison is case-insensitive.
+func PermissionMatches(pattern, code string) bool {
+	ps := strings.Split(strings.ToLower(pattern), ":")
+	cs := strings.Split(strings.ToLower(code), ":")
+
+	for i, p := range ps {
+		if i >= len(cs) {
+			return false
+		}
+		if p == PermissionWildcard {
+			if i == len(ps)-1 {
+				return true
+			}
+			continue
+		}
+		if p != cs[i] {
+			return false
+		}
+	}
+	return len(ps) == len(cs)
+}
+
+// PermissionSpecificity ranks patterns, an exact name ranks higher than
+// any pattern that has wildcards in it.
+func PermissionSpecificity(pattern string) int {
+	score := 0
+	for _, segment := range strings.Split(pattern, ":") {
+		if segment != PermissionWildcard {
+			score++
+		}
+	}
+	if score == len(strings.Split(pattern, ":")) {
+		// no wildcards at all
+		score++
+	}
+	return score
+}
+
+// bestMatch returns the specificity of the most specific permission in list
+// that covers code, or -1 if there is none.
+func bestMatch(list []Permission, code string) int {
+	best := -1
+	for _, v := range list {
+		if !PermissionMatches(v.Name, code) {
+			continue
+		}
+		if s := PermissionSpecificity(v.Name); s > best {
+			best = s
+		}
+	}
+	return best
 }
 
 func PermissionsInclude(list []Permission, code string) bool {
-	code = strings.ToLower(code)
+	return bestMatch(list, code) >= 0
+}
+
+// IsPermitted decides whether code is granted by granted and not taken back
+// by revoked. The most specific matching entry wins, on a tie the revocation
+// wins, so revoking "orders:*" beats granting "*:read" but revoking
+// "orders:*" loses to granting "orders:read".
+func IsPermitted(granted, revoked []Permission, code string) bool {
+	g := bestMatch(granted, code)
+	if g < 0 {
+		return false
+	}
+	return bestMatch(revoked, code) < g
+}
+
+// containsUnconditionalPermission reports whether list grants the permission
+// with the given id without any conditions.
+func containsUnconditionalPermission(list []Permission, id int64) bool {
 	for _, v := range list {
-		if strings.ToLower(v.Name) == code {
+		if v.ID == id && v.Conditions == nil {
 			return true
 		}
 	}
@@ -47,6 +129,16 @@ func (m PermissionModel) GetAll(p *Paginate) ([]*Permission, Metadata, error) {
 	return permissions, metadata, nil
 }
 
+// GetAllNames returns the names of every permission.
+func (m PermissionModel) GetAllNames() ([]string, error) {
+	names := make([]string, 0)
+	err := m.DB.Model(&Permission{}).Order("name").Pluck("name", &names).Error
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
 func (m PermissionModel) GetByID(id int64) (*Permission, error) {
 	var permission Permission
 	err := m.DB.First(&permission, id).Error
@@ -92,5 +184,5 @@ func (m PermissionModel) Delete(p *Permission) error {
 }
 
 func (m PermissionModel) Update(p *Permission) error {
-	return m.DB.Model(p).Updates(p).Error
+	return m.DB.Model(p).Select("Name", "RequiresApproval").Updates(p).Error
 }
@@ -0,0 +1,650 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/kubil6y/myshop-go/internal/validator"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidPolicy = errors.New("invalid policy")
+
+	errPolicyDryRun = errors.New("policy dry run")
+)
+
+// Policy is the whole authorization model as a document: permissions,
+// bundles and global roles by name, and optionally the global roles of
+// users by email. Organization local roles are not part of it.
+type Policy struct {
+	Permissions []PolicyPermission `json:"permissions" yaml:"permissions"`
+	Bundles     []PolicyBundle     `json:"bundles,omitempty" yaml:"bundles,omitempty"`
+	Roles       []PolicyRole       `json:"roles" yaml:"roles"`
+	Bindings    []PolicyBinding    `json:"bindings,omitempty" yaml:"bindings,omitempty"`
+}
+
+type PolicyPermission struct {
+	Name             string `json:"name" yaml:"name"`
+	RequiresApproval bool   `json:"requires_approval,omitempty" yaml:"requires_approval,omitempty"`
+}
+
+type PolicyBundle struct {
+	Name        string   `json:"name" yaml:"name"`
+	Permissions []string `json:"permissions" yaml:"permissions"`
+}
+
+type PolicyRole struct {
+	Name             string   `json:"name" yaml:"name"`
+	Permissions      []string `json:"permissions" yaml:"permissions"`
+	Bundles          []string `json:"bundles,omitempty" yaml:"bundles,omitempty"`
+	Parents          []string `json:"parents,omitempty" yaml:"parents,omitempty"`
+	RequiresApproval bool     `json:"requires_approval,omitempty" yaml:"requires_approval,omitempty"`
+}
+
+// PolicyBinding sets the global roles of the user with the email.
+type PolicyBinding struct {
+	User  string   `json:"user" yaml:"user"`
+	Roles []string `json:"roles" yaml:"roles"`
+}
+
+// Policy change actions.
+const (
+	PolicyCreate = "create"
+	PolicyUpdate = "update"
+	PolicyDelete = "delete"
+)
+
+// PolicyChange is one line of the difference between the stored model and
+// a policy. Fields lists what an update changes.
+type PolicyChange struct {
+	Kind   string   `json:"kind"`
+	Name   string   `json:"name"`
+	Action string   `json:"action"`
+	Fields []string `json:"fields,omitempty"`
+	// WithoutApproval lists the roles that a binding gives the user although
+	// they require approval, see PolicyImport.BindApprovalRoles.
+	WithoutApproval []string `json:"without_approval,omitempty"`
+}
+
+// PolicyImport holds the options of an import. Permissions, bundles and
+// roles missing from the policy are deleted only when Prune is set. With
+// DryRun nothing changes. Bindings can not give users roles that require
+// approval they don't hold yet, unless BindApprovalRoles is set.
+type PolicyImport struct {
+	Prune             bool
+	DryRun            bool
+	BindApprovalRoles bool
+}
+
+func ValidatePolicy(v *validator.Validator, p *Policy) {
+	unique := func(key string, names []string) {
+		for _, name := range names {
+			v.Check(name != "", key, "names must be provided")
+		}
+		v.Check(validator.IsUniqueSS(names), key, "names must be unique")
+	}
+
+	var names []string
+	for _, pp := range p.Permissions {
+		names = append(names, pp.Name)
+	}
+	unique("permissions", names)
+
+	names = nil
+	for _, pb := range p.Bundles {
+		names = append(names, pb.Name)
+	}
+	unique("bundles", names)
+
+	names = nil
+	for _, pr := range p.Roles {
+		names = append(names, pr.Name)
+	}
+	unique("roles", names)
+
+	names = nil
+	for _, pb := range p.Bindings {
+		names = append(names, pb.User)
+	}
+	unique("bindings", names)
+}
+
+type PolicyModel struct {
+	DB *gorm.DB
+}
+
+// Export returns the stored model as a policy, sorted by name. Bindings are
+// only included if withBindings is set.
+func (m PolicyModel) Export(withBindings bool) (*Policy, error) {
+	policy := &Policy{
+		Permissions: make([]PolicyPermission, 0),
+		Roles:       make([]PolicyRole, 0),
+	}
+
+	var permissions []Permission
+	if err := m.DB.Order("name").Find(&permissions).Error; err != nil {
+		return nil, err
+	}
+	for _, p := range permissions {
+		policy.Permissions = append(policy.Permissions, PolicyPermission{Name: p.Name, RequiresApproval: p.RequiresApproval})
+	}
+
+	var bundles []Bundle
+	if err := m.DB.Preload("Permissions").Order("name").Find(&bundles).Error; err != nil {
+		return nil, err
+	}
+	for _, b := range bundles {
+		policy.Bundles = append(policy.Bundles, PolicyBundle{Name: b.Name, Permissions: permissionNames(b.Permissions)})
+	}
+
+	var roles []Role
+	err := m.DB.Preload("Permissions").Preload("Bundles").Preload("Parents").
+		Where("organization_id IS NULL").Order("name").Find(&roles).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range roles {
+		pr := PolicyRole{
+			Name:             r.Name,
+			Permissions:      permissionNames(r.Permissions),
+			RequiresApproval: r.RequiresApproval,
+		}
+		for _, b := range r.Bundles {
+			pr.Bundles = append(pr.Bundles, b.Name)
+		}
+		pr.Parents = roleNames(r.Parents)
+		sort.Strings(pr.Bundles)
+		policy.Roles = append(policy.Roles, pr)
+	}
+
+	if withBindings {
+		var users []User
+		if err := m.DB.Preload("Roles").Order("email").Find(&users).Error; err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			if len(u.Roles) == 0 {
+				continue
+			}
+			policy.Bindings = append(policy.Bindings, PolicyBinding{User: u.Email, Roles: roleNames(u.Roles)})
+		}
+	}
+
+	return policy, nil
+}
+
+// Import makes the stored model match the policy in a single transaction,
+// either everything is applied or nothing. Users without a binding keep
+// their roles. With opts.DryRun the transaction is rolled back, so the
+// policy is fully checked but nothing changes. The returned changes are
+// what the import does.
+func (m PolicyModel) Import(p *Policy, opts PolicyImport) ([]PolicyChange, error) {
+	var changes []PolicyChange
+
+	err := m.DB.Transaction(func(tx *gorm.DB) error {
+		models := NewModels(tx)
+		current, err := models.Policy.Export(len(p.Bindings) > 0)
+		if err != nil {
+			return err
+		}
+		changes = DiffPolicy(current, p, opts.Prune)
+
+		withoutApproval, err := applyPolicy(models, current, p, opts)
+		if err != nil {
+			return err
+		}
+		annotateWithoutApproval(changes, withoutApproval)
+		if opts.DryRun {
+			return errPolicyDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPolicyDryRun) {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// applyPolicy makes models match p, current is what models held before. It
+// only goes through the repositories, so every implementation imports the
+// same way, the caller makes it atomic. It returns, by user, the roles that
+// bindings gave without approval.
+func applyPolicy(models Models, current, p *Policy, opts PolicyImport) (map[string][]string, error) {
+	attached, err := models.Bundles.GetAllAttachedToUsers()
+	if err != nil {
+		return nil, err
+	}
+	approvalsBefore := UserBundleApprovals(attached)
+
+	for _, pp := range p.Permissions {
+		permission, err := models.Permissions.GetByName(pp.Name)
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			permission = &Permission{Name: pp.Name, RequiresApproval: pp.RequiresApproval}
+			err = models.Permissions.Insert(permission)
+		case err == nil && permission.RequiresApproval != pp.RequiresApproval:
+			permission.RequiresApproval = pp.RequiresApproval
+			err = models.Permissions.Update(permission)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	permissions := make(map[string]Permission)
+	lookupPermissions := func(owner string, names []string) ([]Permission, error) {
+		result := make([]Permission, 0, len(names))
+		for _, name := range names {
+			permission, ok := permissions[name]
+			if !ok {
+				stored, err := models.Permissions.GetByName(name)
+				if err != nil {
+					switch {
+					case errors.Is(err, ErrRecordNotFound):
+						return nil, fmt.Errorf("%w: %s: unknown permission %q", ErrInvalidPolicy, owner, name)
+					default:
+						return nil, err
+					}
+				}
+				permission = *stored
+				permissions[name] = permission
+			}
+			result = append(result, permission)
+		}
+		return result, nil
+	}
+
+	bundles := make(map[string]Bundle)
+	for _, pb := range p.Bundles {
+		bundlePermissions, err := lookupPermissions(fmt.Sprintf("bundle %q", pb.Name), pb.Permissions)
+		if err != nil {
+			return nil, err
+		}
+
+		bundle, err := models.Bundles.GetByName(pb.Name)
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			bundle = &Bundle{Name: pb.Name, Permissions: bundlePermissions}
+			err = models.Bundles.Insert(bundle)
+		case err == nil:
+			bundle.Permissions = bundlePermissions
+			err = models.Bundles.Update(bundle)
+		}
+		if err != nil {
+			return nil, err
+		}
+		bundles[pb.Name] = *bundle
+	}
+
+	attached, err = models.Bundles.GetAllAttachedToUsers()
+	if err != nil {
+		return nil, err
+	}
+	for key := range UserBundleApprovals(attached) {
+		if !approvalsBefore[key] {
+			return nil, fmt.Errorf("%w: bundle %q is attached to users and can not hold %q which requires approval", ErrInvalidPolicy, key[0], key[1])
+		}
+	}
+	lookupBundle := func(owner, name string) (Bundle, error) {
+		if bundle, ok := bundles[name]; ok {
+			return bundle, nil
+		}
+		bundle, err := models.Bundles.GetByName(name)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrRecordNotFound):
+				return Bundle{}, fmt.Errorf("%w: %s: unknown bundle %q", ErrInvalidPolicy, owner, name)
+			default:
+				return Bundle{}, err
+			}
+		}
+		bundles[name] = *bundle
+		return *bundle, nil
+	}
+
+	// roles are created first so that they can be each other's parents.
+	roles := make(map[string]*Role)
+	for _, pr := range p.Roles {
+		role, err := models.Roles.GetByName(pr.Name)
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			role = &Role{Name: pr.Name}
+			err = models.Roles.Insert(role)
+		}
+		if err != nil {
+			return nil, err
+		}
+		roles[pr.Name] = role
+	}
+
+	for _, pr := range p.Roles {
+		role := roles[pr.Name]
+		owner := fmt.Sprintf("role %q", pr.Name)
+
+		rolePermissions, err := lookupPermissions(owner, pr.Permissions)
+		if err != nil {
+			return nil, err
+		}
+
+		roleBundles := make([]Bundle, 0, len(pr.Bundles))
+		for _, name := range pr.Bundles {
+			bundle, err := lookupBundle(owner, name)
+			if err != nil {
+				return nil, err
+			}
+			roleBundles = append(roleBundles, bundle)
+		}
+
+		parents := make([]Role, 0, len(pr.Parents))
+		for _, name := range pr.Parents {
+			parent, err := policyRole(models.Roles, roles, name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", owner, err)
+			}
+			parents = append(parents, *parent)
+		}
+
+		role.Permissions = rolePermissions
+		role.Bundles = roleBundles
+		role.Parents = parents
+		role.RequiresApproval = pr.RequiresApproval
+		if err := models.Roles.Update(role); err != nil {
+			switch {
+			case errors.Is(err, ErrRoleCycle):
+				return nil, fmt.Errorf("%w: %s: parents create a cycle", ErrInvalidPolicy, owner)
+			default:
+				return nil, err
+			}
+		}
+	}
+
+	// roles that require approval and are already held were approved, only
+	// new ones are refused.
+	held := make(map[[2]string]bool)
+	for _, pb := range current.Bindings {
+		for _, name := range pb.Roles {
+			held[[2]string{pb.User, name}] = true
+		}
+	}
+
+	withoutApproval := make(map[string][]string)
+	for _, pb := range p.Bindings {
+		user, err := models.Users.GetByEmail(pb.User)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrRecordNotFound):
+				return nil, fmt.Errorf("%w: binding: unknown user %q", ErrInvalidPolicy, pb.User)
+			default:
+				return nil, err
+			}
+		}
+
+		var ids []int64
+		user.Roles = make([]Role, 0, len(pb.Roles))
+		for _, name := range pb.Roles {
+			role, err := policyRole(models.Roles, roles, name)
+			if err != nil {
+				return nil, fmt.Errorf("binding %q: %w", pb.User, err)
+			}
+			if role.RequiresApproval && !held[[2]string{pb.User, name}] {
+				if !opts.BindApprovalRoles {
+					return nil, fmt.Errorf("%w: binding %q: role %q requires approval, grant it through a grant request", ErrInvalidPolicy, pb.User, name)
+				}
+				withoutApproval[pb.User] = append(withoutApproval[pb.User], name)
+			}
+			ids = append(ids, role.ID)
+			user.Roles = append(user.Roles, *role)
+		}
+
+		conflicts, err := models.Conflicts.FindConflicts(ids)
+		if err != nil {
+			return nil, err
+		}
+		if len(conflicts) > 0 {
+			c := conflicts[0]
+			return nil, fmt.Errorf("%w: binding %q: roles %q and %q conflict", ErrInvalidPolicy, pb.User, c.Role.Name, c.ConflictingRole.Name)
+		}
+
+		if err := models.Users.UpdateRoles(user); err != nil {
+			return nil, err
+		}
+	}
+
+	if !opts.Prune {
+		return withoutApproval, nil
+	}
+
+	var keep []string
+	for _, pr := range p.Roles {
+		keep = append(keep, pr.Name)
+	}
+	var stored []string
+	for _, pr := range current.Roles {
+		stored = append(stored, pr.Name)
+	}
+	err = pruneMissing(stored, keep, func(name string) error {
+		role, err := models.Roles.GetByName(name)
+		if err != nil {
+			return err
+		}
+		return models.Roles.Delete(role)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keep, stored = nil, nil
+	for _, pb := range p.Bundles {
+		keep = append(keep, pb.Name)
+	}
+	for _, pb := range current.Bundles {
+		stored = append(stored, pb.Name)
+	}
+	err = pruneMissing(stored, keep, func(name string) error {
+		bundle, err := models.Bundles.GetByName(name)
+		if err != nil {
+			return err
+		}
+		return models.Bundles.Delete(bundle)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keep, stored = nil, nil
+	for _, pp := range p.Permissions {
+		keep = append(keep, pp.Name)
+	}
+	for _, pp := range current.Permissions {
+		stored = append(stored, pp.Name)
+	}
+	err = pruneMissing(stored, keep, func(name string) error {
+		permission, err := models.Permissions.GetByName(name)
+		if err != nil {
+			return err
+		}
+		return models.Permissions.Delete(permission)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return withoutApproval, nil
+}
+
+// annotateWithoutApproval sets WithoutApproval of the binding changes.
+func annotateWithoutApproval(changes []PolicyChange, withoutApproval map[string][]string) {
+	for i, c := range changes {
+		if c.Kind == "binding" {
+			changes[i].WithoutApproval = withoutApproval[c.Name]
+		}
+	}
+}
+
+// policyRole returns the role of the policy with the name, or the stored one.
+func policyRole(roles RoleRepository, inPolicy map[string]*Role, name string) (*Role, error) {
+	if role, ok := inPolicy[name]; ok {
+		return role, nil
+	}
+	role, err := roles.GetByName(name)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return nil, fmt.Errorf("%w: unknown role %q", ErrInvalidPolicy, name)
+		default:
+			return nil, err
+		}
+	}
+	return role, nil
+}
+
+// pruneMissing calls remove for every name in stored that is not in keep.
+func pruneMissing(stored, keep []string, remove func(name string) error) error {
+	kept := make(map[string]bool, len(keep))
+	for _, name := range keep {
+		kept[name] = true
+	}
+	for _, name := range stored {
+		if kept[name] {
+			continue
+		}
+		if err := remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiffPolicy returns the changes that turn current into desired.
+func DiffPolicy(current, desired *Policy, prune bool) []PolicyChange {
+	changes := make([]PolicyChange, 0)
+
+	currentPermissions := make(map[string]PolicyPermission)
+	for _, pp := range current.Permissions {
+		currentPermissions[pp.Name] = pp
+	}
+	desiredPermissions := make(map[string]bool)
+	for _, pp := range desired.Permissions {
+		desiredPermissions[pp.Name] = true
+		old, ok := currentPermissions[pp.Name]
+		switch {
+		case !ok:
+			changes = append(changes, PolicyChange{Kind: "permission", Name: pp.Name, Action: PolicyCreate})
+		case old.RequiresApproval != pp.RequiresApproval:
+			changes = append(changes, PolicyChange{Kind: "permission", Name: pp.Name, Action: PolicyUpdate, Fields: []string{"requires_approval"}})
+		}
+	}
+
+	currentBundles := make(map[string]PolicyBundle)
+	for _, pb := range current.Bundles {
+		currentBundles[pb.Name] = pb
+	}
+	desiredBundles := make(map[string]bool)
+	for _, pb := range desired.Bundles {
+		desiredBundles[pb.Name] = true
+		old, ok := currentBundles[pb.Name]
+		switch {
+		case !ok:
+			changes = append(changes, PolicyChange{Kind: "bundle", Name: pb.Name, Action: PolicyCreate})
+		case !sameNames(old.Permissions, pb.Permissions):
+			changes = append(changes, PolicyChange{Kind: "bundle", Name: pb.Name, Action: PolicyUpdate, Fields: []string{"permissions"}})
+		}
+	}
+
+	currentRoles := make(map[string]PolicyRole)
+	for _, pr := range current.Roles {
+		currentRoles[pr.Name] = pr
+	}
+	desiredRoles := make(map[string]bool)
+	for _, pr := range desired.Roles {
+		desiredRoles[pr.Name] = true
+		old, ok := currentRoles[pr.Name]
+		if !ok {
+			changes = append(changes, PolicyChange{Kind: "role", Name: pr.Name, Action: PolicyCreate})
+			continue
+		}
+
+		var fields []string
+		if !sameNames(old.Permissions, pr.Permissions) {
+			fields = append(fields, "permissions")
+		}
+		if !sameNames(old.Bundles, pr.Bundles) {
+			fields = append(fields, "bundles")
+		}
+		if !sameNames(old.Parents, pr.Parents) {
+			fields = append(fields, "parents")
+		}
+		if old.RequiresApproval != pr.RequiresApproval {
+			fields = append(fields, "requires_approval")
+		}
+		if len(fields) > 0 {
+			changes = append(changes, PolicyChange{Kind: "role", Name: pr.Name, Action: PolicyUpdate, Fields: fields})
+		}
+	}
+
+	currentBindings := make(map[string]PolicyBinding)
+	for _, pb := range current.Bindings {
+		currentBindings[pb.User] = pb
+	}
+	for _, pb := range desired.Bindings {
+		if !sameNames(currentBindings[pb.User].Roles, pb.Roles) {
+			changes = append(changes, PolicyChange{Kind: "binding", Name: pb.User, Action: PolicyUpdate, Fields: []string{"roles"}})
+		}
+	}
+
+	if prune {
+		for _, pr := range current.Roles {
+			if !desiredRoles[pr.Name] {
+				changes = append(changes, PolicyChange{Kind: "role", Name: pr.Name, Action: PolicyDelete})
+			}
+		}
+		for _, pb := range current.Bundles {
+			if !desiredBundles[pb.Name] {
+				changes = append(changes, PolicyChange{Kind: "bundle", Name: pb.Name, Action: PolicyDelete})
+			}
+		}
+		for _, pp := range current.Permissions {
+			if !desiredPermissions[pp.Name] {
+				changes = append(changes, PolicyChange{Kind: "permission", Name: pp.Name, Action: PolicyDelete})
+			}
+		}
+	}
+
+	return changes
+}
+
+// sameNames reports whether a and b hold the same names in any order.
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, name := range a {
+		set[name] = true
+	}
+	for _, name := range b {
+		if !set[name] {
+			return false
+		}
+	}
+	return true
+}
+
+func permissionNames(permissions []Permission) []string {
+	names := make([]string, 0, len(permissions))
+	for _, p := range permissions {
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func roleNames(roles []Role) []string {
+	var names []string
+	for _, r := range roles {
+		names = append(names, r.Name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,120 @@
+package data
+
+import "time"
+
+// The repositories below are implemented by the gorm models, see NewModels,
+// and by the in-memory models, see NewMemoryModels.
+
+type UserRepository interface {
+	InvalidateCache(userID int64)
+	PurgeCache()
+	Insert(u *User) error
+	InsertWithToken(u *User, ttl time.Duration, scope string) (*Token, error)
+	Update(u *User) error
+	UpdateGrantedPermissions(u *User) error
+	UpdateRevokedPermissions(u *User) error
+	UpdateBundles(u *User) error
+	UpdateRoles(u *User) error
+	Delete(u *User) error
+	GetByID(id int64) (*User, error)
+	GetByIDWithRolesAndPermissions(id int64) (*User, error)
+	GetByIDWithAccess(id int64) (*User, error)
+	GetByEmail(email string) (*User, error)
+	GetForToken(scope string, tokenPlaintext string) (*User, error)
+	GetAll(p *Paginate) ([]*User, Metadata, error)
+	GrantRoles(userID int64, roleIDs []int64, w GrantWindow) error
+	GrantPermissions(userID int64, permissionIDs []int64, w GrantWindow) error
+	DeleteExpiredGrants() (int64, error)
+}
+
+type TokenRepository interface {
+	Insert(token *Token) error
+	New(userID int64, ttl time.Duration, scope string) (*Token, error)
+	NewWithMetadata(userID int64, ttl time.Duration, scope string, md TokenMetadata) (*Token, error)
+	GetAllForUser(scope string, userID int64) ([]Token, error)
+	DeleteAllForUser(scope string, userID int64) error
+	DeleteForUser(scope string, userID, id int64) error
+	DeleteForToken(scope string, tokenPlaintext string) error
+	Rotate(tokenPlaintext string) (*Token, error)
+	UpdateLastUsed(lastUsed map[string]time.Time) error
+}
+
+type RoleRepository interface {
+	GetAll(p *Paginate) ([]*Role, Metadata, error)
+	GetByID(id int64) (*Role, error)
+	GetByName(name string) (*Role, error)
+	Insert(r *Role) error
+	Update(r *Role) error
+	Delete(r *Role) error
+	SetManaged(r *Role, roles []Role, permissions []Permission) error
+	ManagedBy(roleIDs []int64) (managedRoleIDs []int64, managedPermissionIDs []int64, err error)
+	SetPermissionConditions(roleID, permissionID int64, c Conditions) error
+}
+
+type PermissionRepository interface {
+	GetAll(p *Paginate) ([]*Permission, Metadata, error)
+	GetAllNames() ([]string, error)
+	GetByID(id int64) (*Permission, error)
+	GetByName(name string) (*Permission, error)
+	Insert(p *Permission) error
+	Update(p *Permission) error
+	Delete(p *Permission) error
+}
+
+type ScopedPermissionRepository interface {
+	Insert(s *ScopedUserPermission) error
+	Delete(userID, permissionID int64, resourceType string, resourceID int64) error
+	GetAllForUser(userID int64) ([]ScopedUserPermission, error)
+}
+
+type OrganizationRepository interface {
+	GetAll(p *Paginate) ([]*Organization, Metadata, error)
+	GetByID(id int64) (*Organization, error)
+	Insert(o *Organization) error
+	Update(o *Organization) error
+	Delete(o *Organization) error
+	GetMembership(organizationID, userID int64) (*Membership, error)
+	GetMembershipsForUser(userID int64) ([]Membership, []Organization, error)
+	SetMembership(organizationID, userID int64, roles []Role) (*Membership, error)
+	DeleteMembership(organizationID, userID int64) error
+}
+
+type RoleConflictRepository interface {
+	GetAll() ([]RoleConflict, error)
+	GetByID(id int64) (*RoleConflict, error)
+	Insert(c *RoleConflict) error
+	Delete(c *RoleConflict) error
+	FindConflicts(roleIDs []int64) ([]RoleConflict, error)
+	Violations() ([]Violation, error)
+}
+
+type GrantRequestRepository interface {
+	GetAll(status string, p *Paginate) ([]*GrantRequest, Metadata, error)
+	GetByID(id int64) (*GrantRequest, error)
+	Insert(g *GrantRequest) error
+	Decide(g *GrantRequest, status string, decidedByID int64) error
+	Approve(g *GrantRequest, decidedByID int64) error
+	ExpirePending() (int64, error)
+}
+
+type ElevationRepository interface {
+	GetAll(p *Paginate) ([]*Elevation, Metadata, error)
+	Insert(e *Elevation) error
+}
+
+type BundleRepository interface {
+	GetAll(p *Paginate) ([]*Bundle, Metadata, error)
+	GetByID(id int64) (*Bundle, error)
+	GetByName(name string) (*Bundle, error)
+	// GetAllAttachedToUsers returns the bundles attached to at least one
+	// user, their permissions are loaded.
+	GetAllAttachedToUsers() ([]*Bundle, error)
+	Insert(b *Bundle) error
+	Update(b *Bundle) error
+	Delete(b *Bundle) error
+}
+
+type PolicyRepository interface {
+	Export(withBindings bool) (*Policy, error)
+	Import(p *Policy, opts PolicyImport) ([]PolicyChange, error)
+}
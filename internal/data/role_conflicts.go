@@ -0,0 +1,220 @@
+package data
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// RoleConflict declares two roles mutually exclusive (separation of duties),
+// nobody may hold both of them. RoleID is always the smaller id.
+type RoleConflict struct {
+	CoreModel
+	RoleID            int64 `json:"role_id" gorm:"not null;uniqueIndex:idx_role_conflicts_roles"`
+	Role              Role  `json:"role" gorm:"constraint:OnDelete:CASCADE"`
+	ConflictingRoleID int64 `json:"conflicting_role_id" gorm:"not null;uniqueIndex:idx_role_conflicts_roles"`
+	ConflictingRole   Role  `json:"conflicting_role" gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// Violation is a user who holds both roles of a conflict, either globally or
+// in an organization.
+type Violation struct {
+	UserID         int64        `json:"user_id"`
+	OrganizationID *int64       `json:"organization_id,omitempty"`
+	Conflict       RoleConflict `json:"conflict"`
+}
+
+type RoleConflictModel struct {
+	DB *gorm.DB
+}
+
+func (m RoleConflictModel) Insert(c *RoleConflict) error {
+	if c.RoleID > c.ConflictingRoleID {
+		c.RoleID, c.ConflictingRoleID = c.ConflictingRoleID, c.RoleID
+		c.Role, c.ConflictingRole = c.ConflictingRole, c.Role
+	}
+
+	err := m.DB.Omit("Role", "ConflictingRole").Create(c).Error
+	if err != nil {
+		switch {
+		case IsDuplicateRecord(err):
+			return ErrDuplicateRecord
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m RoleConflictModel) GetAll() ([]RoleConflict, error) {
+	conflicts := make([]RoleConflict, 0)
+	err := m.DB.Preload("Role").Preload("ConflictingRole").Order("id").Find(&conflicts).Error
+	if err != nil {
+		return nil, err
+	}
+	return conflicts, nil
+}
+
+func (m RoleConflictModel) GetByID(id int64) (*RoleConflict, error) {
+	var conflict RoleConflict
+	err := m.DB.Preload("Role").Preload("ConflictingRole").First(&conflict, id).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &conflict, nil
+}
+
+func (m RoleConflictModel) Delete(c *RoleConflict) error {
+	return m.DB.Delete(c).Error
+}
+
+// FindConflicts returns the conflicts between the given roles and the roles
+// they inherit from.
+func (m RoleConflictModel) FindConflicts(roleIDs []int64) ([]RoleConflict, error) {
+	conflicts := make([]RoleConflict, 0)
+	if len(roleIDs) == 0 {
+		return conflicts, nil
+	}
+
+	h, err := loadRoleHierarchy(m.DB)
+	if err != nil {
+		return nil, err
+	}
+	ids := h.withAncestors(roleIDs).ids()
+	if len(ids) < 2 {
+		return conflicts, nil
+	}
+
+	err = m.DB.Preload("Role").Preload("ConflictingRole").
+		Where("role_id IN ? and conflicting_role_id IN ?", ids, ids).
+		Order("id").
+		Find(&conflicts).Error
+	if err != nil {
+		return nil, err
+	}
+	return conflicts, nil
+}
+
+// Violations returns every user who already holds both roles of a conflict,
+// directly or through inheritance. Roles held in an organization count
+// together with the global roles of the user.
+func (m RoleConflictModel) Violations() ([]Violation, error) {
+	conflicts, err := m.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	violations := make([]Violation, 0)
+	if len(conflicts) == 0 {
+		return violations, nil
+	}
+
+	h, err := loadRoleHierarchy(m.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	var userRoles []UserRole
+	if err := m.DB.Order("user_id").Find(&userRoles).Error; err != nil {
+		return nil, err
+	}
+	var users []int64
+	heldByUser := make(map[int64][]int64)
+	for _, row := range userRoles {
+		if heldByUser[row.UserID] == nil {
+			users = append(users, row.UserID)
+		}
+		heldByUser[row.UserID] = append(heldByUser[row.UserID], row.RoleID)
+	}
+
+	var members []Membership
+	if err := m.DB.Preload("Roles").Order("user_id").Order("organization_id").Find(&members).Error; err != nil {
+		return nil, err
+	}
+
+	for _, c := range conflicts {
+		for _, id := range users {
+			if h.withAncestors(heldByUser[id]).holdsBoth(c) {
+				violations = append(violations, Violation{UserID: id, Conflict: c})
+			}
+		}
+		for _, ms := range members {
+			if h.membershipViolates(heldByUser[ms.UserID], roleIDs(ms.Roles), c) {
+				organizationID := ms.OrganizationID
+				violations = append(violations, Violation{UserID: ms.UserID, OrganizationID: &organizationID, Conflict: c})
+			}
+		}
+	}
+	return violations, nil
+}
+
+// loadRoleHierarchy loads the parents of every role.
+func loadRoleHierarchy(db *gorm.DB) (roleHierarchy, error) {
+	var rows []struct {
+		RoleID   int64
+		ParentID int64
+	}
+	if err := db.Table("roles_parents").Select("role_id, parent_id").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	h := make(roleHierarchy)
+	for _, row := range rows {
+		h[row.RoleID] = append(h[row.RoleID], row.ParentID)
+	}
+	return h, nil
+}
+
+// roleHierarchy maps a role id to the ids of its parents.
+type roleHierarchy map[int64][]int64
+
+// membershipViolates reports whether the roles of a membership, held
+// together with the global roles of the user, break c. A conflict the
+// global roles break on their own is reported once without an organization
+// instead of for every membership.
+func (h roleHierarchy) membershipViolates(global, member []int64, c RoleConflict) bool {
+	if h.withAncestors(global).holdsBoth(c) {
+		return false
+	}
+	var held []int64
+	held = append(held, global...)
+	held = append(held, member...)
+	return h.withAncestors(held).holdsBoth(c)
+}
+
+// withAncestors returns the roles together with every role they inherit
+// from.
+func (h roleHierarchy) withAncestors(roleIDs []int64) roleSet {
+	set := make(roleSet)
+	frontier := roleIDs
+	for len(frontier) > 0 {
+		var next []int64
+		for _, id := range frontier {
+			if set[id] {
+				continue
+			}
+			set[id] = true
+			next = append(next, h[id]...)
+		}
+		frontier = next
+	}
+	return set
+}
+
+type roleSet map[int64]bool
+
+func (s roleSet) holdsBoth(c RoleConflict) bool {
+	return s[c.RoleID] && s[c.ConflictingRoleID]
+}
+
+func (s roleSet) ids() []int64 {
+	ids := make([]int64, 0, len(s))
+	for id := range s {
+		ids = append(ids, id)
+	}
+	return sortedIDs(ids)
+}
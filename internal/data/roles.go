@@ -6,11 +6,54 @@ import (
 	"gorm.io/gorm"
 )
 
+var (
+	ErrRoleCycle = errors.New("role hierarchy cycle")
+)
+
 type Role struct {
 	CoreModel
-	Name        string       `json:"name" gorm:"uniqueIndex;not null"`
-	Permissions []Permission `json:"permissions,omitempty" gorm:"many2many:roles_permissions;constraint:OnDelete:CASCADE"`
-	Users       []User       `json:"roles,omitempty" gorm:"many2many:users_roles;constraint:OnDelete:CASCADE"`
+	Name                 string       `json:"name" gorm:"not null"`
+	Permissions          []Permission `json:"permissions,omitempty" gorm:"many2many:roles_permissions;constraint:OnDelete:CASCADE"`
+	Parents              []Role       `json:"parents,omitempty" gorm:"many2many:roles_parents;joinForeignKey:RoleID;joinReferences:ParentID;constraint:OnDelete:CASCADE"`
+	InheritedPermissions []Permission `json:"inherited_permissions,omitempty" gorm:"-"`
+	Bundles              []Bundle     `json:"bundles,omitempty" gorm:"many2many:roles_bundles;constraint:OnDelete:CASCADE"`
+	Users                []User       `json:"roles,omitempty" gorm:"many2many:users_roles;constraint:OnDelete:CASCADE"`
+	// OrganizationID is nil for global roles, which can also be used as
+	// templates in any organization, and set for organization local roles.
+	OrganizationID *int64 `json:"organization_id,omitempty" gorm:"index"`
+	// RequiresApproval makes grants of the role wait for a second admin.
+	RequiresApproval bool `json:"requires_approval" gorm:"default:false;not null"`
+	// ManagedRoles and ManagedPermissions make holders of the role managers
+	// who can grant and revoke them without being admins.
+	ManagedRoles       []Role       `json:"managed_roles,omitempty" gorm:"many2many:roles_managed_roles;joinForeignKey:RoleID;joinReferences:ManagedRoleID;constraint:OnDelete:CASCADE"`
+	ManagedPermissions []Permission `json:"managed_permissions,omitempty" gorm:"many2many:roles_managed_permissions;constraint:OnDelete:CASCADE"`
+}
+
+// RolePermission is the join between roles and permissions, it can carry
+// conditions under which the role grants the permission.
+type RolePermission struct {
+	RoleID       int64      `json:"role_id" gorm:"primaryKey"`
+	PermissionID int64      `json:"permission_id" gorm:"primaryKey"`
+	Conditions   Conditions `json:"conditions" gorm:"type:text"`
+}
+
+func (RolePermission) TableName() string {
+	return "roles_permissions"
+}
+
+// AvailableIn reports whether the role can be held in the organization.
+func (r *Role) AvailableIn(organizationID int64) bool {
+	return r.OrganizationID == nil || *r.OrganizationID == organizationID
+}
+
+// AllPermissions returns the direct, bundled and inherited permissions of
+// the role.
+func (r *Role) AllPermissions() []Permission {
+	var result []Permission
+	result = append(result, r.Permissions...)
+	result = append(result, BundlePermissions(r.Bundles)...)
+	result = append(result, r.InheritedPermissions...)
+	return result
 }
 
 type RoleModel struct {
@@ -31,7 +74,7 @@ func (m RoleModel) GetAll(p *Paginate) ([]*Role, Metadata, error) {
 
 func (m RoleModel) GetByID(id int64) (*Role, error) {
 	var role Role
-	err := m.DB.Preload("Permissions").Where("id=?", id).First(&role).Error
+	err := m.DB.Preload("Permissions").Preload("Bundles.Permissions").Preload("Parents").Preload("ManagedRoles").Preload("ManagedPermissions").Where("id=?", id).First(&role).Error
 	if err != nil {
 		switch {
 		case errors.Is(err, gorm.ErrRecordNotFound):
@@ -41,12 +84,20 @@ func (m RoleModel) GetByID(id int64) (*Role, error) {
 		}
 	}
 
+	if err := m.attachConditions(&role); err != nil {
+		return nil, err
+	}
+	if err := m.LoadInheritedPermissions(&role); err != nil {
+		return nil, err
+	}
 	return &role, nil
 }
 
+// GetByName returns the global role with the name, organizations may have
+// local roles with the same name.
 func (m RoleModel) GetByName(name string) (*Role, error) {
 	var role Role
-	if err := m.DB.Preload("Permissions").Where("name = ?", name).First(&role).Error; err != nil {
+	if err := m.DB.Preload("Permissions").Preload("Bundles.Permissions").Preload("Parents").Where("name = ? and organization_id is null", name).First(&role).Error; err != nil {
 		switch {
 		case errors.Is(err, gorm.ErrRecordNotFound):
 			return nil, ErrRecordNotFound
@@ -54,10 +105,21 @@ func (m RoleModel) GetByName(name string) (*Role, error) {
 			return nil, err
 		}
 	}
+
+	if err := m.attachConditions(&role); err != nil {
+		return nil, err
+	}
+	if err := m.LoadInheritedPermissions(&role); err != nil {
+		return nil, err
+	}
 	return &role, nil
 }
 
 func (m RoleModel) Insert(r *Role) error {
+	if err := m.checkCycle(r); err != nil {
+		return err
+	}
+
 	err := m.DB.Create(r).Error
 	if err != nil {
 		switch {
@@ -74,8 +136,203 @@ func (m RoleModel) Delete(r *Role) error {
 	return m.DB.Delete(r).Error
 }
 
+// Update writes the role with its permissions, parents and bundles in one
+// transaction, a failed save leaves the associations as they were.
 func (m RoleModel) Update(r *Role) error {
-	err := m.DB.Model(r).Association("Permissions").Replace(r.Permissions)
-	err = m.DB.Save(r).Error
-	return err
+	err := m.DB.Transaction(func(tx *gorm.DB) error {
+		if err := (RoleModel{DB: tx}).checkCycle(r); err != nil {
+			return err
+		}
+
+		if err := tx.Model(r).Association("Permissions").Replace(r.Permissions); err != nil {
+			return err
+		}
+		if err := tx.Model(r).Association("Parents").Replace(r.Parents); err != nil {
+			return err
+		}
+		if err := tx.Model(r).Association("Bundles").Replace(r.Bundles); err != nil {
+			return err
+		}
+		return tx.Save(r).Error
+	})
+	if err != nil {
+		switch {
+		case IsDuplicateRecord(err):
+			return ErrDuplicateRecord
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// SetManaged replaces the roles and permissions that holders of r manage.
+func (m RoleModel) SetManaged(r *Role, roles []Role, permissions []Permission) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(r).Association("ManagedRoles").Replace(roles); err != nil {
+			return err
+		}
+		if err := tx.Model(r).Association("ManagedPermissions").Replace(permissions); err != nil {
+			return err
+		}
+		r.ManagedRoles = roles
+		r.ManagedPermissions = permissions
+		return nil
+	})
+}
+
+// ManagedBy returns the ids of the roles and permissions managed by any of
+// the given roles or the roles they inherit from.
+func (m RoleModel) ManagedBy(roleIDs []int64) (managedRoleIDs []int64, managedPermissionIDs []int64, err error) {
+	if len(roleIDs) == 0 {
+		return nil, nil, nil
+	}
+
+	h, err := loadRoleHierarchy(m.DB)
+	if err != nil {
+		return nil, nil, err
+	}
+	roleIDs = h.withAncestors(roleIDs).ids()
+
+	err = m.DB.Table("roles_managed_roles").Distinct().Where("role_id IN ?", roleIDs).Pluck("managed_role_id", &managedRoleIDs).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	err = m.DB.Table("roles_managed_permissions").Distinct().Where("role_id IN ?", roleIDs).Pluck("permission_id", &managedPermissionIDs).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	return managedRoleIDs, managedPermissionIDs, nil
+}
+
+// LoadInheritedPermissions fills r.InheritedPermissions with the permissions of
+// every ancestor of r, bundled ones included, skipping the ones r already has
+// directly. r.Parents must be loaded.
+func (m RoleModel) LoadInheritedPermissions(r *Role) error {
+	ancestors, err := m.ancestors(r.Parents)
+	if err != nil {
+		return err
+	}
+
+	inherited := make([]Permission, 0)
+	for _, ancestor := range ancestors {
+		for _, p := range ancestor.AllPermissions() {
+			if containsUnconditionalPermission(r.Permissions, p.ID) || containsUnconditionalPermission(inherited, p.ID) {
+				continue
+			}
+			inherited = append(inherited, p)
+		}
+	}
+	r.InheritedPermissions = inherited
+	return nil
+}
+
+// ancestors walks the hierarchy upwards starting from parents (inclusive) and
+// returns every reachable role once, with its permissions loaded.
+func (m RoleModel) ancestors(parents []Role) ([]Role, error) {
+	var result []Role
+	seen := make(map[int64]bool)
+
+	var frontier []int64
+	for _, p := range parents {
+		frontier = append(frontier, p.ID)
+	}
+
+	for len(frontier) > 0 {
+		var roles []Role
+		err := m.DB.Preload("Permissions").Preload("Bundles.Permissions").Preload("Parents").Where("id IN ?", frontier).Find(&roles).Error
+		if err != nil {
+			return nil, err
+		}
+		for i := range roles {
+			if err := m.attachConditions(&roles[i]); err != nil {
+				return nil, err
+			}
+		}
+
+		frontier = nil
+		for _, role := range roles {
+			if seen[role.ID] {
+				continue
+			}
+			seen[role.ID] = true
+			result = append(result, role)
+
+			for _, parent := range role.Parents {
+				if !seen[parent.ID] {
+					frontier = append(frontier, parent.ID)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// checkCycle returns ErrRoleCycle if r would become its own ancestor.
+func (m RoleModel) checkCycle(r *Role) error {
+	if r.ID == 0 {
+		// a role that is not persisted yet can not be anyone's parent.
+		return nil
+	}
+
+	ancestors, err := m.ancestors(r.Parents)
+	if err != nil {
+		return err
+	}
+	for _, ancestor := range ancestors {
+		if ancestor.ID == r.ID {
+			return ErrRoleCycle
+		}
+	}
+	return nil
+}
+
+// SetPermissionConditions replaces the conditions under which the role grants
+// the permission, the permission must already belong to the role.
+func (m RoleModel) SetPermissionConditions(roleID, permissionID int64, c Conditions) error {
+	result := m.DB.Model(&RolePermission{}).
+		Where("role_id = ? and permission_id = ?", roleID, permissionID).
+		Update("conditions", c)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// attachConditions sets Conditions on the loaded permissions of the roles
+// that grant them conditionally.
+func (m RoleModel) attachConditions(roles ...*Role) error {
+	var ids []int64
+	for _, r := range roles {
+		ids = append(ids, r.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var rows []RolePermission
+	err := m.DB.Where("role_id IN ? and conditions IS NOT NULL", ids).Find(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	type key struct{ roleID, permissionID int64 }
+	conditions := make(map[key]Conditions)
+	for _, row := range rows {
+		if !row.Conditions.IsZero() {
+			conditions[key{row.RoleID, row.PermissionID}] = row.Conditions
+		}
+	}
+
+	for _, r := range roles {
+		for i := range r.Permissions {
+			if c, ok := conditions[key{r.ID, r.Permissions[i].ID}]; ok {
+				r.Permissions[i].Conditions = &c
+			}
+		}
+	}
+	return nil
 }
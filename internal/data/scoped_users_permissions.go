@@ -0,0 +1,66 @@
+package data
+
+import (
+	"gorm.io/gorm"
+)
+
+// ScopedUserPermission grants a permission to a user on a single resource
+// only, e.g. user 42 may "orders:write" on store 7.
+type ScopedUserPermission struct {
+	CoreModel
+	UserID       int64      `json:"user_id" gorm:"not null;uniqueIndex:idx_scoped_users_permissions"`
+	PermissionID int64      `json:"permission_id" gorm:"not null;uniqueIndex:idx_scoped_users_permissions"`
+	Permission   Permission `json:"permission,omitempty" gorm:"constraint:OnDelete:CASCADE"`
+	ResourceType string     `json:"resource_type" gorm:"not null;uniqueIndex:idx_scoped_users_permissions"`
+	ResourceID   int64      `json:"resource_id" gorm:"not null;uniqueIndex:idx_scoped_users_permissions"`
+}
+
+func (ScopedUserPermission) TableName() string {
+	return "scoped_users_permissions"
+}
+
+// ScopedPermissionsFor returns the permissions in list that are granted on
+// the given resource.
+func ScopedPermissionsFor(list []ScopedUserPermission, resourceType string, resourceID int64) []Permission {
+	var result []Permission
+	for _, v := range list {
+		if v.ResourceType == resourceType && v.ResourceID == resourceID {
+			result = append(result, v.Permission)
+		}
+	}
+	return result
+}
+
+type ScopedPermissionModel struct {
+	DB *gorm.DB
+}
+
+func (m ScopedPermissionModel) Insert(s *ScopedUserPermission) error {
+	err := m.DB.Create(s).Error
+	if err != nil {
+		switch {
+		case IsDuplicateRecord(err):
+			return ErrDuplicateRecord
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the grant of permissionID to userID on the given resource.
+func (m ScopedPermissionModel) Delete(userID, permissionID int64, resourceType string, resourceID int64) error {
+	return m.DB.
+		Where("user_id = ? and permission_id = ? and resource_type = ? and resource_id = ?",
+			userID, permissionID, resourceType, resourceID).
+		Delete(&ScopedUserPermission{}).Error
+}
+
+func (m ScopedPermissionModel) GetAllForUser(userID int64) ([]ScopedUserPermission, error) {
+	scoped := make([]ScopedUserPermission, 0)
+	err := m.DB.Preload("Permission").Where("user_id = ?", userID).Find(&scoped).Error
+	if err != nil {
+		return nil, err
+	}
+	return scoped, nil
+}
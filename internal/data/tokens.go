@@ -1,9 +1,11 @@
 package data
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"gorm.io/gorm"
@@ -12,18 +14,44 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
 )
 
+// ErrTokenReused is returned when a refresh token is used after it was
+// rotated, the whole token family is revoked by then.
+var ErrTokenReused = errors.New("refresh token reused")
+
 type Token struct {
 	CoreModel
 	Hash      []byte    `json:"-"`
-	Plaintext string    `json:"token" gorm:"-"`
+	Plaintext string    `json:"token,omitempty" gorm:"-"`
 	Scope     string    `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	UserID    int64     `json:"user_id"`
+	TokenMetadata
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RotatedAt  *time.Time `json:"-"`
 	//User      User      `json:"user,omitempty"`
 }
 
+// TokenMetadata describes the client a token was issued to, it is captured
+// at login so users can tell their sessions apart. Family links the access
+// and refresh tokens issued for one login, it is kept when they are rotated.
+type TokenMetadata struct {
+	IP          string `json:"ip"`
+	UserAgent   string `json:"user_agent"`
+	DeviceLabel string `json:"device_label"`
+	Family      string `json:"-"`
+}
+
+// HashToken returns the hash of the plaintext token that is stored.
+func HashToken(plaintext string) []byte {
+	// one way hash with no salt, user will send plain token...
+	hash := sha256.Sum256([]byte(plaintext))
+	return hash[:]
+}
+
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token := &Token{
 		UserID: userID,
@@ -31,17 +59,39 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 		Scope:  scope,
 	}
 
+	plaintext, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+
+	token.Plaintext = plaintext
+	token.Hash = HashToken(token.Plaintext)
+
+	return token, nil
+}
+
+// randomString returns 16 random bytes encoded with base32, e.g.
+// Y3QMGX3PJ3WLRL2YRTQGQ6KRHU.
+func randomString() (string, error) {
 	b := make([]byte, 16)
 	if _, err := rand.Read(b); err != nil {
-		return nil, err
+		return "", err
 	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
 
-	// example plain token: Y3QMGX3PJ3WLRL2YRTQGQ6KRHU
-	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+func generateTokenWithMetadata(userID int64, ttl time.Duration, scope string, md TokenMetadata) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
 
-	// one way hash with no salt, user will send plain token...
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	if md.Family == "" {
+		if md.Family, err = randomString(); err != nil {
+			return nil, err
+		}
+	}
+	token.TokenMetadata = md
 
 	return token, nil
 }
@@ -55,7 +105,13 @@ func (m TokenModel) Insert(token *Token) error {
 }
 
 func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
-	token, err := generateToken(userID, ttl, scope)
+	return m.NewWithMetadata(userID, ttl, scope, TokenMetadata{})
+}
+
+// NewWithMetadata creates a token with the metadata, a token without a family
+// starts a new one.
+func (m TokenModel) NewWithMetadata(userID int64, ttl time.Duration, scope string, md TokenMetadata) (*Token, error) {
+	token, err := generateTokenWithMetadata(userID, ttl, scope, md)
 	if err != nil {
 		return nil, err
 	}
@@ -63,3 +119,114 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	err = m.Insert(token)
 	return token, err
 }
+
+// GetAllForUser returns the unexpired and not rotated tokens of the user in
+// the scope, oldest first.
+func (m TokenModel) GetAllForUser(scope string, userID int64) ([]Token, error) {
+	var tokens []Token
+	err := m.DB.Where("scope = ? and user_id = ? and expiry > ? and rotated_at is null", scope, userID, time.Now()).Order("id").Find(&tokens).Error
+	return tokens, err
+}
+
+// DeleteAllForUser removes every token of the user in the scope.
+func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+	return m.DB.Where("scope = ? and user_id = ?", scope, userID).Delete(&Token{}).Error
+}
+
+// DeleteForUser removes a token of the user in the scope by id, together
+// with the rest of its family so the session cannot be refreshed.
+func (m TokenModel) DeleteForUser(scope string, userID, id int64) error {
+	var token Token
+	err := m.DB.Where("scope = ? and user_id = ?", scope, userID).First(&token, id).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return m.DB.Where("family = ?", token.Family).Delete(&Token{}).Error
+}
+
+// DeleteForToken removes the token with the plaintext in the scope, together
+// with the rest of its family.
+func (m TokenModel) DeleteForToken(scope string, tokenPlaintext string) error {
+	var token Token
+	err := m.DB.Where("hash = ? and scope = ?", HashToken(tokenPlaintext), scope).First(&token).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil
+		default:
+			return err
+		}
+	}
+	return m.DB.Where("family = ?", token.Family).Delete(&Token{}).Error
+}
+
+// Rotate consumes an unexpired refresh token and returns it, its user and
+// metadata are used to issue the next tokens of the family. A token that was
+// rotated before is a sign that it leaked, the family is revoked and
+// ErrTokenReused returned along with the token.
+func (m TokenModel) Rotate(tokenPlaintext string) (*Token, error) {
+	var token Token
+	reused := false
+
+	err := m.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("hash = ? and scope = ? and expiry > ?", HashToken(tokenPlaintext), ScopeRefresh, time.Now()).First(&token).Error
+		if err != nil {
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+
+		if token.RotatedAt == nil {
+			// the condition on rotated_at lets only one of concurrent
+			// requests with the same token through.
+			res := tx.Model(&Token{}).Where("id = ? and rotated_at is null", token.ID).UpdateColumn("rotated_at", time.Now())
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 1 {
+				return nil
+			}
+		}
+
+		reused = true
+		return tx.Where("family = ?", token.Family).Delete(&Token{}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return &token, ErrTokenReused
+	}
+	return &token, nil
+}
+
+// UpdateLastUsed sets the last used time of the token families of the
+// tokens, keyed by token hash, in one transaction.
+func (m TokenModel) UpdateLastUsed(lastUsed map[string]time.Time) error {
+	if len(lastUsed) == 0 {
+		return nil
+	}
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		for hash, usedAt := range lastUsed {
+			family := tx.Model(&Token{}).Select("family").Where("hash = ?", []byte(hash))
+			err := tx.Model(&Token{}).Where("family = (?)", family).UpdateColumn("last_used_at", usedAt).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Matches reports whether the plaintext is the token.
+func (t *Token) Matches(plaintext string) bool {
+	return bytes.Equal(t.Hash, HashToken(plaintext))
+}
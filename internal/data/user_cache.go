@@ -0,0 +1,142 @@
+package data
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// UserCache keeps users resolved by GetForToken in memory, keyed by token
+// hash. Entries expire after a ttl, and the least recently used entry is
+// evicted when the cache is full.
+type UserCache struct {
+	mu     sync.Mutex
+	size   int
+	ttl    time.Duration
+	ll     *list.List
+	items  map[string]*list.Element
+	byUser map[int64]map[string]bool
+}
+
+type userCacheEntry struct {
+	key    string
+	user   *User
+	expiry time.Time
+}
+
+func NewUserCache(size int, ttl time.Duration) *UserCache {
+	return &UserCache{
+		size:   size,
+		ttl:    ttl,
+		ll:     list.New(),
+		items:  make(map[string]*list.Element),
+		byUser: make(map[int64]map[string]bool),
+	}
+}
+
+// Get returns a copy of the cached user. The user and its slices are copied,
+// so callers can set fields and append to or reorder the slices, but the
+// roles, permissions and bundles in them are shared with other requests and
+// must be treated as read-only.
+func (c *UserCache) Get(key string) (*User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := el.Value.(*userCacheEntry)
+	if !time.Now().Before(entry.expiry) {
+		c.remove(el)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	return entry.user.clone(), true
+}
+
+// Set caches a copy of the user until the ttl passes or expiry, whichever is
+// sooner.
+func (c *UserCache) Set(key string, user *User, expiry time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ttlExpiry := time.Now().Add(c.ttl); ttlExpiry.Before(expiry) {
+		expiry = ttlExpiry
+	}
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+
+	entry := &userCacheEntry{key: key, user: user.clone(), expiry: expiry}
+	c.items[key] = c.ll.PushFront(entry)
+	if c.byUser[user.ID] == nil {
+		c.byUser[user.ID] = make(map[string]bool)
+	}
+	c.byUser[user.ID][key] = true
+
+	for c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+	}
+}
+
+// Delete removes a single token from the cache.
+func (c *UserCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+// InvalidateUser removes every cached token of the user.
+func (c *UserCache) InvalidateUser(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.byUser[userID] {
+		c.remove(c.items[key])
+	}
+}
+
+// Purge removes everything, it is used when a change may affect any user,
+// e.g. a role or a permission is updated.
+func (c *UserCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.byUser = make(map[int64]map[string]bool)
+}
+
+func (c *UserCache) remove(el *list.Element) {
+	entry := el.Value.(*userCacheEntry)
+	c.ll.Remove(el)
+	delete(c.items, entry.key)
+
+	keys := c.byUser[entry.user.ID]
+	delete(keys, entry.key)
+	if len(keys) == 0 {
+		delete(c.byUser, entry.user.ID)
+	}
+}
+
+// clone copies the user and its slices, the elements are not copied.
+func (u *User) clone() *User {
+	c := *u
+	c.Tokens = append([]Token(nil), u.Tokens...)
+	c.Roles = append([]Role(nil), u.Roles...)
+	c.GrantedPermissions = append([]Permission(nil), u.GrantedPermissions...)
+	c.RevokedPermissions = append([]Permission(nil), u.RevokedPermissions...)
+	c.ScopedPermissions = append([]ScopedUserPermission(nil), u.ScopedPermissions...)
+	c.Elevations = append([]Elevation(nil), u.Elevations...)
+	c.Bundles = append([]Bundle(nil), u.Bundles...)
+	c.RoleGrants = append([]UserRole(nil), u.RoleGrants...)
+	c.PermissionGrants = append([]GrantedUserPermission(nil), u.PermissionGrants...)
+	return &c
+}
@@ -1,12 +1,13 @@
 package data
 
 import (
-	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var (
@@ -15,16 +16,23 @@ var (
 
 type User struct {
 	CoreModel
-	FirstName          string       `json:"first_name" gorm:"not null"`
-	LastName           string       `json:"last_name" gorm:"not null"`
-	Email              string       `json:"email" gorm:"uniqueIndex;not null"`
-	Password           []byte       `json:"-" gorm:"not null"`
-	IsActivated        bool         `json:"-" gorm:"default:false;not null"`
-	IsAdmin            bool         `json:"-" gorm:"default:false;not null"`
-	Tokens             []Token      `json:"tokens,omitempty" gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
-	Roles              []Role       `json:"roles,omitempty" gorm:"many2many:users_roles;constraint:OnDelete:CASCADE"`
-	GrantedPermissions []Permission `json:"granted_permissions,omitempty" gorm:"many2many:granted_users_permissions"`
-	RevokedPermissions []Permission `json:"revoked_permissions,omitempty" gorm:"many2many:revoked_users_permissions"`
+	FirstName          string                 `json:"first_name" gorm:"not null"`
+	LastName           string                 `json:"last_name" gorm:"not null"`
+	Email              string                 `json:"email" gorm:"uniqueIndex;not null"`
+	Password           []byte                 `json:"-" gorm:"not null"`
+	IsActivated        bool                   `json:"-" gorm:"default:false;not null"`
+	IsAdmin            bool                   `json:"-" gorm:"default:false;not null"`
+	Tokens             []Token                `json:"tokens,omitempty" gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	Roles              []Role                 `json:"roles,omitempty" gorm:"many2many:users_roles;constraint:OnDelete:CASCADE"`
+	GrantedPermissions []Permission           `json:"granted_permissions,omitempty" gorm:"many2many:granted_users_permissions;constraint:OnDelete:CASCADE"`
+	RevokedPermissions []Permission           `json:"revoked_permissions,omitempty" gorm:"many2many:revoked_users_permissions;constraint:OnDelete:CASCADE"`
+	ScopedPermissions  []ScopedUserPermission `json:"scoped_permissions,omitempty" gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	Elevations         []Elevation            `json:"elevations,omitempty" gorm:"foreignKey:UserID;constraint:OnDelete:SET NULL"`
+	Bundles            []Bundle               `json:"bundles,omitempty" gorm:"many2many:users_bundles;constraint:OnDelete:CASCADE"`
+	// RoleGrants and PermissionGrants hold the time windows of the roles and
+	// the granted permissions above.
+	RoleGrants       []UserRole              `json:"role_grants,omitempty" gorm:"-"`
+	PermissionGrants []GrantedUserPermission `json:"permission_grants,omitempty" gorm:"-"`
 }
 
 //Permissions []Permission `json:"permissions,omitempty" gorm:"many2many:users_permissions"`
@@ -57,6 +65,24 @@ func (u *User) ComparePassword(plain string) (bool, error) {
 
 type UserModel struct {
 	DB *gorm.DB
+	// Cache is optional, when set GetForToken results are cached.
+	Cache *UserCache
+}
+
+// InvalidateCache drops the cached tokens of the user, it must be called
+// after anything that affects the access of the user changes.
+func (m UserModel) InvalidateCache(userID int64) {
+	if m.Cache != nil {
+		m.Cache.InvalidateUser(userID)
+	}
+}
+
+// PurgeCache drops every cached user, it must be called after a change that
+// may affect the access of any user.
+func (m UserModel) PurgeCache() {
+	if m.Cache != nil {
+		m.Cache.Purge()
+	}
 }
 
 func (m UserModel) Insert(u *User) error {
@@ -71,8 +97,29 @@ func (m UserModel) Insert(u *User) error {
 	return nil
 }
 
+// InsertWithToken inserts the user and a new token of it in one
+// transaction, e.g. a registration and its activation token.
+func (m UserModel) InsertWithToken(u *User, ttl time.Duration, scope string) (*Token, error) {
+	var token *Token
+	err := m.DB.Transaction(func(tx *gorm.DB) error {
+		if err := (UserModel{DB: tx}).Insert(u); err != nil {
+			return err
+		}
+		var err error
+		token, err = TokenModel{DB: tx}.New(u.ID, ttl, scope)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Update writes the non-zero columns of u. The associations are left alone,
+// they have their own update methods, otherwise saving a user loaded for
+// access checks would write back whatever its associations hold.
 func (m UserModel) Update(u *User) error {
-	return m.DB.Model(u).Updates(u).Error
+	return m.DB.Model(u).Omit(clause.Associations).Updates(u).Error
 }
 
 func (m UserModel) UpdateGrantedPermissions(u *User) error {
@@ -90,6 +137,10 @@ func (m UserModel) UpdateRevokedPermissions(u *User) error {
 	return nil
 }
 
+func (m UserModel) UpdateBundles(u *User) error {
+	return m.DB.Model(u).Association("Bundles").Replace(u.Bundles)
+}
+
 func (m UserModel) UpdateRoles(u *User) error {
 	err := m.DB.Model(u).Association("Roles").Replace(u.Roles)
 	if err != nil {
@@ -121,6 +172,8 @@ func (m UserModel) GetByIDWithRolesAndPermissions(id int64) (*User, error) {
 		Preload("Roles").
 		Preload("GrantedPermissions").
 		Preload("RevokedPermissions").
+		Preload("ScopedPermissions.Permission").
+		Preload("Bundles.Permissions").
 		First(&user, id).Error; err != nil {
 		switch {
 		case errors.Is(err, gorm.ErrRecordNotFound):
@@ -129,6 +182,10 @@ func (m UserModel) GetByIDWithRolesAndPermissions(id int64) (*User, error) {
 			return nil, err
 		}
 	}
+
+	if err := m.loadGrants(&user); err != nil {
+		return nil, err
+	}
 	return &user, nil
 }
 
@@ -146,8 +203,14 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 }
 
 func (m UserModel) GetForToken(scope string, tokenPlaintext string) (*User, error) {
-	sizedTokenHash := sha256.Sum256([]byte(tokenPlaintext))
-	tokenHash := sizedTokenHash[:]
+	tokenHash := HashToken(tokenPlaintext)
+	cacheKey := tokenCacheKey(scope, tokenHash)
+
+	if m.Cache != nil {
+		if user, ok := m.Cache.Get(cacheKey); ok {
+			return user, nil
+		}
+	}
 
 	var token Token
 	err := m.DB.Where("hash=? and scope=? and expiry > ?", tokenHash, scope, time.Now()).First(&token).Error
@@ -160,12 +223,76 @@ func (m UserModel) GetForToken(scope string, tokenPlaintext string) (*User, erro
 		}
 	}
 
+	user, err := m.GetByIDWithAccess(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Cache != nil {
+		// keep the cached user only as long as nothing changes on its own.
+		expiry := token.Expiry
+		if next := user.nextGrantChange(time.Now()); next != nil && next.Before(expiry) {
+			expiry = *next
+		}
+		m.Cache.Set(cacheKey, user, expiry)
+	}
+
+	return user, nil
+}
+
+// GetByIDWithAccess returns the user with everything needed to make access
+// decisions: roles with their direct, bundled and inherited permissions, the
+// custom granted, revoked and scoped permissions, the bundles of the user,
+// and the active elevations. Elevated roles are not added to Roles, which
+// only holds the granted ones, access decisions use EffectiveRoles.
+func (m UserModel) GetByIDWithAccess(id int64) (*User, error) {
+	now := time.Now()
+
 	var user User
-	err = m.DB.Where("id=?", token.UserID).
+	err := m.DB.Where("id=?", id).
 		Preload("Roles.Permissions").
+		Preload("Roles.Bundles.Permissions").
+		Preload("Roles.Parents").
 		Preload("GrantedPermissions").
 		Preload("RevokedPermissions").
+		Preload("ScopedPermissions.Permission").
+		Preload("Bundles.Permissions").
+		Preload("Elevations", "expires_at > ? AND role_id IS NOT NULL", now).
+		Preload("Elevations.Role.Permissions").
+		Preload("Elevations.Role.Bundles.Permissions").
+		Preload("Elevations.Role.Parents").
 		First(&user).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if err := m.loadGrants(&user); err != nil {
+		return nil, err
+	}
+	dropInactiveGrants(&user, now)
+
+	var toResolve []*Role
+	for i := range user.Roles {
+		toResolve = append(toResolve, &user.Roles[i])
+	}
+	for i := range user.Elevations {
+		toResolve = append(toResolve, user.Elevations[i].Role)
+	}
+
+	roles := RoleModel{DB: m.DB}
+	for _, role := range toResolve {
+		if err := roles.attachConditions(role); err != nil {
+			return nil, err
+		}
+		if err := roles.LoadInheritedPermissions(role); err != nil {
+			return nil, err
+		}
+	}
 
 	return &user, nil
 }
@@ -182,3 +309,197 @@ func (m UserModel) GetAll(p *Paginate) ([]*User, Metadata, error) {
 	metadata := CalculateMetadata(p, int(total))
 	return users, metadata, nil
 }
+
+// GrantRoles adds the roles to the user with the window, in one statement.
+// A grant without a window is permanent, granting again replaces the window.
+func (m UserModel) GrantRoles(userID int64, roleIDs []int64, w GrantWindow) error {
+	return grantRoles(m.DB, userID, roleIDs, w)
+}
+
+// GrantPermissions adds the permissions to the custom granted permissions of
+// the user with the window and takes them out of the revoked ones, in one
+// transaction. Granting again replaces the window.
+func (m UserModel) GrantPermissions(userID int64, permissionIDs []int64, w GrantWindow) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		return grantPermissions(tx, userID, permissionIDs, w)
+	})
+}
+
+// grantRoles upserts the users_roles rows together with their window, so a
+// grant is never visible without it.
+func grantRoles(tx *gorm.DB, userID int64, roleIDs []int64, w GrantWindow) error {
+	if len(roleIDs) == 0 {
+		return nil
+	}
+
+	rows := make([]UserRole, 0, len(roleIDs))
+	for _, id := range roleIDs {
+		rows = append(rows, UserRole{UserID: userID, RoleID: id, GrantWindow: w})
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "role_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"starts_at", "expires_at"}),
+	}).Create(&rows).Error
+}
+
+func grantPermissions(tx *gorm.DB, userID int64, permissionIDs []int64, w GrantWindow) error {
+	if len(permissionIDs) == 0 {
+		return nil
+	}
+
+	rows := make([]GrantedUserPermission, 0, len(permissionIDs))
+	for _, id := range permissionIDs {
+		rows = append(rows, GrantedUserPermission{UserID: userID, PermissionID: id, GrantWindow: w})
+	}
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "permission_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"starts_at", "expires_at"}),
+	}).Create(&rows).Error
+	if err != nil {
+		return err
+	}
+	return tx.Exec("DELETE FROM revoked_users_permissions WHERE user_id = ? AND permission_id IN ?", userID, permissionIDs).Error
+}
+
+// DeleteExpiredGrants removes role and custom permission grants that have
+// expired, it returns the number of removed grants.
+func (m UserModel) DeleteExpiredGrants() (int64, error) {
+	now := time.Now()
+
+	result := m.DB.Where("expires_at <= ?", now).Delete(&UserRole{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	total := result.RowsAffected
+
+	result = m.DB.Where("expires_at <= ?", now).Delete(&GrantedUserPermission{})
+	if result.Error != nil {
+		return total, result.Error
+	}
+	return total + result.RowsAffected, nil
+}
+
+func tokenCacheKey(scope string, tokenHash []byte) string {
+	return scope + ":" + hex.EncodeToString(tokenHash)
+}
+
+// nextGrantChange returns the earliest time after now at which one of the
+// grants of the user starts or expires, or nil if there is none.
+// u.RoleGrants and u.PermissionGrants must be loaded.
+func (u *User) nextGrantChange(now time.Time) *time.Time {
+	var next *time.Time
+	consider := func(t *time.Time) {
+		if t != nil && t.After(now) && (next == nil || t.Before(*next)) {
+			next = t
+		}
+	}
+
+	for _, g := range u.RoleGrants {
+		consider(g.StartsAt)
+		consider(g.ExpiresAt)
+	}
+	for _, g := range u.PermissionGrants {
+		consider(g.StartsAt)
+		consider(g.ExpiresAt)
+	}
+	for i := range u.Elevations {
+		consider(&u.Elevations[i].ExpiresAt)
+	}
+	return next
+}
+
+// EffectiveRoles returns the roles of the user together with the roles of
+// the loaded elevations. Only Roles is ever written back.
+func (u *User) EffectiveRoles() []Role {
+	var result []Role
+	result = append(result, u.Roles...)
+	for _, e := range u.Elevations {
+		if e.Role != nil && !containsRoleID(result, e.Role.ID) {
+			result = append(result, *e.Role)
+		}
+	}
+	return result
+}
+
+func containsRoleID(list []Role, id int64) bool {
+	for _, v := range list {
+		if v.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (m UserModel) loadGrants(u *User) error {
+	if err := m.DB.Where("user_id = ?", u.ID).Find(&u.RoleGrants).Error; err != nil {
+		return err
+	}
+	return m.DB.Where("user_id = ?", u.ID).Find(&u.PermissionGrants).Error
+}
+
+// dropInactiveGrants removes the roles and granted permissions that are not
+// in effect at the given time. u.RoleGrants and u.PermissionGrants must be loaded.
+func dropInactiveGrants(u *User, now time.Time) {
+	activeRoles := make(map[int64]bool)
+	for _, g := range u.RoleGrants {
+		activeRoles[g.RoleID] = g.IsActive(now)
+	}
+	activePermissions := make(map[int64]bool)
+	for _, g := range u.PermissionGrants {
+		activePermissions[g.PermissionID] = g.IsActive(now)
+	}
+
+	var roles []Role
+	for _, r := range u.Roles {
+		if activeRoles[r.ID] {
+			roles = append(roles, r)
+		}
+	}
+	u.Roles = roles
+
+	var granted []Permission
+	for _, p := range u.GrantedPermissions {
+		if activePermissions[p.ID] {
+			granted = append(granted, p)
+		}
+	}
+	u.GrantedPermissions = granted
+}
+
+// StandingAccess returns a copy of the user that holds only the grants in
+// effect all the time: roles and custom grants without a time window, and
+// of those roles only the permissions without conditions. Elevations and
+// resource scoped permissions are left out, revocations still apply.
+// u.RoleGrants and u.PermissionGrants must be loaded.
+func (u *User) StandingAccess() *User {
+	standingRoles := make(map[int64]bool)
+	for _, g := range u.RoleGrants {
+		standingRoles[g.RoleID] = g.StartsAt == nil && g.ExpiresAt == nil
+	}
+	standingPermissions := make(map[int64]bool)
+	for _, g := range u.PermissionGrants {
+		standingPermissions[g.PermissionID] = g.StartsAt == nil && g.ExpiresAt == nil
+	}
+
+	user := *u
+	user.Roles = nil
+	user.Elevations = nil
+	user.ScopedPermissions = nil
+	user.GrantedPermissions = nil
+	for _, p := range u.GrantedPermissions {
+		if standingPermissions[p.ID] {
+			user.GrantedPermissions = append(user.GrantedPermissions, p)
+		}
+	}
+	for i := range u.Roles {
+		if !standingRoles[u.Roles[i].ID] {
+			continue
+		}
+		for _, p := range u.Roles[i].AllPermissions() {
+			if p.Conditions == nil {
+				user.GrantedPermissions = append(user.GrantedPermissions, p)
+			}
+		}
+	}
+	return &user
+}
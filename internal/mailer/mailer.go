@@ -0,0 +1,82 @@
+// Package mailer renders and delivers the emails of the service. Delivery is
+// behind the Mailer interface, LogMailer and FileMailer are stand-ins for
+// local use that do not send anything.
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+// Message is a rendered email.
+type Message struct {
+	To        string
+	Subject   string
+	PlainBody string
+}
+
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// Render executes the "subject" and "plainBody" templates of the template
+// file with data.
+func Render(recipient, templateFile string, data interface{}) (*Message, error) {
+	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := new(bytes.Buffer)
+	if err := tmpl.ExecuteTemplate(subject, "subject", data); err != nil {
+		return nil, err
+	}
+	plainBody := new(bytes.Buffer)
+	if err := tmpl.ExecuteTemplate(plainBody, "plainBody", data); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		To:        recipient,
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+	}, nil
+}
+
+// LogMailer writes messages to the log.
+type LogMailer struct {
+	Logger *zap.SugaredLogger
+}
+
+func (m LogMailer) Send(msg *Message) error {
+	m.Logger.Infow("email", "to", msg.To, "subject", msg.Subject, "body", msg.PlainBody)
+	return nil
+}
+
+// FileMailer writes every message to its own file in Dir.
+type FileMailer struct {
+	Dir string
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9@._-]`)
+
+func (m FileMailer) Send(msg *Message) error {
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.txt", time.Now().UTC().Format("20060102T150405.000000000"), unsafeFileChars.ReplaceAllString(msg.To, "_"))
+	content := fmt.Sprintf("To: %s\nSubject: %s\n\n%s", msg.To, msg.Subject, msg.PlainBody)
+	return os.WriteFile(filepath.Join(m.Dir, name), []byte(content), 0o600)
+}
@@ -0,0 +1,391 @@
+package migrations
+
+import (
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// The initial schema is the one gorm AutoMigrate created before versioned
+// migrations, constraint and index names included, written out as DDL.
+//
+// Databases created with AutoMigrate are adopted instead of migrated: if
+// the tables already exist, they are compared with the schema and version 1
+// is only recorded when they match. A drifted database is refused with the
+// list of differences, it has to be fixed by hand first.
+
+// Columns shared by most tables.
+var (
+	idColumn        = schemaColumn{"id", "{serial}"}
+	createdAtColumn = schemaColumn{"created_at", "{time}"}
+	updatedAtColumn = schemaColumn{"updated_at", "{time}"}
+)
+
+func foreignKey(name, column, table, onDelete string) string {
+	fk := fmt.Sprintf("CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s(id)", name, column, table)
+	if onDelete != "" {
+		fk += " ON DELETE " + onDelete
+	}
+	return fk
+}
+
+// tablesV1 is ordered so that referenced tables come first.
+var tablesV1 = []schemaTable{
+	{
+		name: "users",
+		columns: []schemaColumn{
+			idColumn, createdAtColumn, updatedAtColumn,
+			{"first_name", "{text} NOT NULL"},
+			{"last_name", "{text} NOT NULL"},
+			{"email", "{text} NOT NULL"},
+			{"password", "{bytes} NOT NULL"},
+			{"is_activated", "{bool} NOT NULL DEFAULT false"},
+			{"is_admin", "{bool} NOT NULL DEFAULT false"},
+		},
+		constraints: []string{"PRIMARY KEY (id)"},
+		indexes:     []schemaIndex{{name: "idx_users_email", unique: true, columns: []string{"email"}}},
+	},
+	{
+		name: "tokens",
+		columns: []schemaColumn{
+			idColumn, createdAtColumn, updatedAtColumn,
+			{"hash", "{bytes}"},
+			{"scope", "{text}"},
+			{"expiry", "{time}"},
+			{"user_id", "{bigint}"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (id)",
+			foreignKey("fk_users_tokens", "user_id", "users", "CASCADE"),
+		},
+	},
+	{
+		name: "organizations",
+		columns: []schemaColumn{
+			idColumn, createdAtColumn, updatedAtColumn,
+			{"name", "{text} NOT NULL"},
+		},
+		constraints: []string{"PRIMARY KEY (id)"},
+		indexes:     []schemaIndex{{name: "idx_organizations_name", unique: true, columns: []string{"name"}}},
+	},
+	{
+		name: "roles",
+		columns: []schemaColumn{
+			idColumn, createdAtColumn, updatedAtColumn,
+			{"name", "{text} NOT NULL"},
+			{"organization_id", "{bigint}"},
+			{"requires_approval", "{bool} NOT NULL DEFAULT false"},
+		},
+		constraints: []string{"PRIMARY KEY (id)"},
+		indexes: []schemaIndex{
+			{name: "idx_roles_name", unique: true, columns: []string{"name"}},
+			{name: "idx_roles_organization_id", columns: []string{"organization_id"}},
+		},
+	},
+	{
+		name: "permissions",
+		columns: []schemaColumn{
+			idColumn, createdAtColumn, updatedAtColumn,
+			{"name", "{text} NOT NULL"},
+			{"requires_approval", "{bool} NOT NULL DEFAULT false"},
+		},
+		constraints: []string{"PRIMARY KEY (id)"},
+		indexes:     []schemaIndex{{name: "idx_permissions_name", unique: true, columns: []string{"name"}}},
+	},
+	{
+		name: "bundles",
+		columns: []schemaColumn{
+			idColumn, createdAtColumn, updatedAtColumn,
+			{"name", "{text} NOT NULL"},
+		},
+		constraints: []string{"PRIMARY KEY (id)"},
+		indexes:     []schemaIndex{{name: "idx_bundles_name", unique: true, columns: []string{"name"}}},
+	},
+	{
+		name: "users_roles",
+		columns: []schemaColumn{
+			{"user_id", "{bigint}"},
+			{"role_id", "{bigint}"},
+			{"starts_at", "{time}"},
+			{"expires_at", "{time}"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (user_id, role_id)",
+			foreignKey("fk_users_roles_user", "user_id", "users", "CASCADE"),
+			foreignKey("fk_users_roles_role", "role_id", "roles", "CASCADE"),
+		},
+		indexes: []schemaIndex{{name: "idx_users_roles_expires_at", columns: []string{"expires_at"}}},
+	},
+	{
+		name: "granted_users_permissions",
+		columns: []schemaColumn{
+			{"user_id", "{bigint}"},
+			{"permission_id", "{bigint}"},
+			{"starts_at", "{time}"},
+			{"expires_at", "{time}"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (user_id, permission_id)",
+			foreignKey("fk_granted_users_permissions_user", "user_id", "users", ""),
+			foreignKey("fk_granted_users_permissions_permission", "permission_id", "permissions", ""),
+		},
+		indexes: []schemaIndex{{name: "idx_granted_users_permissions_expires_at", columns: []string{"expires_at"}}},
+	},
+	{
+		name: "revoked_users_permissions",
+		columns: []schemaColumn{
+			{"user_id", "{bigint}"},
+			{"permission_id", "{bigint}"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (user_id, permission_id)",
+			foreignKey("fk_revoked_users_permissions_user", "user_id", "users", ""),
+			foreignKey("fk_revoked_users_permissions_permission", "permission_id", "permissions", ""),
+		},
+	},
+	{
+		name: "users_bundles",
+		columns: []schemaColumn{
+			{"user_id", "{bigint}"},
+			{"bundle_id", "{bigint}"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (user_id, bundle_id)",
+			foreignKey("fk_users_bundles_user", "user_id", "users", "CASCADE"),
+			foreignKey("fk_users_bundles_bundle", "bundle_id", "bundles", "CASCADE"),
+		},
+	},
+	{
+		name: "roles_permissions",
+		columns: []schemaColumn{
+			{"role_id", "{bigint}"},
+			{"permission_id", "{bigint}"},
+			{"conditions", "{text}"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (role_id, permission_id)",
+			foreignKey("fk_roles_permissions_role", "role_id", "roles", "CASCADE"),
+			foreignKey("fk_roles_permissions_permission", "permission_id", "permissions", "CASCADE"),
+		},
+	},
+	{
+		name: "roles_parents",
+		columns: []schemaColumn{
+			{"role_id", "{bigint}"},
+			{"parent_id", "{bigint}"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (role_id, parent_id)",
+			foreignKey("fk_roles_parents_role", "role_id", "roles", "CASCADE"),
+			foreignKey("fk_roles_parents_parents", "parent_id", "roles", "CASCADE"),
+		},
+	},
+	{
+		name: "roles_bundles",
+		columns: []schemaColumn{
+			{"role_id", "{bigint}"},
+			{"bundle_id", "{bigint}"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (role_id, bundle_id)",
+			foreignKey("fk_roles_bundles_role", "role_id", "roles", "CASCADE"),
+			foreignKey("fk_roles_bundles_bundle", "bundle_id", "bundles", "CASCADE"),
+		},
+	},
+	{
+		name: "roles_managed_roles",
+		columns: []schemaColumn{
+			{"role_id", "{bigint}"},
+			{"managed_role_id", "{bigint}"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (role_id, managed_role_id)",
+			foreignKey("fk_roles_managed_roles_role", "role_id", "roles", "CASCADE"),
+			foreignKey("fk_roles_managed_roles_managed_roles", "managed_role_id", "roles", "CASCADE"),
+		},
+	},
+	{
+		name: "roles_managed_permissions",
+		columns: []schemaColumn{
+			{"role_id", "{bigint}"},
+			{"permission_id", "{bigint}"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (role_id, permission_id)",
+			foreignKey("fk_roles_managed_permissions_role", "role_id", "roles", "CASCADE"),
+			foreignKey("fk_roles_managed_permissions_permission", "permission_id", "permissions", "CASCADE"),
+		},
+	},
+	{
+		name: "bundles_permissions",
+		columns: []schemaColumn{
+			{"bundle_id", "{bigint}"},
+			{"permission_id", "{bigint}"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (bundle_id, permission_id)",
+			foreignKey("fk_bundles_permissions_bundle", "bundle_id", "bundles", "CASCADE"),
+			foreignKey("fk_bundles_permissions_permission", "permission_id", "permissions", "CASCADE"),
+		},
+	},
+	{
+		name: "scoped_users_permissions",
+		columns: []schemaColumn{
+			idColumn, createdAtColumn, updatedAtColumn,
+			{"user_id", "{bigint} NOT NULL"},
+			{"permission_id", "{bigint} NOT NULL"},
+			{"resource_type", "{text} NOT NULL"},
+			{"resource_id", "{bigint} NOT NULL"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (id)",
+			foreignKey("fk_users_scoped_permissions", "user_id", "users", "CASCADE"),
+			foreignKey("fk_scoped_users_permissions_permission", "permission_id", "permissions", "CASCADE"),
+		},
+		indexes: []schemaIndex{{
+			name:    "idx_scoped_users_permissions",
+			unique:  true,
+			columns: []string{"user_id", "permission_id", "resource_type", "resource_id"},
+		}},
+	},
+	{
+		name: "custom_users_permissions",
+		columns: []schemaColumn{
+			idColumn, createdAtColumn, updatedAtColumn,
+			{"user_id", "{bigint} NOT NULL"},
+			{"permission_id", "{bigint} NOT NULL"},
+			{"has_access", "{bool} NOT NULL"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (id)",
+			foreignKey("fk_custom_users_permissions_user", "user_id", "users", ""),
+			foreignKey("fk_custom_users_permissions_permission", "permission_id", "permissions", ""),
+		},
+	},
+	{
+		name: "memberships",
+		columns: []schemaColumn{
+			idColumn, createdAtColumn, updatedAtColumn,
+			{"organization_id", "{bigint} NOT NULL"},
+			{"user_id", "{bigint} NOT NULL"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (id)",
+			foreignKey("fk_organizations_members", "organization_id", "organizations", "CASCADE"),
+			foreignKey("fk_memberships_user", "user_id", "users", "CASCADE"),
+		},
+		indexes: []schemaIndex{{
+			name:    "idx_memberships_organization_user",
+			unique:  true,
+			columns: []string{"organization_id", "user_id"},
+		}},
+	},
+	{
+		name: "memberships_roles",
+		columns: []schemaColumn{
+			{"membership_id", "{bigint}"},
+			{"role_id", "{bigint}"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (membership_id, role_id)",
+			foreignKey("fk_memberships_roles_membership", "membership_id", "memberships", "CASCADE"),
+			foreignKey("fk_memberships_roles_role", "role_id", "roles", "CASCADE"),
+		},
+	},
+	{
+		name: "role_conflicts",
+		columns: []schemaColumn{
+			idColumn, createdAtColumn, updatedAtColumn,
+			{"role_id", "{bigint} NOT NULL"},
+			{"conflicting_role_id", "{bigint} NOT NULL"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (id)",
+			foreignKey("fk_role_conflicts_role", "role_id", "roles", "CASCADE"),
+			foreignKey("fk_role_conflicts_conflicting_role", "conflicting_role_id", "roles", "CASCADE"),
+		},
+		indexes: []schemaIndex{{
+			name:    "idx_role_conflicts_roles",
+			unique:  true,
+			columns: []string{"role_id", "conflicting_role_id"},
+		}},
+	},
+	{
+		name: "grant_requests",
+		columns: []schemaColumn{
+			idColumn, createdAtColumn, updatedAtColumn,
+			{"user_id", "{bigint} NOT NULL"},
+			{"kind", "{text} NOT NULL"},
+			{"target_id", "{bigint} NOT NULL"},
+			{"starts_at", "{time}"},
+			{"expires_at", "{time}"},
+			{"status", "{text} NOT NULL"},
+			{"requested_by_id", "{bigint} NOT NULL"},
+			{"pending_until", "{time} NOT NULL"},
+			{"decided_by_id", "{bigint}"},
+			{"decided_at", "{time}"},
+		},
+		constraints: []string{"PRIMARY KEY (id)"},
+		indexes: []schemaIndex{
+			{name: "idx_grant_requests_user_id", columns: []string{"user_id"}},
+			{name: "idx_grant_requests_expires_at", columns: []string{"expires_at"}},
+			{name: "idx_grant_requests_status", columns: []string{"status"}},
+		},
+	},
+	{
+		name: "elevations",
+		columns: []schemaColumn{
+			idColumn, createdAtColumn, updatedAtColumn,
+			{"user_id", "{bigint} NOT NULL"},
+			{"role_id", "{bigint} NOT NULL"},
+			{"reason", "{text} NOT NULL"},
+			{"expires_at", "{time} NOT NULL"},
+		},
+		constraints: []string{
+			"PRIMARY KEY (id)",
+			foreignKey("fk_users_elevations", "user_id", "users", "CASCADE"),
+			foreignKey("fk_elevations_role", "role_id", "roles", "CASCADE"),
+		},
+		indexes: []schemaIndex{
+			{name: "idx_elevations_user_id", columns: []string{"user_id"}},
+			{name: "idx_elevations_expires_at", columns: []string{"expires_at"}},
+		},
+	},
+}
+
+func upInitialSchema(tx *gorm.DB) error {
+	return createTables(tx, tablesV1)
+}
+
+func downInitialSchema(tx *gorm.DB) error {
+	return dropTables(tx, tablesV1)
+}
+
+// adoptInitialSchema reports whether the database was created before
+// versioned migrations and matches the initial schema, so version 1 can be
+// recorded without running it. It fails with every difference if the tables
+// exist but have drifted.
+//
+// AutoMigrate never created custom_users_permissions, no model referenced
+// it, so it is created here if it is missing.
+func adoptInitialSchema(tx *gorm.DB) (bool, error) {
+	if !anyTableExists(tx, tablesV1) {
+		return false, nil
+	}
+
+	if !tx.Migrator().HasTable("custom_users_permissions") {
+		if err := createTables(tx, []schemaTable{findTable(tablesV1, "custom_users_permissions")}); err != nil {
+			return false, err
+		}
+	}
+
+	drift, err := schemaDrift(tx, tablesV1)
+	if err != nil {
+		return false, err
+	}
+	if len(drift) > 0 {
+		return false, fmt.Errorf("%w, fix it by hand before migrating:\n  %s", ErrSchemaDrift, strings.Join(drift, "\n  "))
+	}
+	return true, nil
+}
@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"gorm.io/gorm"
+)
+
+// tokenMetadataColumns hold the client metadata captured at login and the
+// last use of a token.
+var tokenMetadataColumns = []schemaColumn{
+	{"ip", "{text}"},
+	{"user_agent", "{text}"},
+	{"device_label", "{text}"},
+	{"last_used_at", "{time}"},
+}
+
+var tokensV2 = findTable(tablesV1, "tokens").withColumns(tokenMetadataColumns)
+
+func upTokenMetadata(tx *gorm.DB) error {
+	return addColumns(tx, "tokens", tokenMetadataColumns)
+}
+
+func downTokenMetadata(tx *gorm.DB) error {
+	return dropColumns(tx, findTable(tablesV1, "tokens"), columnNames(tokenMetadataColumns))
+}
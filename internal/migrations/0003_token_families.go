@@ -0,0 +1,33 @@
+package migrations
+
+import (
+	"gorm.io/gorm"
+)
+
+// tokenFamilyColumns hold the token family shared by the access and refresh
+// tokens of a login, and the rotation time of refresh tokens.
+var tokenFamilyColumns = []schemaColumn{
+	{"family", "{text}"},
+	{"rotated_at", "{time}"},
+}
+
+var tokenFamilyIndex = schemaIndex{name: "idx_tokens_family", columns: []string{"family"}}
+
+func upTokenFamilies(tx *gorm.DB) error {
+	if err := addColumns(tx, "tokens", tokenFamilyColumns); err != nil {
+		return err
+	}
+
+	// every existing token is a family of its own.
+	if err := tx.Exec("UPDATE tokens SET family = 'legacy-' || id").Error; err != nil {
+		return err
+	}
+	return tx.Exec(tokenFamilyIndex.createStatement("tokens")).Error
+}
+
+func downTokenFamilies(tx *gorm.DB) error {
+	if err := tx.Exec("DROP INDEX " + tokenFamilyIndex.name).Error; err != nil {
+		return err
+	}
+	return dropColumns(tx, tokensV2, columnNames(tokenFamilyColumns))
+}
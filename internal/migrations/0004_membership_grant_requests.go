@@ -0,0 +1,22 @@
+package migrations
+
+import (
+	"gorm.io/gorm"
+)
+
+// membershipGrantRequestColumns hold the organization of grant requests for
+// roles of a membership, requests go away with their organization.
+var membershipGrantRequestColumns = []schemaColumn{
+	{"organization_id", "{bigint} REFERENCES organizations(id) ON DELETE CASCADE"},
+}
+
+func upMembershipGrantRequests(tx *gorm.DB) error {
+	return addColumns(tx, "grant_requests", membershipGrantRequestColumns)
+}
+
+func downMembershipGrantRequests(tx *gorm.DB) error {
+	if err := tx.Exec("DELETE FROM grant_requests WHERE organization_id IS NOT NULL").Error; err != nil {
+		return err
+	}
+	return dropColumns(tx, findTable(tablesV1, "grant_requests"), columnNames(membershipGrantRequestColumns))
+}
@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"gorm.io/gorm"
+)
+
+// Role names are unique among the global roles and within each organization,
+// so organizations can name their local roles freely.
+var (
+	roleGlobalNameIndex       = schemaIndex{name: "idx_roles_global_name", unique: true, columns: []string{"name"}, where: "organization_id IS NULL"}
+	roleOrganizationNameIndex = schemaIndex{name: "idx_roles_organization_name", unique: true, columns: []string{"organization_id", "name"}}
+	roleNameIndex             = schemaIndex{name: "idx_roles_name", unique: true, columns: []string{"name"}}
+)
+
+func upOrganizationRoleNames(tx *gorm.DB) error {
+	if err := tx.Exec("DROP INDEX " + roleNameIndex.name).Error; err != nil {
+		return err
+	}
+	if err := tx.Exec(roleGlobalNameIndex.createStatement("roles")).Error; err != nil {
+		return err
+	}
+	return tx.Exec(roleOrganizationNameIndex.createStatement("roles")).Error
+}
+
+// downOrganizationRoleNames fails if roles of different organizations, or an
+// organization role and a global role, share a name. They have to be renamed
+// first.
+func downOrganizationRoleNames(tx *gorm.DB) error {
+	for _, idx := range []schemaIndex{roleOrganizationNameIndex, roleGlobalNameIndex} {
+		if err := tx.Exec("DROP INDEX " + idx.name).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Exec(roleNameIndex.createStatement("roles")).Error
+}
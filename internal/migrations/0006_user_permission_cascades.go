@@ -0,0 +1,41 @@
+package migrations
+
+import (
+	"gorm.io/gorm"
+)
+
+// The custom grants and revocations of a user go away with the user or the
+// permission, like every other join of users and permissions.
+var userPermissionForeignKeys = map[string][]string{
+	"granted_users_permissions": {"fk_granted_users_permissions_user", "fk_granted_users_permissions_permission"},
+	"revoked_users_permissions": {"fk_revoked_users_permissions_user", "fk_revoked_users_permissions_permission"},
+}
+
+var userPermissionTablesV6 = []schemaTable{
+	findTable(tablesV1, "granted_users_permissions").withConstraints(
+		foreignKey("fk_granted_users_permissions_user", "user_id", "users", "CASCADE"),
+		foreignKey("fk_granted_users_permissions_permission", "permission_id", "permissions", "CASCADE"),
+	),
+	findTable(tablesV1, "revoked_users_permissions").withConstraints(
+		foreignKey("fk_revoked_users_permissions_user", "user_id", "users", "CASCADE"),
+		foreignKey("fk_revoked_users_permissions_permission", "permission_id", "permissions", "CASCADE"),
+	),
+}
+
+func upUserPermissionCascades(tx *gorm.DB) error {
+	for _, t := range userPermissionTablesV6 {
+		if err := replaceConstraints(tx, t, userPermissionForeignKeys[t.name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func downUserPermissionCascades(tx *gorm.DB) error {
+	for _, t := range userPermissionTablesV6 {
+		if err := replaceConstraints(tx, findTable(tablesV1, t.name), userPermissionForeignKeys[t.name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
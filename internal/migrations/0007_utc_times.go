@@ -0,0 +1,67 @@
+package migrations
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SQLite stores times as text with the offset they were written with and
+// compares them as text, times are written in UTC from now on (see
+// data.Open) and the stored ones are converted here. Postgres stores times
+// as instants, so there is nothing to convert there.
+func upUTCTimes(tx *gorm.DB) error {
+	if tx.Dialector.Name() != "sqlite" {
+		return nil
+	}
+
+	tables := append([]schemaTable(nil), tablesV1...)
+	tables = append(tables, schemaTable{name: "tokens", columns: append(append([]schemaColumn(nil), tokenMetadataColumns...), tokenFamilyColumns...)})
+	for _, t := range tables {
+		for _, c := range t.columns {
+			if !strings.HasPrefix(c.definition, "{time}") {
+				continue
+			}
+			if err := convertToUTC(tx, t.name, c.name); err != nil {
+				return fmt.Errorf("%s.%s: %w", t.name, c.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// downUTCTimes keeps the times in UTC, they are read the same either way.
+func downUTCTimes(tx *gorm.DB) error {
+	return nil
+}
+
+func convertToUTC(tx *gorm.DB, table, column string) error {
+	rows, err := tx.Raw(fmt.Sprintf("SELECT rowid, %s FROM %s WHERE %s IS NOT NULL AND %s NOT LIKE '%%+00:00'", column, table, column, column)).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	times := make(map[int64]time.Time)
+	for rows.Next() {
+		var rowID int64
+		var t time.Time
+		if err := rows.Scan(&rowID, &t); err != nil {
+			return err
+		}
+		times[rowID] = t.UTC()
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for rowID, t := range times {
+		if err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE rowid = ?", table, column), t, rowID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
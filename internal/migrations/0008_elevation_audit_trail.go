@@ -0,0 +1,85 @@
+package migrations
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Elevations are the audit trail of break-glass access, they outlive their
+// user and role. The ids are cleared instead and the row keeps the email of
+// the user and the name of the role.
+var elevationAuditColumns = []schemaColumn{
+	{"user_email", "{text} NOT NULL DEFAULT ''"},
+	{"role_name", "{text} NOT NULL DEFAULT ''"},
+}
+
+var elevationForeignKeys = []string{"fk_users_elevations", "fk_elevations_role"}
+
+var elevationsV8 = schemaTable{
+	name: "elevations",
+	columns: []schemaColumn{
+		idColumn, createdAtColumn, updatedAtColumn,
+		{"user_id", "{bigint}"},
+		{"role_id", "{bigint}"},
+		{"reason", "{text} NOT NULL"},
+		{"expires_at", "{time} NOT NULL"},
+		elevationAuditColumns[0],
+		elevationAuditColumns[1],
+	},
+	constraints: []string{
+		"PRIMARY KEY (id)",
+		foreignKey("fk_users_elevations", "user_id", "users", "SET NULL"),
+		foreignKey("fk_elevations_role", "role_id", "roles", "SET NULL"),
+	},
+	indexes: findTable(tablesV1, "elevations").indexes,
+}
+
+func upElevationAuditTrail(tx *gorm.DB) error {
+	if err := addColumns(tx, "elevations", elevationAuditColumns); err != nil {
+		return err
+	}
+
+	statements := []string{
+		"UPDATE elevations SET user_email = COALESCE((SELECT email FROM users WHERE users.id = elevations.user_id), '')",
+		"UPDATE elevations SET role_name = COALESCE((SELECT name FROM roles WHERE roles.id = elevations.role_id), '')",
+	}
+	for _, statement := range statements {
+		if err := tx.Exec(statement).Error; err != nil {
+			return fmt.Errorf("elevations: %w", err)
+		}
+	}
+
+	if tx.Dialector.Name() == "sqlite" {
+		return rebuildTable(tx, elevationsV8)
+	}
+	for _, column := range []string{"user_id", "role_id"} {
+		if err := tx.Exec(fmt.Sprintf("ALTER TABLE elevations ALTER COLUMN %s DROP NOT NULL", column)).Error; err != nil {
+			return fmt.Errorf("elevations: %w", err)
+		}
+	}
+	return replaceConstraints(tx, elevationsV8, elevationForeignKeys)
+}
+
+// downElevationAuditTrail deletes the elevations of deleted users and roles,
+// the previous schema can not hold them.
+func downElevationAuditTrail(tx *gorm.DB) error {
+	elevationsV1 := findTable(tablesV1, "elevations")
+
+	if err := tx.Exec("DELETE FROM elevations WHERE user_id IS NULL OR role_id IS NULL").Error; err != nil {
+		return fmt.Errorf("elevations: %w", err)
+	}
+
+	if tx.Dialector.Name() == "sqlite" {
+		return rebuildTable(tx, elevationsV1)
+	}
+	for _, column := range []string{"user_id", "role_id"} {
+		if err := tx.Exec(fmt.Sprintf("ALTER TABLE elevations ALTER COLUMN %s SET NOT NULL", column)).Error; err != nil {
+			return fmt.Errorf("elevations: %w", err)
+		}
+	}
+	if err := replaceConstraints(tx, elevationsV1, elevationForeignKeys); err != nil {
+		return err
+	}
+	return dropColumns(tx, elevationsV1, columnNames(elevationAuditColumns))
+}
@@ -0,0 +1,7 @@
+package migrations
+
+// Exported for the tests in package migrations_test.
+var (
+	All           = all
+	TestDatabases = testDatabases
+)
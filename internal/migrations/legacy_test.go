@@ -0,0 +1,224 @@
+package migrations_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kubil6y/myshop-go/internal/migrations"
+	"gorm.io/gorm"
+)
+
+// The models below are a snapshot of the data package before versioned
+// migrations, when every boot ran AutoMigrate on them. Only the fields and
+// tags that shape the schema are kept, the names must stay as they were
+// since gorm derives table, column and index names from them.
+
+type CoreModel struct {
+	ID        int64 `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type GrantWindow struct {
+	StartsAt  *time.Time
+	ExpiresAt *time.Time `gorm:"index"`
+}
+
+type User struct {
+	CoreModel
+	FirstName          string                 `gorm:"not null"`
+	LastName           string                 `gorm:"not null"`
+	Email              string                 `gorm:"uniqueIndex;not null"`
+	Password           []byte                 `gorm:"not null"`
+	IsActivated        bool                   `gorm:"default:false;not null"`
+	IsAdmin            bool                   `gorm:"default:false;not null"`
+	Tokens             []Token                `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	Roles              []Role                 `gorm:"many2many:users_roles;constraint:OnDelete:CASCADE"`
+	GrantedPermissions []Permission           `gorm:"many2many:granted_users_permissions"`
+	RevokedPermissions []Permission           `gorm:"many2many:revoked_users_permissions"`
+	ScopedPermissions  []ScopedUserPermission `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	Elevations         []Elevation            `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	Bundles            []Bundle               `gorm:"many2many:users_bundles;constraint:OnDelete:CASCADE"`
+}
+
+type Token struct {
+	CoreModel
+	Hash   []byte
+	Scope  string
+	Expiry time.Time
+	UserID int64
+}
+
+type Role struct {
+	CoreModel
+	Name               string       `gorm:"uniqueIndex;not null"`
+	Permissions        []Permission `gorm:"many2many:roles_permissions;constraint:OnDelete:CASCADE"`
+	Parents            []Role       `gorm:"many2many:roles_parents;joinForeignKey:RoleID;joinReferences:ParentID;constraint:OnDelete:CASCADE"`
+	Bundles            []Bundle     `gorm:"many2many:roles_bundles;constraint:OnDelete:CASCADE"`
+	Users              []User       `gorm:"many2many:users_roles;constraint:OnDelete:CASCADE"`
+	OrganizationID     *int64       `gorm:"index"`
+	RequiresApproval   bool         `gorm:"default:false;not null"`
+	ManagedRoles       []Role       `gorm:"many2many:roles_managed_roles;joinForeignKey:RoleID;joinReferences:ManagedRoleID;constraint:OnDelete:CASCADE"`
+	ManagedPermissions []Permission `gorm:"many2many:roles_managed_permissions;constraint:OnDelete:CASCADE"`
+}
+
+type Permission struct {
+	CoreModel
+	Name             string `gorm:"uniqueIndex;not null"`
+	Roles            []Role `gorm:"many2many:roles_permissions;constraint:OnDelete:CASCADE"`
+	RequiresApproval bool   `gorm:"default:false;not null"`
+}
+
+type UserRole struct {
+	UserID int64 `gorm:"primaryKey"`
+	RoleID int64 `gorm:"primaryKey"`
+	GrantWindow
+}
+
+func (UserRole) TableName() string {
+	return "users_roles"
+}
+
+type GrantedUserPermission struct {
+	UserID       int64 `gorm:"primaryKey"`
+	PermissionID int64 `gorm:"primaryKey"`
+	GrantWindow
+}
+
+func (GrantedUserPermission) TableName() string {
+	return "granted_users_permissions"
+}
+
+type RolePermission struct {
+	RoleID       int64  `gorm:"primaryKey"`
+	PermissionID int64  `gorm:"primaryKey"`
+	Conditions   string `gorm:"type:text"`
+}
+
+func (RolePermission) TableName() string {
+	return "roles_permissions"
+}
+
+type ScopedUserPermission struct {
+	CoreModel
+	UserID       int64      `gorm:"not null;uniqueIndex:idx_scoped_users_permissions"`
+	PermissionID int64      `gorm:"not null;uniqueIndex:idx_scoped_users_permissions"`
+	Permission   Permission `gorm:"constraint:OnDelete:CASCADE"`
+	ResourceType string     `gorm:"not null;uniqueIndex:idx_scoped_users_permissions"`
+	ResourceID   int64      `gorm:"not null;uniqueIndex:idx_scoped_users_permissions"`
+}
+
+func (ScopedUserPermission) TableName() string {
+	return "scoped_users_permissions"
+}
+
+type Organization struct {
+	CoreModel
+	Name    string       `gorm:"uniqueIndex;not null"`
+	Members []Membership `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+type Membership struct {
+	CoreModel
+	OrganizationID int64  `gorm:"not null;uniqueIndex:idx_memberships_organization_user"`
+	UserID         int64  `gorm:"not null;uniqueIndex:idx_memberships_organization_user"`
+	User           *User  `gorm:"constraint:OnDelete:CASCADE"`
+	Roles          []Role `gorm:"many2many:memberships_roles;constraint:OnDelete:CASCADE"`
+}
+
+type RoleConflict struct {
+	CoreModel
+	RoleID            int64 `gorm:"not null;uniqueIndex:idx_role_conflicts_roles"`
+	Role              Role  `gorm:"constraint:OnDelete:CASCADE"`
+	ConflictingRoleID int64 `gorm:"not null;uniqueIndex:idx_role_conflicts_roles"`
+	ConflictingRole   Role  `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+type GrantRequest struct {
+	CoreModel
+	UserID   int64  `gorm:"not null;index"`
+	Kind     string `gorm:"not null"`
+	TargetID int64  `gorm:"not null"`
+	GrantWindow
+	Status        string    `gorm:"not null;index"`
+	RequestedByID int64     `gorm:"not null"`
+	PendingUntil  time.Time `gorm:"not null"`
+	DecidedByID   *int64
+	DecidedAt     *time.Time
+}
+
+type Elevation struct {
+	CoreModel
+	UserID    int64     `gorm:"not null;index"`
+	RoleID    int64     `gorm:"not null"`
+	Role      Role      `gorm:"constraint:OnDelete:CASCADE"`
+	Reason    string    `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+type Bundle struct {
+	CoreModel
+	Name        string       `gorm:"uniqueIndex;not null"`
+	Permissions []Permission `gorm:"many2many:bundles_permissions;constraint:OnDelete:CASCADE"`
+}
+
+// autoMigrateLegacy creates the schema the way the pre-migration boot did.
+func autoMigrateLegacy(db *gorm.DB) error {
+	joins := []struct {
+		model     interface{}
+		field     string
+		joinTable interface{}
+	}{
+		{&Role{}, "Permissions", &RolePermission{}},
+		{&Permission{}, "Roles", &RolePermission{}},
+		{&User{}, "Roles", &UserRole{}},
+		{&Role{}, "Users", &UserRole{}},
+		{&User{}, "GrantedPermissions", &GrantedUserPermission{}},
+	}
+	for _, j := range joins {
+		if err := db.SetupJoinTable(j.model, j.field, j.joinTable); err != nil {
+			return err
+		}
+	}
+
+	return db.AutoMigrate(
+		&User{},
+		&Token{},
+		&Role{},
+		&Permission{},
+		&ScopedUserPermission{},
+		&Organization{},
+		&Membership{},
+		&RoleConflict{},
+		&GrantRequest{},
+		&Elevation{},
+		&Bundle{},
+	)
+}
+
+func TestUpAdoptsLegacySchema(t *testing.T) {
+	for driver, open := range migrations.TestDatabases() {
+		t.Run(driver, func(t *testing.T) {
+			db := open(t)
+			if err := autoMigrateLegacy(db); err != nil {
+				t.Fatal(err)
+			}
+
+			applied, err := migrations.Up(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(applied) != len(migrations.All) {
+				t.Fatalf("applied %d migrations, want %d", len(applied), len(migrations.All))
+			}
+			for _, a := range applied {
+				if want := a.Version == 1; a.Adopted != want {
+					t.Fatalf("migration %d adopted: %v, want %v", a.Version, a.Adopted, want)
+				}
+			}
+			if err := migrations.Check(db); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
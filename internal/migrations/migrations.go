@@ -0,0 +1,210 @@
+// Package migrations holds the ordered, versioned changes of the database
+// schema. The applied versions are recorded in the schema_migrations table.
+//
+// A migration must never change once it is released, so migrations write
+// their tables out as DDL (see schemaTable) instead of deriving them from the
+// models in internal/data. A schema change is a new migration appended to
+// the list.
+//
+// Databases created before versioned migrations have the tables of the
+// initial schema but no version table. The initial migration adopts them
+// when they match its definition and fails with ErrSchemaDrift otherwise.
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSchemaBehind = errors.New("database schema is behind")
+	ErrSchemaDrift  = errors.New("database schema differs from the migrations")
+)
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+	// Adopt is optional, it reports whether the changes of the migration
+	// are already in the database, so the version is recorded without
+	// running Up.
+	Adopt func(tx *gorm.DB) (bool, error)
+}
+
+// Applied is a migration applied by Up.
+type Applied struct {
+	Migration
+	// Adopted is set if the migration was found in the database and only
+	// recorded.
+	Adopted bool
+}
+
+// all is every migration, ordered by version.
+var all = []Migration{
+	{Version: 1, Name: "initial schema", Up: upInitialSchema, Down: downInitialSchema, Adopt: adoptInitialSchema},
+	{Version: 2, Name: "token metadata", Up: upTokenMetadata, Down: downTokenMetadata},
+	{Version: 3, Name: "token families", Up: upTokenFamilies, Down: downTokenFamilies},
+	{Version: 4, Name: "membership grant requests", Up: upMembershipGrantRequests, Down: downMembershipGrantRequests},
+	{Version: 5, Name: "organization role names", Up: upOrganizationRoleNames, Down: downOrganizationRoleNames},
+	{Version: 6, Name: "user permission cascades", Up: upUserPermissionCascades, Down: downUserPermissionCascades},
+	{Version: 7, Name: "utc times", Up: upUTCTimes, Down: downUTCTimes},
+	{Version: 8, Name: "elevation audit trail", Up: upElevationAuditTrail, Down: downElevationAuditTrail},
+}
+
+// schemaMigration is a row of the schema version table.
+type schemaMigration struct {
+	Version   int64     `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// Status is a migration and whether it is applied.
+type Status struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Latest returns the version the code expects.
+func Latest() int64 {
+	return all[len(all)-1].Version
+}
+
+// Up applies every pending migration in order, each one in its own
+// transaction, and returns the applied ones.
+func Up(db *gorm.DB) ([]Applied, error) {
+	if err := db.Migrator().AutoMigrate(&schemaMigration{}); err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Applied
+	for _, m := range all {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		a := Applied{Migration: m}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if m.Adopt != nil {
+				adopted, err := m.Adopt(tx)
+				if err != nil {
+					return err
+				}
+				a.Adopted = adopted
+			}
+			if !a.Adopted {
+				if err := m.Up(tx); err != nil {
+					return err
+				}
+			}
+			return tx.Create(&schemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return result, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		result = append(result, a)
+	}
+	return result, nil
+}
+
+// Down rolls back the last steps applied migrations, newest first, and
+// returns the rolled back ones.
+func Down(db *gorm.DB, steps int) ([]Migration, error) {
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Migration
+	for i := len(all) - 1; i >= 0 && len(result) < steps; i-- {
+		m := all[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&schemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return result, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+// StatusOf returns every migration with the time it was applied, nil for
+// pending ones.
+func StatusOf(db *gorm.DB) ([]Status, error) {
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Status, 0, len(all))
+	for _, m := range all {
+		s := Status{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			s.AppliedAt = &at
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// Check returns ErrSchemaBehind if a migration is pending.
+func Check(db *gorm.DB) error {
+	statuses, err := StatusOf(db)
+	if err != nil {
+		return err
+	}
+
+	var pending int
+	var current int64
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			pending++
+			continue
+		}
+		current = s.Version
+	}
+	if pending > 0 {
+		return fmt.Errorf("%w: at version %d, %d migrations pending up to version %d", ErrSchemaBehind, current, pending, Latest())
+	}
+	return nil
+}
+
+// appliedVersions returns the applied versions with the time they were
+// applied, none if the version table does not exist yet.
+func appliedVersions(db *gorm.DB) (map[int64]time.Time, error) {
+	applied := make(map[int64]time.Time)
+	if !db.Migrator().HasTable(&schemaMigration{}) {
+		return applied, nil
+	}
+
+	var rows []schemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		applied[row.Version] = row.AppliedAt
+	}
+	return applied, nil
+}
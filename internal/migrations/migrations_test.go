@@ -0,0 +1,93 @@
+package migrations
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kubil6y/myshop-go/internal/data"
+	"gorm.io/gorm"
+)
+
+// testPostgresDSN names the environment variable with the DSN of a Postgres
+// database for the tests. The database is wiped, it must be a throwaway one.
+const testPostgresDSN = "MYSHOP_TEST_POSTGRES_DSN"
+
+// testDatabases returns an empty database of every supported driver. Postgres
+// is skipped unless testPostgresDSN is set.
+func testDatabases() map[string]func(t *testing.T) *gorm.DB {
+	return map[string]func(t *testing.T) *gorm.DB{
+		"sqlite": func(t *testing.T) *gorm.DB {
+			db, err := data.Open(data.DriverSQLite, filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"postgres": func(t *testing.T) *gorm.DB {
+			dsn := os.Getenv(testPostgresDSN)
+			if dsn == "" {
+				t.Skipf("%s is not set", testPostgresDSN)
+			}
+			db, err := data.Open(data.DriverPostgres, dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public").Error; err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	for driver, open := range testDatabases() {
+		t.Run(driver, func(t *testing.T) {
+			db := open(t)
+
+			applied, err := Up(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(applied) != len(all) {
+				t.Fatalf("applied %d migrations, want %d", len(applied), len(all))
+			}
+			if err := Check(db); err != nil {
+				t.Fatal(err)
+			}
+
+			applied, err = Up(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(applied) != 0 {
+				t.Fatalf("applied %d migrations on an up to date schema", len(applied))
+			}
+
+			// every migration is rolled back and applied again on its own.
+			for i := len(all) - 1; i >= 0; i-- {
+				rolledBack, err := Down(db, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(rolledBack) != 1 || rolledBack[0].Version != all[i].Version {
+					t.Fatalf("rolled back %v, want version %d", rolledBack, all[i].Version)
+				}
+			}
+			for _, table := range tablesV1 {
+				if db.Migrator().HasTable(table.name) {
+					t.Fatalf("table %s is left after rolling back every migration", table.name)
+				}
+			}
+
+			applied, err = Up(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(applied) != len(all) {
+				t.Fatalf("applied %d migrations after rolling back, want %d", len(applied), len(all))
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package migrations
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// schemaTable is a table written out as DDL. Column and constraint
+// definitions use the type placeholders of dialectTypes, so the same
+// definition creates the table on every supported database.
+type schemaTable struct {
+	name        string
+	columns     []schemaColumn
+	constraints []string
+	indexes     []schemaIndex
+}
+
+type schemaColumn struct {
+	name       string
+	definition string
+}
+
+type schemaIndex struct {
+	name    string
+	unique  bool
+	columns []string
+	// where makes it a partial index.
+	where string
+}
+
+// dialectTypes maps the type placeholders to the types of a dialect. The
+// types are the ones gorm picked before versioned migrations, so that
+// adopted databases and created ones do not differ.
+var dialectTypes = map[string]*strings.Replacer{
+	"postgres": strings.NewReplacer(
+		"{serial}", "bigserial",
+		"{bigint}", "bigint",
+		"{time}", "timestamptz",
+		"{bytes}", "bytea",
+		"{bool}", "boolean",
+		"{text}", "text",
+	),
+	"sqlite": strings.NewReplacer(
+		"{serial}", "integer",
+		"{bigint}", "integer",
+		"{time}", "datetime",
+		"{bytes}", "blob",
+		"{bool}", "numeric",
+		"{text}", "text",
+	),
+}
+
+func typesOf(tx *gorm.DB) (*strings.Replacer, error) {
+	types, ok := dialectTypes[tx.Dialector.Name()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database dialect %q", tx.Dialector.Name())
+	}
+	return types, nil
+}
+
+func (t schemaTable) createStatements(types *strings.Replacer) []string {
+	var defs []string
+	for _, c := range t.columns {
+		defs = append(defs, c.name+" "+c.definition)
+	}
+	defs = append(defs, t.constraints...)
+
+	statements := []string{
+		types.Replace(fmt.Sprintf("CREATE TABLE %s (%s)", t.name, strings.Join(defs, ", "))),
+	}
+	for _, idx := range t.indexes {
+		statements = append(statements, idx.createStatement(t.name))
+	}
+	return statements
+}
+
+func (idx schemaIndex) createStatement(table string) string {
+	unique := ""
+	if idx.unique {
+		unique = "UNIQUE "
+	}
+	statement := fmt.Sprintf("CREATE %sINDEX %s ON %s (%s)", unique, idx.name, table, strings.Join(idx.columns, ", "))
+	if idx.where != "" {
+		statement += " WHERE " + idx.where
+	}
+	return statement
+}
+
+// createTables creates the tables in order.
+func createTables(tx *gorm.DB, tables []schemaTable) error {
+	types, err := typesOf(tx)
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		for _, statement := range t.createStatements(types) {
+			if err := tx.Exec(statement).Error; err != nil {
+				return fmt.Errorf("%s: %w", t.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// dropTables drops the tables in reverse order.
+func dropTables(tx *gorm.DB, tables []schemaTable) error {
+	for i := len(tables) - 1; i >= 0; i-- {
+		if err := tx.Exec("DROP TABLE IF EXISTS " + tables[i].name).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// anyTableExists reports whether one of the tables is in the database.
+func anyTableExists(tx *gorm.DB, tables []schemaTable) bool {
+	for _, t := range tables {
+		if tx.Migrator().HasTable(t.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaDrift compares the tables in the database with their definitions
+// and returns every difference: missing tables, missing or unexpected
+// columns and missing indexes.
+func schemaDrift(tx *gorm.DB, tables []schemaTable) ([]string, error) {
+	var drift []string
+	for _, t := range tables {
+		if !tx.Migrator().HasTable(t.name) {
+			drift = append(drift, fmt.Sprintf("table %s is missing", t.name))
+			continue
+		}
+
+		columnTypes, err := tx.Migrator().ColumnTypes(t.name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t.name, err)
+		}
+		existing := make(map[string]bool)
+		for _, ct := range columnTypes {
+			existing[ct.Name()] = true
+		}
+
+		expected := make(map[string]bool)
+		for _, c := range t.columns {
+			expected[c.name] = true
+			if !existing[c.name] {
+				drift = append(drift, fmt.Sprintf("table %s: column %s is missing", t.name, c.name))
+			}
+		}
+		var unexpected []string
+		for name := range existing {
+			if !expected[name] {
+				unexpected = append(unexpected, name)
+			}
+		}
+		sort.Strings(unexpected)
+		for _, name := range unexpected {
+			drift = append(drift, fmt.Sprintf("table %s: column %s is not in the schema", t.name, name))
+		}
+
+		for _, idx := range t.indexes {
+			ok, err := hasIndex(tx, t.name, idx.name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", t.name, err)
+			}
+			if !ok {
+				drift = append(drift, fmt.Sprintf("table %s: index %s is missing", t.name, idx.name))
+			}
+		}
+	}
+	return drift, nil
+}
+
+func hasIndex(tx *gorm.DB, table, name string) (bool, error) {
+	var count int64
+	var err error
+	switch tx.Dialector.Name() {
+	case "postgres":
+		err = tx.Raw("SELECT count(*) FROM pg_indexes WHERE schemaname = current_schema() AND tablename = ? AND indexname = ?", table, name).Scan(&count).Error
+	case "sqlite":
+		err = tx.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND name = ?", table, name).Scan(&count).Error
+	default:
+		return false, fmt.Errorf("unsupported database dialect %q", tx.Dialector.Name())
+	}
+	return count > 0, err
+}
+
+// findTable returns the table with the name, it panics if there is none so
+// a typo in a migration shows up right away.
+func findTable(tables []schemaTable, name string) schemaTable {
+	for _, t := range tables {
+		if t.name == name {
+			return t
+		}
+	}
+	panic("migrations: unknown table " + name)
+}
+
+// withColumns returns a copy of the table with the columns and indexes added.
+func (t schemaTable) withColumns(columns []schemaColumn, indexes ...schemaIndex) schemaTable {
+	c := t
+	c.columns = append(append([]schemaColumn(nil), t.columns...), columns...)
+	c.indexes = append(append([]schemaIndex(nil), t.indexes...), indexes...)
+	return c
+}
+
+// withConstraints returns a copy of the table with the named constraints
+// replaced by the given ones, which must have the same names.
+func (t schemaTable) withConstraints(constraints ...string) schemaTable {
+	c := t
+	c.constraints = append([]string(nil), t.constraints...)
+	for _, replacement := range constraints {
+		name := strings.Fields(replacement)[1]
+		for i, existing := range c.constraints {
+			if strings.HasPrefix(existing, "CONSTRAINT "+name+" ") {
+				c.constraints[i] = replacement
+			}
+		}
+	}
+	return c
+}
+
+func columnNames(columns []schemaColumn) []string {
+	var names []string
+	for _, c := range columns {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+func addColumns(tx *gorm.DB, table string, columns []schemaColumn) error {
+	types, err := typesOf(tx)
+	if err != nil {
+		return err
+	}
+	for _, c := range columns {
+		statement := types.Replace(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, c.name, c.definition))
+		if err := tx.Exec(statement).Error; err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// dropColumns removes the columns that target, the definition of the table
+// without them, does not have. SQLite cannot drop columns, the table is
+// rebuilt from target there, so it must not be referenced by other tables.
+func dropColumns(tx *gorm.DB, target schemaTable, columns []string) error {
+	if tx.Dialector.Name() != "sqlite" {
+		for _, name := range columns {
+			if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", target.name, name)).Error; err != nil {
+				return fmt.Errorf("%s: %w", target.name, err)
+			}
+		}
+		return nil
+	}
+	return rebuildTable(tx, target)
+}
+
+// replaceConstraints changes the named constraints of a table to the ones of
+// target, the definition of the table with the changed constraints. SQLite
+// cannot alter constraints, the table is rebuilt from target there, so it
+// must not be referenced by other tables.
+func replaceConstraints(tx *gorm.DB, target schemaTable, names []string) error {
+	if tx.Dialector.Name() == "sqlite" {
+		return rebuildTable(tx, target)
+	}
+
+	for _, name := range names {
+		if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", target.name, name)).Error; err != nil {
+			return fmt.Errorf("%s: %w", target.name, err)
+		}
+		if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD %s", target.name, target.constraint(name))).Error; err != nil {
+			return fmt.Errorf("%s: %w", target.name, err)
+		}
+	}
+	return nil
+}
+
+// constraint returns the definition of the named constraint.
+func (t schemaTable) constraint(name string) string {
+	for _, c := range t.constraints {
+		if strings.HasPrefix(c, "CONSTRAINT "+name+" ") {
+			return c
+		}
+	}
+	panic("migrations: unknown constraint " + name + " of " + t.name)
+}
+
+// rebuildTable recreates a SQLite table from its definition and copies the
+// rows of the columns that are defined, the way SQLite documents changing
+// tables.
+func rebuildTable(tx *gorm.DB, target schemaTable) error {
+	types, err := typesOf(tx)
+	if err != nil {
+		return err
+	}
+
+	rebuilt := target
+	rebuilt.name = target.name + "__rebuild"
+	rebuilt.indexes = nil
+	columns := strings.Join(columnNames(target.columns), ", ")
+
+	statements := rebuilt.createStatements(types)
+	statements = append(statements,
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", rebuilt.name, columns, columns, target.name),
+		fmt.Sprintf("DROP TABLE %s", target.name),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", rebuilt.name, target.name),
+	)
+	for _, idx := range target.indexes {
+		statements = append(statements, idx.createStatement(target.name))
+	}
+
+	for _, statement := range statements {
+		if err := tx.Exec(statement).Error; err != nil {
+			return fmt.Errorf("%s: %w", target.name, err)
+		}
+	}
+	return nil
+}